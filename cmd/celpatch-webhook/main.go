@@ -0,0 +1,349 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command celpatch-webhook serves a mutating admission webhook and a CustomResourceDefinition
+// conversion webhook that mutate and convert resources using CEL.
+//
+// Usage:
+//
+//	celpatch-webhook [-addr <address>] [-tls-cert-file <file> -tls-private-key-file <file>] [-crd <file>]... [-mode basic|apply|template] [-mutation <Kind.version.group>=<patch file>]... [-policy <file>]... [-conversion <Kind.version.group>:<version>=<patch file>]...
+//
+// Each -mutation mutates the resources of a kind, such as Pod.v1 or Deployment.v1.apps, with the
+// patch in the patch file. Each -policy file contains MutationPolicies, which select the resources
+// they mutate by kind, namespace and labels, and ConversionPolicies, which convert custom resources
+// between the versions of a CustomResourceDefinition. The schemas of built-in kinds are resolved from the OpenAPI documents
+// embedded in the binary, and the schemas of custom resources from the CustomResourceDefinitions
+// given with -crd. Each -conversion converts the custom resources of a kind and version to another
+// version of the same CustomResourceDefinition. The mutating webhook is served at /mutate and the
+// conversion webhook at /convert, over HTTPS if a certificate is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/builtin"
+	"jpbetz.github.com/celpatch/pkg/crd"
+	"jpbetz.github.com/celpatch/pkg/policy"
+	"jpbetz.github.com/celpatch/pkg/webhook"
+)
+
+const (
+	modeBasic    = "basic"
+	modeApply    = "apply"
+	modeTemplate = "template"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+type options struct {
+	addr           string
+	certFile       string
+	keyFile        string
+	mode           string
+	crdFiles       stringsFlag
+	mutationArgs   stringsFlag
+	policyFiles    stringsFlag
+	policies       []*policy.Policies
+	conversionArgs stringsFlag
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func parseOptions(args []string, stderr io.Writer) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("celpatch-webhook", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&o.addr, "addr", ":8443", "address to serve the webhook on")
+	fs.StringVar(&o.certFile, "tls-cert-file", "", "file containing the TLS certificate to serve with")
+	fs.StringVar(&o.keyFile, "tls-private-key-file", "", "file containing the private key of the TLS certificate")
+	fs.StringVar(&o.mode, "mode", modeBasic, "how patches are applied: basic (merge the result of the expression), apply (objects.apply() the result of the expression) or template")
+	fs.Var(&o.crdFiles, "crd", "CustomResourceDefinition file providing the schemas of custom resources (may be repeated)")
+	fs.Var(&o.mutationArgs, "mutation", "<Kind.version.group>=<patch file> mutation of the resources of a kind (may be repeated)")
+	fs.Var(&o.policyFiles, "policy", "file containing MutationPolicies and ConversionPolicies (may be repeated)")
+	fs.Var(&o.conversionArgs, "conversion", "<Kind.version.group>:<version>=<patch file> conversion of the custom resources of a kind and version to another version (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	switch o.mode {
+	case modeBasic, modeApply, modeTemplate:
+	default:
+		return nil, fmt.Errorf("unsupported -mode %q, must be one of: basic, apply, template", o.mode)
+	}
+	if (len(o.certFile) == 0) != (len(o.keyFile) == 0) {
+		return nil, fmt.Errorf("-tls-cert-file and -tls-private-key-file must be specified together")
+	}
+	if len(o.mutationArgs) == 0 && len(o.policyFiles) == 0 && len(o.conversionArgs) == 0 {
+		return nil, fmt.Errorf("at least one -mutation, -policy or -conversion is required")
+	}
+	for _, file := range o.policyFiles {
+		policies, err := policy.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		o.policies = append(o.policies, policies)
+	}
+	return o, nil
+}
+
+func run(args []string, stderr io.Writer) error {
+	o, err := parseOptions(args, stderr)
+	if err != nil {
+		return err
+	}
+	handler, err := newHandler(o)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: o.addr, Handler: handler}
+	fmt.Fprintf(stderr, "serving webhooks on %s\n", o.addr)
+	if len(o.certFile) > 0 {
+		return server.ListenAndServeTLS(o.certFile, o.keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// newHandler returns the handler serving the webhooks with the mutations and conversions of the
+// options.
+func newHandler(o *options) (http.Handler, error) {
+	schemas, err := newSchemaResolver(o.crdFiles)
+	if err != nil {
+		return nil, err
+	}
+	mutating, err := newMutatingWebhook(o, schemas)
+	if err != nil {
+		return nil, err
+	}
+	conversion, err := newConversionWebhook(o, schemas)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", mutating)
+	mux.Handle("/convert", conversion)
+	return mux, nil
+}
+
+func newMutatingWebhook(o *options, schemas *schemaResolver) (*webhook.MutatingWebhook, error) {
+	w := webhook.NewMutatingWebhook()
+	for _, arg := range o.mutationArgs {
+		kind, patchFile, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -mutation %q, must be of the form <Kind.version.group>=<patch file>", arg)
+		}
+		gvk, err := parseGroupVersionKind(kind, "-mutation")
+		if err != nil {
+			return nil, err
+		}
+		s, err := schemas.ResolveSchema(gvk)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := readYAMLFile(patchFile)
+		if err != nil {
+			return nil, err
+		}
+		mutation, err := compileMutation(o.mode, s, patch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %s: %w", patchFile, err)
+		}
+		w.Register(gvk, mutation)
+	}
+	for _, policies := range o.policies {
+		for _, p := range policies.MutationPolicies {
+			compiled, err := policy.CompileMutationPolicy(p, schemas)
+			if err != nil {
+				return nil, err
+			}
+			w.RegisterPolicy(compiled)
+		}
+	}
+	return w, nil
+}
+
+func newConversionWebhook(o *options, schemas *schemaResolver) (*webhook.ConversionWebhook, error) {
+	w := webhook.NewConversionWebhook()
+	for _, arg := range o.conversionArgs {
+		versions, patchFile, ok := strings.Cut(arg, "=")
+		from, toVersion, ok2 := strings.Cut(versions, ":")
+		if !ok || !ok2 || len(toVersion) == 0 {
+			return nil, fmt.Errorf("invalid -conversion %q, must be of the form <Kind.version.group>:<version>=<patch file>", arg)
+		}
+		gvk, err := parseGroupVersionKind(from, "-conversion")
+		if err != nil {
+			return nil, err
+		}
+		fromVersion, err := schemas.resolveCustomResource(gvk)
+		if err != nil {
+			return nil, err
+		}
+		to, err := schemas.resolveCustomResource(gvk.GroupKind().WithVersion(toVersion))
+		if err != nil {
+			return nil, err
+		}
+		patch, err := readYAMLFile(patchFile)
+		if err != nil {
+			return nil, err
+		}
+		conversion, err := compileConversion(o.mode, fromVersion, to, patch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %s: %w", patchFile, err)
+		}
+		w.Register(gvk, toVersion, conversion)
+	}
+	for _, policies := range o.policies {
+		for _, p := range policies.ConversionPolicies {
+			compiled, err := policy.CompileConversionPolicy(p, func(version string) (*crd.Version, error) {
+				return schemas.resolveCustomResource(schema.GroupVersionKind{Group: p.Spec.Group, Version: version, Kind: p.Spec.Kind})
+			})
+			if err != nil {
+				return nil, err
+			}
+			w.RegisterPolicy(compiled)
+		}
+	}
+	return w, nil
+}
+
+// parseGroupVersionKind parses a kind of the form Kind.version.group, or Kind.version for the core
+// group, of the flag.
+func parseGroupVersionKind(s, flag string) (schema.GroupVersionKind, error) {
+	parts := strings.SplitN(s, ".", 3)
+	for _, part := range parts {
+		if len(part) == 0 {
+			parts = nil
+		}
+	}
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionKind{Version: parts[1], Kind: parts[0]}, nil
+	case 3:
+		return schema.GroupVersionKind{Group: parts[2], Version: parts[1], Kind: parts[0]}, nil
+	default:
+		return schema.GroupVersionKind{}, fmt.Errorf("invalid kind %q of %s, must be of the form Kind.version.group, such as Deployment.v1.apps, or Kind.version for the core group, such as Pod.v1", s, flag)
+	}
+}
+
+func compileMutation(mode string, s *spec.Schema, patch any) (*apply.CompiledMutation, error) {
+	switch mode {
+	case modeApply:
+		return apply.CompileMutateApply(s, patch)
+	case modeTemplate:
+		return apply.CompileMutateWithTemplate(s, patch)
+	default:
+		return apply.CompileMutateBasicMerge(s, patch)
+	}
+}
+
+func compileConversion(mode string, from, to *crd.Version, patch any) (*apply.CompiledConversion, error) {
+	switch mode {
+	case modeApply:
+		return apply.CompileConvertApply(from.Schema, to.Schema, patch)
+	case modeTemplate:
+		return apply.CompileConvertWithTemplate(from.Schema, to.Schema, patch)
+	default:
+		return apply.CompileConvertBasicMerge(from.Schema, to.Schema, patch)
+	}
+}
+
+// schemaResolver resolves the schemas of custom resources from CustomResourceDefinitions, and of
+// built-in types from the embedded OpenAPI documents.
+type schemaResolver struct {
+	customResources map[schema.GroupVersionKind]*crd.Version
+	builtin         *builtin.Resolver
+}
+
+func newSchemaResolver(crdFiles []string) (*schemaResolver, error) {
+	r := &schemaResolver{customResources: map[schema.GroupVersionKind]*crd.Version{}, builtin: builtin.NewResolver()}
+	for _, file := range crdFiles {
+		c, err := crd.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range c.VersionNames() {
+			v, err := c.Version(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			r.customResources[schema.GroupVersionKind{Group: c.Spec.Group, Version: name, Kind: c.Spec.Names.Kind}] = v
+		}
+	}
+	return r, nil
+}
+
+// ResolveSchema implements resolver.SchemaResolver.
+func (r *schemaResolver) ResolveSchema(gvk schema.GroupVersionKind) (*spec.Schema, error) {
+	if v, ok := r.customResources[gvk]; ok {
+		return v.Schema, nil
+	}
+	s, err := r.builtin.ResolveSchema(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("no schema for %s, it is neither a built-in type nor defined by a -crd: %w", gvk, err)
+	}
+	return s, nil
+}
+
+func (r *schemaResolver) resolveCustomResource(gvk schema.GroupVersionKind) (*crd.Version, error) {
+	v, ok := r.customResources[gvk]
+	if !ok {
+		return nil, fmt.Errorf("no schema for %s, it is not defined by a -crd", gvk)
+	}
+	return v, nil
+}
+
+func readYAMLFile(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	var result any
+	if err := utiljson.Unmarshal(j, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testdata = "../../testdata"
+
+func TestHandler(t *testing.T) {
+	o, err := parseOptions([]string{
+		"-crd", filepath.Join(testdata, "crd.yaml"),
+		"-mutation", "Pod.v1=" + filepath.Join(testdata, "webhook/sidecar.yaml"),
+		"-mutation", "Example.v1.group.example.com=" + filepath.Join(testdata, "basicmerge/mutate/basic/patch.yaml"),
+		"-policy", filepath.Join(testdata, "policy/policies.yaml"),
+		"-conversion", "Example.v2.group.example.com:v1=" + filepath.Join(testdata, "basicmerge/convert/basic/v2tov1.yaml"),
+	}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := newHandler(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	review := &admissionv1.AdmissionReview{}
+	post(t, server.URL+"/mutate", "webhook/pod-create.json", review)
+	if review.Response == nil || !review.Response.Allowed {
+		t.Fatalf("expected request to be allowed, but got %v", review.Response)
+	}
+	// The -mutation injects the proxy, and the policies add its args and the team label.
+	expected := `[{"op":"add","path":"/metadata/labels/team","value":"payments"},{"op":"add","path":"/spec/containers/1","value":{"args":["--port=15001"],"image":"proxy:1.0","name":"proxy"}}]`
+	if string(review.Response.Patch) != expected {
+		t.Errorf("expected patch %s but got %s", expected, review.Response.Patch)
+	}
+
+	conversionReview := &apiextensionsv1.ConversionReview{}
+	post(t, server.URL+"/convert", "webhook/convert-to-v1.json", conversionReview)
+	if conversionReview.Response == nil || conversionReview.Response.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected conversion to succeed, but got %v", conversionReview.Response)
+	}
+	if converted := string(conversionReview.Response.ConvertedObjects[0].Raw); !strings.Contains(converted, `"replicas":2`) {
+		t.Errorf("expected spec.copies to be converted to spec.replicas, but got %s", converted)
+	}
+}
+
+func post(t *testing.T, url, file string, review any) {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join(testdata, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(review); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	cases := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{
+			name:          "no mutations",
+			expectedError: "at least one -mutation, -policy or -conversion is required",
+		},
+		{
+			name:          "certificate without key",
+			args:          []string{"-tls-cert-file", "cert.pem", "-mutation", "Pod.v1=webhook/sidecar.yaml"},
+			expectedError: "must be specified together",
+		},
+		{
+			name:          "invalid mutation",
+			args:          []string{"-mutation", "Pod.v1"},
+			expectedError: "must be of the form <Kind.version.group>=<patch file>",
+		},
+		{
+			name:          "invalid kind",
+			args:          []string{"-mutation", "Pod=webhook/sidecar.yaml"},
+			expectedError: `invalid kind "Pod"`,
+		},
+		{
+			name:          "unknown kind",
+			args:          []string{"-mutation", "Example.v1.group.example.com=webhook/sidecar.yaml"},
+			expectedError: "neither a built-in type nor defined by a -crd",
+		},
+		{
+			name:          "invalid conversion",
+			args:          []string{"-conversion", "Example.v1.group.example.com=webhook/sidecar.yaml"},
+			expectedError: "must be of the form <Kind.version.group>:<version>=<patch file>",
+		},
+		{
+			name:          "conversion of built-in type",
+			args:          []string{"-conversion", "Pod.v1:v2=webhook/sidecar.yaml"},
+			expectedError: "not defined by a -crd",
+		},
+		{
+			name:          "invalid policy",
+			args:          []string{"-policy", filepath.Join(testdata, "webhook/sidecar.yaml")},
+			expectedError: "expected apiVersion celpatch.jpbetz.github.com/v1alpha1",
+		},
+		{
+			name:          "conversion policy without CustomResourceDefinition",
+			args:          []string{"-policy", filepath.Join(testdata, "policy/widget-conversion.yaml")},
+			expectedError: "Widget, it is not defined by a -crd",
+		},
+		{
+			name:          "compile error",
+			args:          []string{"-mutation", "Deployment.v1.apps=webhook/sidecar.yaml"},
+			expectedError: "failed to compile",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := make([]string, len(tc.args))
+			for i, arg := range tc.args {
+				if kind, file, ok := strings.Cut(arg, "="); ok {
+					arg = kind + "=" + filepath.Join(testdata, file)
+				}
+				args[i] = arg
+			}
+			o, err := parseOptions(args, &bytes.Buffer{})
+			if err == nil {
+				_, err = newHandler(o)
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/crd"
+)
+
+func runConvert(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var o patchOptions
+	var toSchemaFile, fromVersion, toVersion string
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.addFlags(fs)
+	fs.StringVar(&toSchemaFile, "to-schema", "", "OpenAPI schema or CustomResourceDefinition file of the version to convert to, if it is not in the -schema file")
+	fs.StringVar(&fromVersion, "from", "", "version of the CustomResourceDefinition to convert from")
+	fs.StringVar(&toVersion, "to", "", "version of the CustomResourceDefinition to convert to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if len(o.schemaFile) == 0 {
+		return fmt.Errorf("-schema is required")
+	}
+	if len(toSchemaFile) == 0 {
+		toSchemaFile = o.schemaFile
+	}
+
+	from, err := loadSchema(o.schemaFile, fromVersion)
+	if err != nil {
+		return err
+	}
+	to, err := loadSchema(toSchemaFile, toVersion)
+	if err != nil {
+		return err
+	}
+	patch, err := o.patch()
+	if err != nil {
+		return err
+	}
+	obj, err := readObject(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	conversion, err := o.compileConversion(from, to, patch)
+	if err != nil {
+		return err
+	}
+	result, report, err := conversion.ApplyWithReport(obj)
+	if err != nil {
+		return err
+	}
+	for _, warning := range report.Warnings() {
+		fmt.Fprintln(stderr, "warning:", warning)
+	}
+	return writeResult(stdout, result, o.output)
+}
+
+// compileConversion compiles the conversion of the patch from one version to another, using the
+// -mode of the options.
+func (o *patchOptions) compileConversion(from, to *crd.Version, patch any) (*apply.CompiledConversion, error) {
+	var compile func(*spec.Schema, *spec.Schema, any, ...apply.CompileOption) (*apply.CompiledConversion, error)
+	switch o.mode {
+	case modeApply:
+		compile = apply.CompileConvertApply
+	case modeTemplate:
+		compile = apply.CompileConvertWithTemplate
+	default:
+		compile = apply.CompileConvertBasicMerge
+	}
+	return compile(from.Schema, to.Schema, patch, apply.WithEstimatedCostLimit(o.estimatedCostLimit))
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command celpatch mutates and converts Kubernetes resources using CEL.
+//
+// Usage:
+//
+//	celpatch mutate [-schema <file>] [-version <version>] (-e <expression> | -f <patch file>) [-mode basic|apply|template] [-estimated-cost-limit <cost>] [-field-manager <name> [-force]] [-o yaml|json] [<object file>]
+//	celpatch convert -schema <file> [-to-schema <file>] [-from <version>] [-to <version>] (-e <expression> | -f <patch file>) [-mode basic|apply|template] [-estimated-cost-limit <cost>] [-o yaml|json] [<object file>]
+//	celpatch roundtrip -schema <file> [-to-schema <file>] [-from <version>] [-to <version>] (-e <expression> | -f <patch file>) (-backward-e <expression> | -backward-f <patch file>) [-mode basic|apply|template] [-estimated-cost-limit <cost>] [-n <count>] [-seed <seed>] [-o yaml|json]
+//
+// The object is read from stdin if no object file is given, or if the object file is "-". If mutate
+// is not given a -schema, the object must be of a built-in type, such as a Pod or Deployment,
+// and the schema of the type is used.
+//
+// Expressions whose estimated cost exceeds the limit of the validation rules of
+// CustomResourceDefinitions are rejected, unless a different -estimated-cost-limit is given, or 0
+// to disable the check. The limit is disabled for built-in types, whose schemas do not bound the
+// sizes of their lists and strings, unless -estimated-cost-limit is given.
+//
+// roundtrip converts random objects of the from version to the to version and back, and reports
+// the first object that is not converted back to itself, minimized.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+const usage = `celpatch mutates and converts Kubernetes resources using CEL.
+
+Usage:
+  celpatch mutate [flags] [<object file>]
+  celpatch convert [flags] [<object file>]
+  celpatch roundtrip [flags]
+
+Use "celpatch <command> -h" for the flags of a command.
+`
+
+// run runs the celpatch command with the arguments, not including the program name.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("a command is required")
+	}
+	switch args[0] {
+	case "mutate":
+		return runMutate(args[1:], stdin, stdout, stderr)
+	case "convert":
+		return runConvert(args[1:], stdin, stdout, stderr)
+	case "roundtrip":
+		return runRoundtrip(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
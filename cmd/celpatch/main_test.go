@@ -0,0 +1,251 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+const testdata = "../../testdata"
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected string
+		// expectedStderr, if set, is the expected output to stderr, such as warnings.
+		expectedStderr string
+	}{
+		{
+			name:     "mutate template",
+			args:     []string{"mutate", "-schema", "v1schema.yaml", "-estimated-cost-limit", "0", "-mode", "template", "-f", "templates/mutate/basic/patch.yaml", "templates/mutate/basic/original.yaml"},
+			expected: "templates/mutate/basic/expected.yaml",
+		},
+		{
+			name:     "mutate basic merge",
+			args:     []string{"mutate", "-schema", "v1schema.yaml", "-estimated-cost-limit", "0", "-f", "basicmerge/mutate/basic/patch.yaml", "basicmerge/mutate/basic/original.yaml"},
+			expected: "basicmerge/mutate/basic/expected.yaml",
+		},
+		{
+			name:     "mutate apply from stdin",
+			args:     []string{"mutate", "-schema", "v1schema.yaml", "-estimated-cost-limit", "0", "-mode", "apply", "-f", "apply/mutate/unsettingfields/patch.yaml", "-o", "json"},
+			stdin:    "apply/mutate/unsettingfields/original.yaml",
+			expected: "apply/mutate/unsettingfields/expected.yaml",
+		},
+		{
+			name:     "mutate with CRD schema",
+			args:     []string{"mutate", "-schema", "crd.yaml", "-version", "v1", "-mode", "template", "-f", "templates/mutate/basic/patch.yaml", "templates/mutate/basic/original.yaml"},
+			expected: "templates/mutate/basic/expected.yaml",
+		},
+		{
+			name:     "mutate built-in type",
+			args:     []string{"mutate", "-f", "builtin/sidecar/patch.yaml", "builtin/sidecar/original.yaml"},
+			expected: "builtin/sidecar/expected.yaml",
+		},
+		{
+			name:     "mutate the containers of a built-in type",
+			args:     []string{"mutate", "-f", "builtin/alwayspullimages/patch.yaml", "builtin/alwayspullimages/original.yaml"},
+			expected: "builtin/alwayspullimages/expected.yaml",
+		},
+		{
+			name:     "convert with OpenAPI schemas",
+			args:     []string{"convert", "-schema", "v1schema.yaml", "-to-schema", "v2schema.yaml", "-estimated-cost-limit", "0", "-mode", "template", "-f", "templates/convert/basic/v1tov2.yaml", "templates/convert/basic/original.yaml"},
+			expected: "templates/convert/basic/expected.yaml",
+			expectedStderr: "warning: spec.list: not carried over by the conversion: the field does not exist in the to version\n" +
+				"warning: spec.listMap: not carried over by the conversion: the value is not compatible with the field of the to version\n" +
+				"warning: spec.replicas: not carried over by the conversion: the field does not exist in the to version\n" +
+				"warning: spec.something: not carried over by the conversion: the value is not compatible with the field of the to version\n",
+		},
+		{
+			name:     "convert with CRD schema",
+			args:     []string{"convert", "-schema", "crd.yaml", "-from", "v2", "-to", "v1", "-mode", "template", "-f", "templates/convert/basic/v2tov1.yaml", "templates/convert/basic/expected.yaml"},
+			expected: "templates/convert/basic/original.yaml",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdin bytes.Buffer
+			if len(tc.stdin) > 0 {
+				stdin.Write(readFile(t, tc.stdin))
+			}
+			var stdout, stderr bytes.Buffer
+			if err := run(inTestdata(tc.args), &stdin, &stdout, &stderr); err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+			}
+			var expected, got any
+			if err := yaml.Unmarshal(readFile(t, tc.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal(stdout.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("Expected:\n%s\nBut got:\n%s\n", readFile(t, tc.expected), stdout.String())
+			}
+			if len(tc.expectedStderr) > 0 && stderr.String() != tc.expectedStderr {
+				t.Errorf("Expected stderr:\n%s\nBut got:\n%s\n", tc.expectedStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	cases := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{
+			name:          "no command",
+			expectedError: "a command is required",
+		},
+		{
+			name:          "unknown command",
+			args:          []string{"bogus"},
+			expectedError: `unknown command "bogus"`,
+		},
+		{
+			name:          "missing schema",
+			args:          []string{"convert", "-e", "Object{}"},
+			expectedError: "-schema is required",
+		},
+		{
+			name:          "not a built-in type",
+			args:          []string{"mutate", "-e", "Object{}", "basicmerge/mutate/basic/original.yaml"},
+			expectedError: "group.example.com/v1 Example is not a built-in type",
+		},
+		{
+			name:          "expression and patch file",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-e", "Object{}", "-f", "basicmerge/mutate/basic/patch.yaml"},
+			expectedError: "exactly one of -e or -f is required",
+		},
+		{
+			name:          "field manager with apply mode",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-e", "Object{}", "-mode", "apply", "-field-manager", "m1"},
+			expectedError: "-field-manager cannot be used with -mode=apply",
+		},
+		{
+			name:          "force without field manager",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-e", "Object{}", "-force"},
+			expectedError: "-force requires -field-manager",
+		},
+		{
+			name:          "unsupported mode",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-e", "Object{}", "-mode", "bogus"},
+			expectedError: `unsupported -mode "bogus"`,
+		},
+		{
+			name:          "CRD version required",
+			args:          []string{"mutate", "-schema", "crd.yaml", "-e", "Object{}", "basicmerge/mutate/basic/original.yaml"},
+			expectedError: "a version must be specified",
+		},
+		{
+			name:          "estimated cost exceeds the limit",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-f", "basicmerge/mutate/basic/patch.yaml", "basicmerge/mutate/basic/original.yaml"},
+			expectedError: "exceeds the limit of 10000000",
+		},
+		{
+			name:          "estimated cost of a built-in type exceeds the given limit",
+			args:          []string{"mutate", "-estimated-cost-limit", "10000000", "-f", "builtin/alwayspullimages/patch.yaml", "builtin/alwayspullimages/original.yaml"},
+			expectedError: "exceeds the limit of 10000000",
+		},
+		{
+			name:          "compile error",
+			args:          []string{"mutate", "-schema", "v1schema.yaml", "-e", "'not an object'", "basicmerge/mutate/basic/original.yaml"},
+			expectedError: "compile error",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := run(inTestdata(tc.args), &bytes.Buffer{}, &stdout, &stderr)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestRoundtrip(t *testing.T) {
+	const sizeToReplicas = "has(oldObject.spec) && has(oldObject.spec.size) ? Object{spec: Object.spec{replicas: oldObject.spec.size}} : Object{}"
+	cases := []struct {
+		name           string
+		backward       string
+		expectedOutput string
+		expectedError  string
+	}{
+		{
+			name:           "lossless",
+			backward:       "has(oldObject.spec) && has(oldObject.spec.replicas) ? Object{spec: Object.spec{size: oldObject.spec.replicas}} : Object{}",
+			expectedOutput: "100 objects round tripped\n",
+		},
+		{
+			name:           "lossy",
+			backward:       "has(oldObject.spec) && has(oldObject.spec.replicas) ? Object{spec: Object.spec{size: oldObject.spec.replicas % 50}} : Object{}",
+			expectedOutput: "converted:\n  spec:\n    replicas: 50\ndifferences:\n- 'spec.size: 50 became 0'\nobject:\n  spec:\n    size: 50\nroundTripped:\n  spec:\n    size: 0\n",
+			expectedError:  "found an object that does not round trip",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := []string{"roundtrip", "-schema", "policy/widget-crd.yaml", "-from", "v1", "-to", "v2", "-seed", "1", "-e", sizeToReplicas, "-backward-e", tc.backward}
+			var stdout, stderr bytes.Buffer
+			err := run(inTestdata(args), &bytes.Buffer{}, &stdout, &stderr)
+			if len(tc.expectedError) == 0 && err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+			}
+			if len(tc.expectedError) > 0 && (err == nil || !strings.Contains(err.Error(), tc.expectedError)) {
+				t.Fatalf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+			if stdout.String() != tc.expectedOutput {
+				t.Errorf("Expected:\n%s\nBut got:\n%s\n", tc.expectedOutput, stdout.String())
+			}
+		})
+	}
+}
+
+// inTestdata returns the args with all testdata file names made relative to the test directory.
+func inTestdata(args []string) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		if strings.HasSuffix(arg, ".yaml") {
+			arg = filepath.Join(testdata, arg)
+		}
+		result[i] = arg
+	}
+	return result
+}
+
+func readFile(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(testdata, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+func runMutate(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var o patchOptions
+	var version, fieldManager string
+	var force bool
+	fs := flag.NewFlagSet("mutate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.addFlags(fs)
+	fs.StringVar(&version, "version", "", "version of the CustomResourceDefinition to use the schema of")
+	fs.StringVar(&fieldManager, "field-manager", "", "field manager that merges the result of the expression or template, using and updating the object's metadata.managedFields")
+	fs.BoolVar(&force, "force", false, "override fields owned by other field managers instead of failing if the -field-manager would change them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	patch, err := o.patch()
+	if err != nil {
+		return err
+	}
+	obj, err := readObject(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	var s *spec.Schema
+	if len(o.schemaFile) > 0 {
+		v, err := loadSchema(o.schemaFile, version)
+		if err != nil {
+			return err
+		}
+		s = v.Schema
+	} else {
+		s, err = builtinSchema(obj)
+		if err != nil {
+			return err
+		}
+		// The schemas of built-in types do not bound the sizes of their lists and strings, so the
+		// estimated cost of an expression that iterates over them is only limited if asked to.
+		if !isFlagSet(fs, "estimated-cost-limit") {
+			o.estimatedCostLimit = 0
+		}
+	}
+
+	var compile func(*spec.Schema, any, ...apply.CompileOption) (*apply.CompiledMutation, error)
+	switch o.mode {
+	case modeApply:
+		compile = apply.CompileMutateApply
+	case modeTemplate:
+		compile = apply.CompileMutateWithTemplate
+	default:
+		compile = apply.CompileMutateBasicMerge
+	}
+	opts := []apply.CompileOption{apply.WithEstimatedCostLimit(o.estimatedCostLimit)}
+	if len(fieldManager) > 0 {
+		if o.mode == modeApply {
+			return fmt.Errorf("-field-manager cannot be used with -mode=apply")
+		}
+		opts = append(opts, apply.WithFieldManager(fieldManager))
+		if force {
+			opts = append(opts, apply.WithForce())
+		}
+	} else if force {
+		return fmt.Errorf("-force requires -field-manager")
+	}
+	mutation, err := compile(s, patch, opts...)
+	if err != nil {
+		return err
+	}
+	result, err := mutation.Apply(obj)
+	if err != nil {
+		return err
+	}
+	return writeResult(stdout, result, o.output)
+}
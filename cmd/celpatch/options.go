@@ -0,0 +1,154 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+const (
+	modeBasic    = "basic"
+	modeApply    = "apply"
+	modeTemplate = "template"
+
+	outputYAML = "yaml"
+	outputJSON = "json"
+)
+
+// patchOptions are the flags shared by the mutate and convert commands.
+type patchOptions struct {
+	schemaFile string
+	expression string
+	patchFile  string
+	mode       string
+	output     string
+	// estimatedCostLimit is the maximum estimated cost of an expression, or 0 if it is unlimited.
+	estimatedCostLimit uint64
+}
+
+func (o *patchOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.schemaFile, "schema", "", "OpenAPI schema or CustomResourceDefinition file (YAML or JSON)")
+	fs.StringVar(&o.expression, "e", "", "CEL mutation expression")
+	fs.StringVar(&o.patchFile, "f", "", "patch file: a document of the form 'mutation: <expression>', or a template when -mode=template")
+	fs.StringVar(&o.mode, "mode", modeBasic, "how the patch is applied: basic (merge the result of the expression), apply (objects.apply() the result of the expression) or template")
+	fs.StringVar(&o.output, "o", outputYAML, "output format: yaml or json")
+	fs.Uint64Var(&o.estimatedCostLimit, "estimated-cost-limit", apply.StaticEstimatedCostLimit, "maximum estimated cost of an expression, as for the validation rules of CustomResourceDefinitions, or 0 to disable the check")
+}
+
+// isFlagSet returns true if the flag was given on the command line.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func (o *patchOptions) validate() error {
+	switch o.mode {
+	case modeBasic, modeApply, modeTemplate:
+	default:
+		return fmt.Errorf("unsupported -mode %q, must be one of: basic, apply, template", o.mode)
+	}
+	switch o.output {
+	case outputYAML, outputJSON:
+	default:
+		return fmt.Errorf("unsupported -o %q, must be one of: yaml, json", o.output)
+	}
+	if (len(o.expression) == 0) == (len(o.patchFile) == 0) {
+		return fmt.Errorf("exactly one of -e or -f is required")
+	}
+	if o.mode == modeTemplate && len(o.expression) > 0 {
+		return fmt.Errorf("-e cannot be used with -mode=template, use -f to provide a template")
+	}
+	return nil
+}
+
+// patch returns the patch in the form expected by the apply package.
+func (o *patchOptions) patch() (any, error) {
+	if len(o.expression) > 0 {
+		return map[string]any{"mutation": o.expression}, nil
+	}
+	return readYAMLFile(o.patchFile)
+}
+
+// readObject reads the object from the file named by the only argument, or from stdin if there
+// are no arguments or the argument is "-".
+func readObject(args []string, stdin io.Reader) (any, error) {
+	switch {
+	case len(args) > 1:
+		return nil, fmt.Errorf("expected at most one object file, but got %d", len(args))
+	case len(args) == 0 || args[0] == "-":
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object from stdin: %w", err)
+		}
+		return unmarshalYAML(data, "stdin")
+	default:
+		return readYAMLFile(args[0])
+	}
+}
+
+func readYAMLFile(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalYAML(data, file)
+}
+
+// unmarshalYAML unmarshals YAML or JSON data into unstructured form. Integers are unmarshalled
+// as int64 rather than float64.
+func unmarshalYAML(data []byte, source string) (any, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	var result any
+	if err := utiljson.Unmarshal(j, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	return result, nil
+}
+
+func writeResult(w io.Writer, result any, format string) error {
+	var out []byte
+	var err error
+	switch format {
+	case outputJSON:
+		out, err = json.MarshalIndent(result, "", "  ")
+		out = append(out, '\n')
+	default:
+		out, err = yaml.Marshal(result)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
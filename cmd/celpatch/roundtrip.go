@@ -0,0 +1,112 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"jpbetz.github.com/celpatch/pkg/roundtrip"
+)
+
+func runRoundtrip(args []string, stdout, stderr io.Writer) error {
+	var o, backward patchOptions
+	var toSchemaFile, fromVersion, toVersion string
+	var opts roundtrip.Options
+	fs := flag.NewFlagSet("roundtrip", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o.addFlags(fs)
+	fs.StringVar(&backward.expression, "backward-e", "", "CEL mutation expression of the conversion back to the from version")
+	fs.StringVar(&backward.patchFile, "backward-f", "", "patch file of the conversion back to the from version")
+	fs.StringVar(&toSchemaFile, "to-schema", "", "OpenAPI schema or CustomResourceDefinition file of the version to convert to, if it is not in the -schema file")
+	fs.StringVar(&fromVersion, "from", "", "version of the CustomResourceDefinition to convert from")
+	fs.StringVar(&toVersion, "to", "", "version of the CustomResourceDefinition to convert to")
+	fs.IntVar(&opts.Count, "n", roundtrip.DefaultCount, "number of random objects to check")
+	fs.Int64Var(&opts.Seed, "seed", 0, "seed of the random objects")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	backward.mode, backward.output = o.mode, o.output
+	if err := backward.validate(); err != nil {
+		return fmt.Errorf("backward conversion: %w", err)
+	}
+	if len(o.schemaFile) == 0 {
+		return fmt.Errorf("-schema is required")
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if len(toSchemaFile) == 0 {
+		toSchemaFile = o.schemaFile
+	}
+
+	from, err := loadSchema(o.schemaFile, fromVersion)
+	if err != nil {
+		return err
+	}
+	to, err := loadSchema(toSchemaFile, toVersion)
+	if err != nil {
+		return err
+	}
+	forwardPatch, err := o.patch()
+	if err != nil {
+		return err
+	}
+	backwardPatch, err := backward.patch()
+	if err != nil {
+		return err
+	}
+	forwardConversion, err := o.compileConversion(from, to, forwardPatch)
+	if err != nil {
+		return err
+	}
+	backwardConversion, err := o.compileConversion(to, from, backwardPatch)
+	if err != nil {
+		return fmt.Errorf("backward conversion: %w", err)
+	}
+
+	result, err := roundtrip.Verify(from.Schema, forwardConversion.Apply, backwardConversion.Apply, opts)
+	if err != nil {
+		return err
+	}
+	c := result.Counterexample
+	if c == nil {
+		fmt.Fprintf(stdout, "%d objects round tripped\n", result.Checked)
+		return nil
+	}
+	report := map[string]any{"object": c.Object}
+	if c.Converted != nil {
+		report["converted"] = c.Converted
+	}
+	if c.RoundTripped != nil {
+		report["roundTripped"] = c.RoundTripped
+	}
+	if len(c.Differences) > 0 {
+		report["differences"] = c.Differences
+	}
+	if c.Err != nil {
+		report["error"] = c.Err.Error()
+	}
+	if err := writeResult(stdout, report, o.output); err != nil {
+		return err
+	}
+	return fmt.Errorf("found an object that does not round trip after checking %d objects", result.Checked)
+}
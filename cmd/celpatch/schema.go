@@ -0,0 +1,93 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/builtin"
+	"jpbetz.github.com/celpatch/pkg/crd"
+)
+
+// loadSchema loads the schema in file, which is either an OpenAPI schema or a
+// CustomResourceDefinition. For a CustomResourceDefinition, version selects the schema of one of
+// its versions, and may be empty if the CustomResourceDefinition has only one version.
+func loadSchema(file, version string) (*crd.Version, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	var typeMeta struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	if typeMeta.Kind == "CustomResourceDefinition" {
+		c, err := crd.Load(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CustomResourceDefinition %s: %w", file, err)
+		}
+		v, err := c.Version(version)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return v, nil
+	}
+	props := &apiextensionsv1.JSONSchemaProps{}
+	if err := json.Unmarshal(data, props); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI schema %s: %w", file, err)
+	}
+	return crd.NewVersion(version, props)
+}
+
+// builtinSchema returns the schema of the built-in type of obj, which is identified by the
+// apiVersion and kind of obj.
+func builtinSchema(obj any) (*spec.Schema, error) {
+	u, ok := obj.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("-schema is required if the object is not a Kubernetes resource")
+	}
+	apiVersion, _ := u["apiVersion"].(string)
+	kind, _ := u["kind"].(string)
+	if len(apiVersion) == 0 || len(kind) == 0 {
+		return nil, fmt.Errorf("-schema is required if the object has no apiVersion and kind")
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	s, err := builtin.NewResolver().ResolveSchema(gv.WithKind(kind))
+	if errors.Is(err, resolver.ErrSchemaNotFound) {
+		return nil, fmt.Errorf("-schema is required: %s %s is not a built-in type", apiVersion, kind)
+	}
+	return s, err
+}
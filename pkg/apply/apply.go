@@ -17,7 +17,8 @@ limitations under the License.
 package apply
 
 import (
-	"strings"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/google/cel-go/cel"
@@ -25,15 +26,11 @@ import (
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/common/types/traits"
 	"github.com/google/cel-go/interpreter"
-	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apiserver/pkg/cel/common"
 	"k8s.io/apiserver/pkg/cel/library"
 	"k8s.io/apiserver/pkg/cel/openapi"
-	"k8s.io/kube-openapi/pkg/schemaconv"
 	"k8s.io/kube-openapi/pkg/validation/spec"
-	smdschema "sigs.k8s.io/structured-merge-diff/v4/schema"
-	"sigs.k8s.io/structured-merge-diff/v4/typed"
 
 	cel2 "jpbetz.github.com/celpatch/pkg/apply/cel"
 )
@@ -43,108 +40,111 @@ const (
 	objectTypeName     = "Object" // com.example.group.v1.Example if we want to fully qualify
 	oldObjectTypeName  = "OldObject"
 	oldSelfVar         = "oldSelf"
+	selfVar            = "self"
 	oldObjectVar       = "oldObject"
 	convertedObjectVar = "convertedObject"
+	paramsVar          = "params"
+	requestVar         = "request"
+	paramsTypeName     = "Params"
 )
 
-// ConvertWithTemplate performs a version conversion using the patch.
-// TODO: Remove schema.Structural from arguments and introduce a more efficient alternative to the prune
-// operation.
-func ConvertWithTemplate(fromVersionSchema, toVersionSchema *spec.Schema, toVersionStructuralSchema *schema.Structural, fromObject, patch any) any {
-	oldOpenAPISchema := &openapi.Schema{Schema: fromVersionSchema}
-	newOpenAPISchema := &openapi.Schema{Schema: toVersionSchema}
-	// Conversion Flow:
-	// 1. Do template variable substitution
-	ac := Substitute(oldOpenAPISchema, newOpenAPISchema, fromObject, patch, true)
-	// 2. Start converting the v1 object to v2 and pruning: (a) any fields not in v2,
-	//    (b) any fields with incorrect types (c) any listType=map entries with missing keys.
-	// TODO: This prune is probably better handled by checking differences between schemas
-	// and only keeping what is compatible.
-	pruned := runtime.DeepCopyJSON(fromObject.(map[string]any))
-	Prune(pruned, toVersionStructuralSchema, true)
-	// 3. Merge the patch with the pruned object
-	return Merge(toVersionSchema, pruned, ac, true)
+// ConvertWithTemplate performs a version conversion using the patch. It also returns a report of
+// the values of fromObject that were not carried over to the to version.
+func ConvertWithTemplate(fromVersionSchema, toVersionSchema *spec.Schema, fromObject, patch any, opts ...CompileOption) (any, *ConversionReport, error) {
+	c, err := CompileConvertWithTemplate(fromVersionSchema, toVersionSchema, patch, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.ApplyWithReport(fromObject)
 }
 
-func ConvertBasicMerge(fromVersionSchema, toVersionSchema *spec.Schema, toVersionStructuralSchema *schema.Structural, fromObject, patch any) any {
-	oldOpenAPISchema := &openapi.Schema{Schema: fromVersionSchema}
-	newOpenAPISchema := &openapi.Schema{Schema: toVersionSchema}
-	// Conversion Flow:
-	// 1. Start converting the v1 object to v2 and pruning: (a) any fields not in v2,
-	//    (b) any fields with incorrect types (c) any listType=map entries with missing keys.
-	// TODO: This prune is probably better handled by checking differences between schemas
-	// and only keeping what is compatible.
-	pruned := runtime.DeepCopyJSON(fromObject.(map[string]any))
-	Prune(pruned, toVersionStructuralSchema, true)
-	// 2. build the apply configuration
-	expression := patch.(map[string]any)["mutation"].(string)
-	ac := EvalConversion(oldOpenAPISchema, newOpenAPISchema, fromObject, pruned, expression)
-	// 3. Merge the patch with the pruned object
-	return Merge(toVersionSchema, pruned, ac, true)
+func ConvertBasicMerge(fromVersionSchema, toVersionSchema *spec.Schema, fromObject, patch any, opts ...CompileOption) (any, *ConversionReport, error) {
+	c, err := CompileConvertBasicMerge(fromVersionSchema, toVersionSchema, patch, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.ApplyWithReport(fromObject)
 }
 
-func ConvertApply(fromVersionSchema, toVersionSchema *spec.Schema, toVersionStructuralSchema *schema.Structural, fromObject, patch any) any {
-	oldOpenAPISchema := &openapi.Schema{Schema: fromVersionSchema}
-	newOpenAPISchema := &openapi.Schema{Schema: toVersionSchema}
-	// Conversion Flow:
-	// 1. Start converting the v1 object to v2 and pruning: (a) any fields not in v2,
-	//    (b) any fields with incorrect types (c) any listType=map entries with missing keys.
-	// TODO: This prune is probably better handled by checking differences between schemas
-	// and only keeping what is compatible.
-	pruned := runtime.DeepCopyJSON(fromObject.(map[string]any))
-	Prune(pruned, toVersionStructuralSchema, true)
-	// 2. Build the apply configuration and merge it
-	expression := patch.(map[string]any)["mutation"].(string)
-	expression = "objects.apply(convertedObject, " + expression + "\n)" // newline to guard against trailing comment
-	return EvalConversion(oldOpenAPISchema, newOpenAPISchema, fromObject, pruned, expression)
+func ConvertApply(fromVersionSchema, toVersionSchema *spec.Schema, fromObject, patch any, opts ...CompileOption) (any, *ConversionReport, error) {
+	c, err := CompileConvertApply(fromVersionSchema, toVersionSchema, patch, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.ApplyWithReport(fromObject)
 }
 
 // MutateWithTemplate applies the patch to the object.
-func MutateWithTemplate(schema *spec.Schema, obj, patch any) any {
-	s := &openapi.Schema{Schema: schema}
-	applyConfiguration := Substitute(s, s, obj, patch, false)
-	return Merge(schema, obj, applyConfiguration, false)
+func MutateWithTemplate(schema *spec.Schema, obj, patch any, opts ...CompileOption) (any, error) {
+	c, err := CompileMutateWithTemplate(schema, patch, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Apply(obj)
 }
 
-func MutateBasicMerge(schema *spec.Schema, obj any, patch any) any {
-	expression := patch.(map[string]any)["mutation"].(string)
-	openAPISchema := &openapi.Schema{Schema: schema}
-	applyConfiguration := EvalMutate(openAPISchema, openAPISchema, obj, expression)
-	return Merge(schema, obj, applyConfiguration, false)
+func MutateBasicMerge(schema *spec.Schema, obj any, patch any, opts ...CompileOption) (any, error) {
+	c, err := CompileMutateBasicMerge(schema, patch, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Apply(obj)
 }
 
-func MutateApply(schema *spec.Schema, obj any, patch any) any {
-	expression := patch.(map[string]any)["mutation"].(string)
-	// TODO: replace with AST modification?
-	expression = "objects.apply(oldObject, " + expression + "\n)" // newline to guard against trailing comment
-	openAPISchema := &openapi.Schema{Schema: schema}
-	result := EvalMutate(openAPISchema, openAPISchema, obj, expression)
-	return result
+func MutateApply(schema *spec.Schema, obj any, patch any, opts ...CompileOption) (any, error) {
+	c, err := CompileMutateApply(schema, patch, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Apply(obj)
 }
 
-// Merge performs a server side apply style merge of the patch (apply configuration) to the
-// obj.  The schema of the object is also required. If preserveUnknownFields is true, the
-// patch may add unrecognized fields, otherwise adding unrecognized fields will result in an error.
-func Merge(s *spec.Schema, obj, patch any, preserveUnknownFields bool) any {
-	specSchema, err := schemaconv.ToSchemaFromOpenAPI(map[string]*spec.Schema{"root": s}, preserveUnknownFields)
-	if err != nil {
-		panic(err)
+// mutationExpression returns the CEL expression of a patch of the form `mutation: <expression>`.
+func mutationExpression(patch any) (string, error) {
+	m, ok := patch.(map[string]any)
+	if !ok {
+		return "", compileError("", nil, "expected patch to be an object containing a 'mutation' field, but got %T", patch)
 	}
-	parser := typed.Parser{Schema: smdschema.Schema{Types: specSchema.Types}}
-	t := parser.Type("root")
-	objT, err := t.FromUnstructured(obj)
-	if err != nil {
-		panic(err)
+	expression, ok := m["mutation"].(string)
+	if !ok {
+		return "", compileError("", field.NewPath("mutation"), "expected a CEL expression string, but got %T", m["mutation"])
 	}
-	patchT, err := t.FromUnstructured(patch)
-	if err != nil {
-		panic(err)
+	return expression, nil
+}
+
+// conversionProjection returns the projection of objects of the from version onto the fields
+// that are compatible with the to version.
+func conversionProjection(fromVersionSchema, toVersionSchema *spec.Schema) (*projection, error) {
+	p := newProjection(fromVersionSchema, toVersionSchema)
+	if p == nil || p.typ != "object" {
+		return nil, schemaError(nil, "expected the schemas of both versions to be objects")
+	}
+	return p, nil
+}
+
+// projectForConversion returns a copy of fromObject projected onto the fields that are compatible
+// with the to version, and a report of the values that were dropped.
+func projectForConversion(fromObject any, p *projection) (map[string]any, *ConversionReport, error) {
+	m, ok := fromObject.(map[string]any)
+	if !ok {
+		return nil, nil, schemaError(nil, "expected object to be a map, but got %T", fromObject)
 	}
-	result, err := objT.Merge(patchT)
+	report := &ConversionReport{}
+	projected, _ := p.project(m, true, nil, report)
+	report.sort()
+	return projected.(map[string]any), report, nil
+}
+
+// Merge performs a server side apply style merge of the patch (apply configuration) to the
+// obj.  The schema of the object is also required. If preserveUnknownFields is true, the
+// patch may add unrecognized fields, otherwise adding unrecognized fields will result in an error.
+// The Merger of the schema is cached, so the schema must not be modified after it is merged with.
+func Merge(s *spec.Schema, obj, patch any, preserveUnknownFields bool) (any, error) {
+	m, err := cachedMerger(s, preserveUnknownFields)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return result.AsValue().Unstructured()
+	return m.Merge(obj, patch)
 }
 
 // Substitute applies template variable substitution to the patch. All `{$: "<CEL expression>}`
@@ -152,223 +152,366 @@ func Merge(s *spec.Schema, obj, patch any, preserveUnknownFields bool) any {
 // obj provides the "oldObject" variable that is accessible in CEL expressions.
 // oldObjectSchema provides the schema of obj, and patchSchema provides the schema of the patch.
 // These schemas may be the same (e.g. for mutating admission) or may differ (e.g. for CRD conversion).
-func Substitute(oldObjectSchema, patchSchema common.Schema, obj, patch any, isConversion bool) any {
-	a := &applier{patchSchema: patchSchema, oldObjectSchema: oldObjectSchema, oldObject: obj, isConvertion: isConversion}
-	return a.applyTemplate(patchSchema, patch, obj)
+func Substitute(oldObjectSchema, patchSchema common.Schema, obj, patch any, isConversion bool) (any, error) {
+	env, err := newEnv(oldObjectSchema, patchSchema, isConversion)
+	if err != nil {
+		return nil, err
+	}
+	template, err := env.compileTemplate(patch)
+	if err != nil {
+		return nil, err
+	}
+	a := &applier{oldObject: obj, budget: newCostBudget(RuntimeCostBudget)}
+	return a.applyTemplate(patchSchema, oldObjectSchema, template, obj, nil, nil)
 }
 
-func EvalMutate(oldObjectSchema, patchSchema common.Schema, obj any, expression string) any {
-	a := &applier{patchSchema: patchSchema, oldObjectSchema: oldObjectSchema, oldObject: obj, isConvertion: false}
-	return a.evaluateSubstitution(expression, false)
+func EvalMutate(oldObjectSchema, patchSchema common.Schema, obj any, expression string) (any, error) {
+	env, err := newEnv(oldObjectSchema, patchSchema, false)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := env.compileExpression(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.eval(obj, nil, newCostBudget(RuntimeCostBudget))
 }
 
-func EvalConversion(oldObjectSchema, patchSchema common.Schema, obj, convertedObj any, expression string) any {
-	a := &applier{patchSchema: patchSchema, oldObjectSchema: oldObjectSchema, convertedObject: convertedObj, oldObject: obj, isConvertion: true}
-	return a.evaluateSubstitution(expression, true)
+func EvalConversion(oldObjectSchema, patchSchema common.Schema, obj, convertedObj any, expression string) (any, error) {
+	env, err := newEnv(oldObjectSchema, patchSchema, true)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := env.compileExpression(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.eval(obj, convertedObj, newCostBudget(RuntimeCostBudget))
 }
 
+// applier evaluates a compiled template against an object.
 type applier struct {
-	patchSchema     common.Schema
-	oldObjectSchema common.Schema
 	oldObject       any
 	convertedObject any
-	isConvertion    bool
+	budget          *costBudget
 }
 
 // applyTemplate applies any template substitutions at the current schema level
-// and then traverses to the next level of schema depth, if any.
-func (a *applier) applyTemplate(schema common.Schema, patchValue, oldValue any) any {
-	if m, ok := patchValue.(map[string]any); ok {
-		if v, ok := m[templateVar]; ok {
-			return a.evaluateSubstitution(v.(string), a.isConvertion)
-		}
+// and then traverses to the next level of schema depth, if any. oldValue is the value of the old
+// object at the same position, which is available to template directives as oldSelf, and oldSchema
+// is its schema. selfValue is the value of the converted object at the same position, which is
+// available to the template directives of conversions as self.
+func (a *applier) applyTemplate(schema, oldSchema common.Schema, patchValue, oldValue, selfValue any, path *field.Path) (any, error) {
+	if e, ok := patchValue.(*compiledExpression); ok {
+		return e.evalTemplate(a.oldObject, a.convertedObject, oldValue, selfValue, a.budget)
 	}
 	if schema.Properties() != nil {
 		m, ok := patchValue.(map[string]any)
 		if !ok {
-			panic("expected map")
+			return nil, schemaError(path, "expected map, but got %T", patchValue)
 		}
 		objM, _ := oldValue.(map[string]any)
+		selfM, _ := selfValue.(map[string]any)
 
 		result := map[string]any{}
 		for fieldName, propSchema := range schema.Properties() {
 			if v, ok := m[fieldName]; ok {
-				var objField any
-				if objM != nil {
-					objField = objM[fieldName]
+				r, err := a.applyTemplate(propSchema, propertySchema(oldSchema, fieldName), v, objM[fieldName], selfM[fieldName], path.Child(fieldName))
+				if err != nil {
+					return nil, err
 				}
-				result[fieldName] = a.applyTemplate(propSchema, v, objField)
+				result[fieldName] = r
 			}
 		}
-		return result
-	} else if schema.AdditionalProperties() != nil {
+		return result, nil
+	} else if schema.AdditionalProperties() != nil && schema.AdditionalProperties().Schema() != nil {
 		m, ok := patchValue.(map[string]any)
 		if !ok {
-			panic("expected map")
+			return nil, schemaError(path, "expected map, but got %T", patchValue)
 		}
 		objM, _ := oldValue.(map[string]any)
+		selfM, _ := selfValue.(map[string]any)
 
 		schema := schema.AdditionalProperties().Schema()
 		result := map[string]any{}
 		for k, v := range m {
-			var objField any
-			if objM != nil {
-				objField = objM[k]
+			r, err := a.applyTemplate(schema, propertySchema(oldSchema, k), v, objM[k], selfM[k], path.Key(k))
+			if err != nil {
+				return nil, err
 			}
-			result[k] = a.applyTemplate(schema, v, objField)
+			result[k] = r
 		}
-		return result
+		return result, nil
 	} else if schema.Items() != nil {
 		l, ok := patchValue.([]any)
 		if !ok {
-			panic("expected slice")
+			return nil, schemaError(path, "expected slice, but got %T", patchValue)
 		}
 
+		var oldItems common.Schema
+		if oldSchema != nil {
+			oldItems = oldSchema.Items()
+		}
+		objL, _ := oldValue.([]any)
+		selfL, _ := selfValue.([]any)
+
 		result := make([]any, len(l))
 		for i, el := range l {
-			var objEl any
-			// TODO: correlate
-
-			result[i] = a.applyTemplate(schema.Items(), el, objEl)
+			objEl := correlateListItem(schema, oldSchema, el, objL, i)
+			selfEl := correlateListItem(schema, schema, el, selfL, i)
+			r, err := a.applyTemplate(schema.Items(), oldItems, el, objEl, selfEl, path.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			result[i] = r
 		}
-		return result
+		return result, nil
 	} else {
-		return patchValue
+		return patchValue, nil
 	}
 }
 
-// TODO: This is not right. The schema needs to be the right one for whatever object "apply()"
-// was called on, which is not necessarily the root schema.
-type merger struct{}
+// celMerger implements objects.apply(). The merge is performed using the schema of the value
+// apply() was called on, which is not necessarily the root schema; a list item, a map value or a
+// nested object are merged according to the list and map semantics of their own schema.
+type celMerger struct{}
 
 type TypedRefVal interface {
 	Schema() common.Schema
 }
 
-func (m *merger) Merge(obj, patch, removals ref.Val) ref.Val {
+// Merge implements cel.Merger. Failures are returned as CEL error values that wrap an *Error.
+func (m *celMerger) Merge(obj, patch, removals ref.Val) ref.Val {
 	t, ok := obj.(TypedRefVal)
 	if !ok {
-		panic("expected TypedRefVal")
+		return mergeErrorVal(fmt.Errorf("objects.apply() requires a value with a schema, but got %s", obj.Type().TypeName()))
+	}
+	return m.mergeWithSchema(obj, t.Schema(), patch, removals)
+}
+
+// MergeField implements cel.Merger. Values that carry their schema are merged as by Merge, and
+// all other values, such as lists, using the schema of the field of parent.
+func (m *celMerger) MergeField(parent ref.Val, field string, obj, patch, removals ref.Val) ref.Val {
+	if _, ok := obj.(TypedRefVal); ok {
+		return m.Merge(obj, patch, removals)
+	}
+	t, ok := parent.(TypedRefVal)
+	if !ok {
+		return mergeErrorVal(fmt.Errorf("objects.apply() requires a value with a schema, but got %s", obj.Type().TypeName()))
+	}
+	fieldSchema := propertySchema(t.Schema(), field)
+	if fieldSchema == nil {
+		return mergeErrorVal(fmt.Errorf("objects.apply() requires a value with a schema, but field %q has none", field))
+	}
+	return m.mergeWithSchema(obj, fieldSchema, patch, removals)
+}
+
+// mergeWithSchema merges the patch into obj, which is of the schema, and then removes the
+// removals.
+func (m *celMerger) mergeWithSchema(obj ref.Val, commonSchema common.Schema, patch, removals ref.Val) ref.Val {
+	var mg *Merger
+	var err error
+	switch s := commonSchema.(type) {
+	case *schemaNode:
+		mg, err = s.getMerger()
+	case *openapi.Schema:
+		mg, err = cachedMerger(s.Schema, false)
+	default:
+		return mergeErrorVal(fmt.Errorf("objects.apply() requires an OpenAPI schema, but got %T", commonSchema))
+	}
+	if err != nil {
+		return types.NewErr("%w", err)
+	}
+	objVal, err := valueToUnstructured(obj)
+	if err != nil {
+		return mergeErrorVal(err)
+	}
+	patchval, err := valueToUnstructured(patch)
+	if err != nil {
+		return mergeErrorVal(err)
 	}
-	commonSchema := t.Schema()
-	openAPISchema := commonSchema.(*openapi.Schema) // TODO
-	s := openAPISchema.Schema
-	objVal := valueToUnstructured(obj)
-	patchval := valueToUnstructured(patch)
 
-	result := Merge(s, objVal, patchval, false)
-	resultObj := result.(map[string]any)
-	iter := removals.(traits.Iterable).Iterator()
+	result, err := mg.Merge(objVal, patchval)
+	if err != nil {
+		return types.NewErr("%w", err)
+	}
+	removalList, ok := removals.(traits.Iterable)
+	if !ok {
+		return mergeErrorVal(fmt.Errorf("expected removals to be a list, but got %s", removals.Type().TypeName()))
+	}
+	iter := removalList.Iterator()
 	for iter.HasNext() == types.True {
-		removal := iter.Next().Value().(string)
-		removalPath := strings.Split(removal, ".")
-		result = m.filter(result, removalPath)
+		removal, err := valueToUnstructured(iter.Next())
+		if err != nil {
+			return mergeErrorVal(err)
+		}
+		removalPath, ok := removal.([]any)
+		if !ok {
+			return mergeErrorVal(fmt.Errorf("expected removal to be a path, but got %T", removal))
+		}
+		result, err = m.filter(result, commonSchema, removalPath)
+		if err != nil {
+			return mergeErrorVal(fmt.Errorf("unable to remove %v: %w", removalPath, err))
+		}
 	}
-	return common.UnstructuredToVal(resultObj, openAPISchema)
+	return common.UnstructuredToVal(result, commonSchema)
 }
 
-// TODO: Account for listType=map
-func (m *merger) filter(obj any, path []string) any {
-	l := len(path)
-	switch l {
-	case 0:
-		panic("path must be non-empty")
-	case 1:
-		key := path[0]
-		switch o := obj.(type) {
-		case map[string]any:
-			delete(o, key)
-			return o
-		case []any:
-			// TODO: support removals from listType=map using key fields
-			panic("removals not supported for lists")
-		default:
-			panic("path must contain valid map keys and list indices")
+// correlateListItem returns the item of the old list that corresponds to the patch list item at
+// index i, or nil if there is none. Items of listType=map lists are correlated by their map keys,
+// which must be set in the patch and not be template directives. Items of atomic lists are
+// correlated by index. Items of listType=set lists are not correlated.
+func correlateListItem(schema, oldSchema common.Schema, patchItem any, oldList []any, i int) any {
+	if oldSchema == nil || len(oldList) == 0 {
+		return nil
+	}
+	switch schema.XListType() {
+	case "map":
+		keys := schema.XListMapKeys()
+		oldKeys := oldSchema.XListMapKeys()
+		if oldSchema.XListType() != "map" || len(keys) != len(oldKeys) {
+			return nil
+		}
+		m, ok := patchItem.(map[string]any)
+		if !ok {
+			return nil
+		}
+		for _, el := range oldList {
+			oldM, ok := el.(map[string]any)
+			if !ok {
+				continue
+			}
+			match := true
+			for j, k := range keys {
+				v, ok := m[k]
+				if !ok {
+					return nil
+				}
+				if _, ok := v.(*compiledExpression); ok {
+					return nil
+				}
+				if !reflect.DeepEqual(v, oldM[oldKeys[j]]) {
+					match = false
+					break
+				}
+			}
+			if match {
+				return el
+			}
 		}
+		return nil
+	case "set":
+		return nil
 	default:
-		key := path[0]
-		switch o := obj.(type) {
-		case map[string]any:
-			o[key] = m.filter(o[key], path[1:])
-			return o
-		case []any:
-			// TODO: support removals from listType=map using key fields
-			panic("removals not supported for lists")
-		default:
-			panic("path must contain valid map keys and list indices")
+		if i < len(oldList) {
+			return oldList[i]
 		}
+		return nil
 	}
 }
 
-// evaluateSubstitution a template variable substitution CEL expression.
-func (a *applier) evaluateSubstitution(expression string, isConversion bool) any {
-	objVal := common.UnstructuredToVal(a.oldObject, a.oldObjectSchema)
+func mergeErrorVal(err error) ref.Val {
+	return types.NewErr("%w", newError(ErrorTypeMerge, "", nil, err))
+}
 
-	m := &merger{}
-	baseEnv, err := buildBaseEnv(m)
-	if err != nil {
-		panic(err)
+// filter removes the value at path from obj. Each path element is either a field name or map
+// key, or a listType=map entry, which is matched against the entries of the list using the
+// list's x-kubernetes-list-map-keys.
+func (m *celMerger) filter(obj any, s common.Schema, path []any) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path must be non-empty")
 	}
-
-	var rt *common.OpenAPITypeProvider
-	var oldObjectCelType, convertedObjectCelType *cel.Type
-	if isConversion {
-		patchDecl := common.SchemaDeclType(a.patchSchema, true).MaybeAssignTypeName(objectTypeName)
-		oldObjectDecl := common.SchemaDeclType(a.oldObjectSchema, true).MaybeAssignTypeName(oldObjectTypeName)
-		rt, err = common.NewOpenAPITypeProvider(patchDecl, oldObjectDecl)
-		if err != nil {
-			panic(err)
+	switch o := obj.(type) {
+	case map[string]any:
+		key, ok := path[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a field name or map key, but got %T", path[0])
 		}
-		convertedObjectCelType = patchDecl.CelType()
-		oldObjectCelType = oldObjectDecl.CelType()
-	} else {
-		objectDecl := common.SchemaDeclType(a.patchSchema, true).MaybeAssignTypeName(objectTypeName)
-		rt, err = common.NewOpenAPITypeProvider(objectDecl)
+		if len(path) == 1 {
+			delete(o, key)
+			return o, nil
+		}
+		v, ok := o[key]
+		if !ok {
+			return o, nil // nothing to remove
+		}
+		v, err := m.filter(v, propertySchema(s, key), path[1:])
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		o[key] = v
+		return o, nil
+	case []any:
+		if s == nil || s.XListType() != "map" {
+			if len(path) == 1 {
+				return nil, fmt.Errorf("objects.remove() requires a list with x-kubernetes-list-type: map")
+			}
+			// Lists that are not listType=map are replaced by the apply configuration, so fields
+			// removed from their entries are already absent.
+			return o, nil
+		}
+		entry, ok := path[0].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("expected a list entry, but got %T", path[0])
+		}
+		keys := s.XListMapKeys()
+		for _, k := range keys {
+			if _, ok := entry[k]; !ok {
+				return nil, fmt.Errorf("list entry must set the map key field %q", k)
+			}
+		}
+		result := make([]any, 0, len(o))
+		for _, el := range o {
+			if !listMapKeysEqual(el, entry, keys) {
+				result = append(result, el)
+				continue
+			}
+			if len(path) == 1 {
+				continue
+			}
+			el, err := m.filter(el, s.Items(), path[1:])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, el)
 		}
-		oldObjectCelType = objectDecl.CelType()
+		return result, nil
+	default:
+		return nil, fmt.Errorf("path must contain valid map keys and list entries")
 	}
+}
 
-	opts, err := rt.EnvOptions(baseEnv.TypeProvider())
-	if err != nil {
-		panic(err)
+// propertySchema returns the schema of the property or map value with the given name, or nil if
+// the schema does not declare it.
+func propertySchema(s common.Schema, name string) common.Schema {
+	if s == nil {
+		return nil
 	}
-	opts = append(opts,
-		cel.Variable(oldObjectVar, oldObjectCelType),
-	)
-	if isConversion {
-		opts = append(opts,
-			cel.Variable(convertedObjectVar, convertedObjectCelType),
-		)
+	if prop, ok := s.Properties()[name]; ok {
+		return prop
 	}
-	env, err := baseEnv.Extend(opts...)
-	if err != nil {
-		panic(err)
-	}
-	ast, issues := env.Compile(expression)
-	if issues != nil {
-		panic(issues)
-	}
-	// TODO: check return type matches schema type
-	prog, err := env.Program(ast)
-	if err != nil {
-		panic(err)
+	if s.AdditionalProperties() != nil {
+		return s.AdditionalProperties().Schema()
 	}
-	activation := &evaluationActivation{object: objVal}
-	if a.isConvertion {
-		conversionVal := common.UnstructuredToVal(a.convertedObject, a.patchSchema)
-		activation.conversionObject = conversionVal
+	return nil
+}
+
+// listMapKeysEqual returns true if a listType=map entry has the same values for all keys as other.
+func listMapKeysEqual(entry any, other map[string]any, keys []string) bool {
+	m, ok := entry.(map[string]any)
+	if !ok {
+		return false
 	}
-	v, _, err := prog.Eval(activation)
-	if err != nil {
-		panic(err)
+	for _, k := range keys {
+		if !reflect.DeepEqual(m[k], other[k]) {
+			return false
+		}
 	}
-	return valueToUnstructured(v)
+	return true
 }
 
 // valueToUnstructured strips away all ref.Val and replaces them with unstructured equivalents.
-func valueToUnstructured(o any) any {
+func valueToUnstructured(o any) (any, error) {
 	// TODO: this is a mess. Essentially, I need a way to convert data back out of CEL and
 	// because of data literals, the data can be a mix of ref.Vals and Go scalars...
 	switch a := o.(type) {
@@ -377,36 +520,56 @@ func valueToUnstructured(o any) any {
 		case map[ref.Val]ref.Val:
 			result := make(map[string]any, len(t))
 			for k, v := range t {
-				result[k.Value().(string)] = valueToUnstructured(v)
+				key, ok := k.Value().(string)
+				if !ok {
+					return nil, fmt.Errorf("expected map key to be a string, but got %s", k.Type().TypeName())
+				}
+				uv, err := valueToUnstructured(v)
+				if err != nil {
+					return nil, err
+				}
+				result[key] = uv
 			}
-			return result
+			return result, nil
 		case []ref.Val:
 			result := make([]any, len(t))
 			for i, e := range t {
-				result[i] = valueToUnstructured(e)
+				ue, err := valueToUnstructured(e)
+				if err != nil {
+					return nil, err
+				}
+				result[i] = ue
 			}
-			return result
+			return result, nil
 		case time.Duration:
-			return t.String() // TODO: what other types should be handled here?
+			return t.String(), nil // TODO: what other types should be handled here?
 		default:
 			return valueToUnstructured(t)
 		}
 	case map[string]any:
 		result := make(map[string]any, len(a))
 		for k, v := range a {
-			result[k] = valueToUnstructured(v)
+			uv, err := valueToUnstructured(v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = uv
 		}
-		return result
+		return result, nil
 	case []any:
 		result := make([]any, len(a))
 		for i, e := range a {
-			result[i] = valueToUnstructured(e)
+			ue, err := valueToUnstructured(e)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = ue
 		}
-		return result
+		return result, nil
 	case time.Duration:
-		return a.String()
+		return a.String(), nil
 	}
-	return o
+	return o, nil
 }
 
 func baseOpts(merger cel2.Merger) []cel.EnvOption {
@@ -428,6 +591,13 @@ func buildBaseEnv(merger cel2.Merger) (*cel.Env, error) {
 
 type evaluationActivation struct {
 	object, conversionObject any
+	// scoped is true if the oldSelf and self variables are available.
+	scoped        bool
+	oldSelf, self ref.Val
+	// params is nil if the expression was compiled without params.
+	params ref.Val
+	// request is nil unless the expression is a match condition.
+	request ref.Val
 }
 
 // ResolveName returns a value from the activation by qualified name, or false if the name
@@ -438,6 +608,14 @@ func (a *evaluationActivation) ResolveName(name string) (interface{}, bool) {
 		return a.object, true
 	case convertedObjectVar:
 		return a.conversionObject, true
+	case oldSelfVar:
+		return a.oldSelf, a.scoped
+	case selfVar:
+		return a.self, a.scoped
+	case paramsVar:
+		return a.params, a.params != nil
+	case requestVar:
+		return a.request, a.request != nil
 	default:
 		return nil, false
 	}
@@ -17,15 +17,23 @@ limitations under the License.
 package apply
 
 import (
+	gojson "encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
-	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
-	v1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	schema2 "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"github.com/google/cel-go/common/types"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/apiserver/pkg/cel/openapi"
 	"k8s.io/kube-openapi/pkg/validation/spec"
 
 	"sigs.k8s.io/yaml"
@@ -55,11 +63,826 @@ func TestConvertApply(t *testing.T) {
 	testConvert(t, "apply", ConvertApply)
 }
 
-type mutateFn func(schema *spec.Schema, obj any, patch any) any
+func TestMutateErrors(t *testing.T) {
+	schema := loadTestSchema()
+	original := loadTestYaml[any](filepath.Join(testdata, "basicmerge", "mutate", "basic", "original.yaml"))
+
+	cases := []struct {
+		name         string
+		mutator      mutateFn
+		patch        any
+		expectedType ErrorType
+		expectedPath string
+	}{
+		{
+			name:         "missing mutation",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{},
+			expectedType: ErrorTypeCompile,
+			expectedPath: "mutation",
+		},
+		{
+			name:         "syntax error",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{"mutation": "Object{"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:         "undeclared reference",
+			mutator:      MutateApply,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{deploymentName: noSuchVariable}}"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:         "evaluation error",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{deploymentName: oldObject.spec.list[5]}}"},
+			expectedType: ErrorTypeEvaluation,
+		},
+		{
+			name:         "wrong result type",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{"mutation": "'not an object'"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:         "wrong dynamic result type",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{"mutation": "dyn('not an object')"},
+			expectedType: ErrorTypeSchema,
+		},
+		{
+			name:    "template wrong result type",
+			mutator: MutateWithTemplate,
+			patch: map[string]any{"spec": map[string]any{
+				"replicas": map[string]any{"$": "'not an integer'"},
+			}},
+			expectedType: ErrorTypeCompile,
+			expectedPath: "spec.replicas",
+		},
+		{
+			name:    "template wrong list item type",
+			mutator: MutateWithTemplate,
+			patch: map[string]any{"spec": map[string]any{
+				"listMap": map[string]any{"$": "oldObject.spec.list"},
+			}},
+			expectedType: ErrorTypeCompile,
+			expectedPath: "spec.listMap",
+		},
+		{
+			name:         "remove from atomic list",
+			mutator:      MutateApply,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{list: [objects.remove('a')]}}"},
+			expectedType: ErrorTypeMerge,
+		},
+		{
+			name:         "remove outside objects.apply()",
+			mutator:      MutateBasicMerge,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{listMap: [objects.remove(Object.spec.listMap.item{key: 'k1'})]}}"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:         "remove outside a list literal",
+			mutator:      MutateApply,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{listMap: oldObject.spec.listMap.map(e, objects.remove(e))}}"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:         "remove of a removed entry",
+			mutator:      MutateApply,
+			patch:        map[string]any{"mutation": "Object{spec: Object.spec{list: [objects.remove(objects.remove('a'))]}}"},
+			expectedType: ErrorTypeCompile,
+		},
+		{
+			name:    "template evaluation error",
+			mutator: MutateWithTemplate,
+			patch: map[string]any{"spec": map[string]any{
+				"listMap": []any{map[string]any{"key": "k1", "value": map[string]any{"$": "oldObject.spec.list[5]"}}},
+			}},
+			expectedType: ErrorTypeEvaluation,
+			expectedPath: "spec.listMap[0].value",
+		},
+		{
+			name:    "template oldSelf undeclared field",
+			mutator: MutateWithTemplate,
+			patch: map[string]any{"spec": map[string]any{
+				"deploymentName": map[string]any{"$": "oldSelf.noSuchField"},
+			}},
+			expectedType: ErrorTypeCompile,
+			expectedPath: "spec.deploymentName",
+		},
+		{
+			name:    "template self in mutation",
+			mutator: MutateWithTemplate,
+			patch: map[string]any{"spec": map[string]any{
+				"deploymentName": map[string]any{"$": "self"},
+			}},
+			expectedType: ErrorTypeCompile,
+			expectedPath: "spec.deploymentName",
+		},
+		{
+			name:         "template schema mismatch",
+			mutator:      MutateWithTemplate,
+			patch:        map[string]any{"spec": []any{"x"}},
+			expectedType: ErrorTypeSchema,
+			expectedPath: "spec",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.mutator(&schema, original, tc.patch)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			var applyErr *Error
+			if !errors.As(err, &applyErr) {
+				t.Fatalf("expected *Error but got %T: %v", err, err)
+			}
+			if applyErr.Type != tc.expectedType {
+				t.Errorf("expected error type %s but got %s: %v", tc.expectedType, applyErr.Type, err)
+			}
+			if applyErr.Path != tc.expectedPath {
+				t.Errorf("expected error path %q but got %q: %v", tc.expectedPath, applyErr.Path, err)
+			}
+		})
+	}
+}
+
+func TestTemplateAssignIntToNumber(t *testing.T) {
+	var schema spec.Schema
+	if err := yaml.Unmarshal([]byte(`
+type: object
+properties:
+  spec:
+    type: object
+    properties:
+      ratio: {type: number}
+      ratios: {type: array, items: {type: number}}
+      weights: {type: object, additionalProperties: {type: number}}
+`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	patch := map[string]any{"spec": map[string]any{
+		"ratio":   map[string]any{"$": "1"},
+		"ratios":  map[string]any{"$": "[1, 2]"},
+		"weights": map[string]any{"$": "{'a': 3}"},
+	}}
+	result, err := MutateWithTemplate(&schema, yamlValue(t, `{spec: {}}`), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := yamlValue(t, `{spec: {ratio: 1, ratios: [1, 2], weights: {a: 3}}}`); !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v but got %v", expected, result)
+	}
+}
+
+func TestCelMergerInvalidRemovals(t *testing.T) {
+	schema := loadTestSchema()
+	s := newSchemaNode(&schema)
+	obj := common.UnstructuredToVal(map[string]any{"spec": map[string]any{"deploymentName": "a"}}, s)
+	patch := common.UnstructuredToVal(map[string]any{"spec": map[string]any{"deploymentName": "b"}}, s)
+	result := (&celMerger{}).Merge(obj, patch, types.String("not a list"))
+	if !types.IsError(result) {
+		t.Fatalf("expected an error but got %v", result)
+	}
+	if err := evaluationError("", nil, result.(*types.Err)); err.Type != ErrorTypeMerge {
+		t.Errorf("expected a merge error but got %v", err)
+	}
+}
+
+func TestObjectsApplyEvaluatesArgumentsOnce(t *testing.T) {
+	schema := loadTestSchema()
+	s := newSchemaNode(&schema)
+	env, err := newEnv(s, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// oldObject is referenced once by the parent of the target, and once by each list entry.
+	expression := `objects.apply(oldObject.spec, Object.spec{listMap: [
+		objects.remove(Object.spec.listMap.item{key: oldObject.metadata.name}),
+		Object.spec.listMap.item{key: "k", value: oldObject.spec.deploymentName}
+	]})`
+	ast, issues := env.env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		t.Fatal(issues.Err())
+	}
+	if count := countIdents(ast.Expr(), oldObjectVar); count != 3 {
+		t.Errorf("expected oldObject to be evaluated 3 times, but it is evaluated %d times", count)
+	}
+}
+
+// countIdents returns the number of references to the variable name in e.
+func countIdents(e *exprpb.Expr, name string) int {
+	count := 0
+	switch k := e.GetExprKind().(type) {
+	case *exprpb.Expr_IdentExpr:
+		if k.IdentExpr.GetName() == name {
+			count++
+		}
+	case *exprpb.Expr_SelectExpr:
+		count += countIdents(k.SelectExpr.GetOperand(), name)
+	case *exprpb.Expr_CallExpr:
+		if k.CallExpr.GetTarget() != nil {
+			count += countIdents(k.CallExpr.GetTarget(), name)
+		}
+		for _, arg := range k.CallExpr.GetArgs() {
+			count += countIdents(arg, name)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, el := range k.ListExpr.GetElements() {
+			count += countIdents(el, name)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			if entry.GetMapKey() != nil {
+				count += countIdents(entry.GetMapKey(), name)
+			}
+			count += countIdents(entry.GetValue(), name)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		c := k.ComprehensionExpr
+		for _, sub := range []*exprpb.Expr{c.GetIterRange(), c.GetAccuInit(), c.GetLoopCondition(), c.GetLoopStep(), c.GetResult()} {
+			count += countIdents(sub, name)
+		}
+	}
+	return count
+}
+
+func TestTemplateWithoutOldValues(t *testing.T) {
+	schema := loadTestSchema()
+	// Scalars without an old value are null, and lists and maps are empty.
+	patch := map[string]any{
+		"metadata": map[string]any{"labels": map[string]any{"$": "size(oldSelf) == 0 ? {'app': 'default'} : oldSelf"}},
+		"spec": map[string]any{
+			"deploymentName": map[string]any{"$": "oldSelf == null ? 'created' : oldSelf + '-updated'"},
+			"replicas":       map[string]any{"$": "oldSelf == null ? 1 : oldSelf + 1"},
+			"list":           map[string]any{"$": "oldSelf + ['c']"},
+		},
+	}
+	compiled, err := CompileMutateWithTemplate(&schema, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ object, expected string }{
+		{
+			object:   `{metadata: {name: a}, spec: {}}`,
+			expected: `{metadata: {name: a, labels: {app: default}}, spec: {deploymentName: created, replicas: 1, list: [c]}}`,
+		},
+		{
+			object:   `{metadata: {name: a, labels: {app: web}}, spec: {deploymentName: d, replicas: 2, list: [b]}}`,
+			expected: `{metadata: {name: a, labels: {app: web}}, spec: {deploymentName: d-updated, replicas: 3, list: [b, c]}}`,
+		},
+	} {
+		result, err := compiled.Apply(yamlValue(t, tc.object))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := yamlValue(t, tc.expected); !reflect.DeepEqual(expected, result) {
+			t.Errorf("expected %v but got %v", expected, result)
+		}
+	}
+}
+
+func TestCompiledMutationConcurrentApply(t *testing.T) {
+	schema := loadTestSchema()
+	testDir := filepath.Join(testdata, "apply", "mutate", "unsettingfields")
+	original := loadTestYaml[any](filepath.Join(testDir, "original.yaml"))
+	patch := loadTestYaml[any](filepath.Join(testDir, "patch.yaml"))
+	expected := loadTestYaml[any](filepath.Join(testDir, "expected.yaml"))
+
+	compiled, err := CompileMutateApply(&schema, patch, WithEstimatedCostLimit(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			merged, err := compiled.Apply(runtime.DeepCopyJSONValue(original))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !reflect.DeepEqual(expected, merged) {
+				errs <- fmt.Errorf("expected:\n%s\nBut got:\n%s", yamlToString(expected), yamlToString(merged))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestObjectsApplyReusesMerger(t *testing.T) {
+	schema, original, patch := loadBenchmarkCase("apply", "unsettingfields")
+	compiled, err := CompileMutateApply(&schema, patch, WithEstimatedCostLimit(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiled.Apply(original); err != nil {
+		t.Fatal(err)
+	}
+	// objects.apply() is called on each widget and should cache the merger on the widget item schema.
+	widgets := compiled.schema.Properties()["spec"].Properties()["widgets"].Items().(*schemaNode)
+	if widgets.merger == nil {
+		t.Fatal("expected merger to be cached on the widgets item schema")
+	}
+	merger := widgets.merger
+	if _, err := compiled.Apply(original); err != nil {
+		t.Fatal(err)
+	}
+	if widgets.merger != merger {
+		t.Error("expected cached merger to be reused")
+	}
+}
+
+func TestParams(t *testing.T) {
+	schema := loadTestSchema()
+	original := loadTestYaml[map[string]any](filepath.Join(testdata, "basicmerge", "mutate", "basic", "original.yaml"))
+	params := map[string]any{
+		"suffix":   "-deployment",
+		"replicas": int64(3),
+		"names":    []any{"c", "d"},
+	}
+
+	t.Run("mutation", func(t *testing.T) {
+		expression := "Object{spec: Object.spec{deploymentName: oldObject.metadata.name + params.suffix, replicas: params.replicas + size(params.names)}}"
+		compiled, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": expression}, WithParams(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := compiled.Apply(runtime.DeepCopyJSON(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec := result.(map[string]any)["spec"].(map[string]any)
+		if spec["deploymentName"] != "alpha-deployment" || spec["replicas"] != int64(5) {
+			t.Errorf("expected params to be substituted, but got %s", yamlToString(spec))
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		patch := map[string]any{"spec": map[string]any{
+			"list": map[string]any{"$": "params.names.map(n, n + params.suffix)"},
+		}}
+		compiled, err := CompileMutateWithTemplate(&schema, patch, WithParams(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := compiled.Apply(runtime.DeepCopyJSON(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []any{"c-deployment", "d-deployment"}
+		if list := result.(map[string]any)["spec"].(map[string]any)["list"]; !reflect.DeepEqual(expected, list) {
+			t.Errorf("expected list %v but got %v", expected, list)
+		}
+	})
+
+	t.Run("cost is bounded by the size of the params", func(t *testing.T) {
+		// The same nested comprehensions over oldObject.spec.list exceed the estimated cost limit.
+		expression := "Object{spec: Object.spec{replicas: params.names.map(a, params.names.map(b, " +
+			"params.names.map(c, params.names.map(d, params.names.map(e, a + b + c + d + e))))).size()}}"
+		if _, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": expression}, WithParams(params), WithEstimatedCostLimit(StaticEstimatedCostLimit)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("params not declared", func(t *testing.T) {
+		_, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": "Object{spec: Object.spec{deploymentName: params.suffix}}"})
+		if err == nil || !strings.Contains(err.Error(), "undeclared reference to 'params'") {
+			t.Errorf("expected undeclared reference error but got %v", err)
+		}
+	})
+
+	for _, tc := range []struct {
+		name          string
+		params        any
+		expectedError string
+	}{
+		{name: "null", params: map[string]any{"a": nil}, expectedError: "params.a: params may not contain null values"},
+		{name: "mixed list", params: []any{"a", int64(1)}, expectedError: "params[1]: the items of a params list must all be of the same type, but got string and integer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": "Object{}"}, WithParams(tc.params))
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConversionProjection(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		object   string
+		expected string
+		// expectedDropped are the paths and reasons of the dropped values.
+		expectedDropped []string
+	}{
+		{
+			name:            "compatible fields are kept",
+			from:            "{type: object, properties: {a: {type: string}, b: {type: integer}, c: {type: boolean}}}",
+			to:              "{type: object, properties: {a: {type: string}, b: {type: number}, d: {type: boolean}}}",
+			object:          "{apiVersion: v1, kind: Example, a: x, b: 1, c: true}",
+			expected:        "{apiVersion: v1, kind: Example, a: x, b: 1}",
+			expectedDropped: []string{"c UnknownField"},
+		},
+		{
+			name:            "fields with incompatible types are dropped",
+			from:            "{type: object, properties: {a: {type: string}, b: {type: object, properties: {c: {type: string}}}}}",
+			to:              "{type: object, properties: {a: {type: integer}, b: {type: array, items: {type: string}}}}",
+			object:          "{a: x, b: {c: y}}",
+			expected:        "{}",
+			expectedDropped: []string{"a TypeMismatch", "b TypeMismatch"},
+		},
+		{
+			name:            "int-or-string",
+			from:            "{type: object, properties: {a: {type: integer}, b: {type: string}, c: {type: boolean}}}",
+			to:              "{type: object, properties: {a: {x-kubernetes-int-or-string: true}, b: {x-kubernetes-int-or-string: true}, c: {x-kubernetes-int-or-string: true}}}",
+			object:          "{a: 1, b: 50%, c: true}",
+			expected:        "{a: 1, b: 50%}",
+			expectedDropped: []string{"c TypeMismatch"},
+		},
+		{
+			name:            "numbers to integers",
+			from:            "{type: object, properties: {a: {type: number}, b: {type: number}, c: {type: number}, d: {type: number}}}",
+			to:              "{type: object, properties: {a: {type: integer}, b: {type: integer}, c: {x-kubernetes-int-or-string: true}, d: {x-kubernetes-int-or-string: true}}}",
+			object:          "{a: 3.0, b: 3.5, c: 4.0, d: 4.5}",
+			expected:        "{a: 3, c: 4}",
+			expectedDropped: []string{"b TypeMismatch", "d TypeMismatch"},
+		},
+		{
+			name:            "nullable",
+			from:            "{type: object, properties: {a: {type: string, nullable: true}, b: {type: string, nullable: true}}}",
+			to:              "{type: object, properties: {a: {type: string, nullable: true}, b: {type: string}}}",
+			object:          "{a: null, b: null}",
+			expected:        "{a: null}",
+			expectedDropped: []string{"b TypeMismatch"},
+		},
+		{
+			name: "list map with the same keys",
+			from: "{type: object, properties: {l: {type: array, x-kubernetes-list-type: map, x-kubernetes-list-map-keys: [k], items: {type: object, properties: {k: {type: string}, v: {type: string}}}}}}",
+			to:   "{type: object, properties: {l: {type: array, x-kubernetes-list-type: map, x-kubernetes-list-map-keys: [k], items: {type: object, properties: {k: {type: string}}}}}}",
+			// Items that are missing keys are dropped.
+			object:          "{l: [{k: a, v: x}, {v: y}]}",
+			expected:        "{l: [{k: a}]}",
+			expectedDropped: []string{"l[0].v UnknownField", "l[1] MissingMapKey"},
+		},
+		{
+			name:            "list map with different keys",
+			from:            "{type: object, properties: {l: {type: array, x-kubernetes-list-type: map, x-kubernetes-list-map-keys: [k], items: {type: object, properties: {k: {type: string}, v: {type: string}}}}}}",
+			to:              "{type: object, properties: {l: {type: array, x-kubernetes-list-type: map, x-kubernetes-list-map-keys: [v], items: {type: object, properties: {k: {type: string}, v: {type: string}}}}}}",
+			object:          "{l: [{k: a, v: x}]}",
+			expected:        "{}",
+			expectedDropped: []string{"l TypeMismatch"},
+		},
+		{
+			name:            "atomic list to set",
+			from:            "{type: object, properties: {l: {type: array, items: {type: string}}, s: {type: array, x-kubernetes-list-type: set, items: {type: string}}}}",
+			to:              "{type: object, properties: {l: {type: array, x-kubernetes-list-type: set, items: {type: string}}, s: {type: array, items: {type: string}}}}",
+			object:          "{l: [a, a], s: [a, b]}",
+			expected:        "{s: [a, b]}",
+			expectedDropped: []string{"l TypeMismatch"},
+		},
+		{
+			name:            "properties to additional properties",
+			from:            "{type: object, properties: {m: {type: object, properties: {a: {type: string}, b: {type: integer}}}}}",
+			to:              "{type: object, properties: {m: {type: object, additionalProperties: {type: string}}}}",
+			object:          "{m: {a: x, b: 1}}",
+			expected:        "{m: {a: x}}",
+			expectedDropped: []string{"m.b TypeMismatch"},
+		},
+		{
+			name:            "preserved unknown fields",
+			from:            "{type: object, properties: {a: {type: string}, b: {type: string}, c: {type: string}}}",
+			to:              "{type: object, x-kubernetes-preserve-unknown-fields: true, properties: {a: {type: string}, b: {type: integer}}}",
+			object:          "{a: x, b: y, c: z}",
+			expected:        "{a: x, c: z}",
+			expectedDropped: []string{"b TypeMismatch"},
+		},
+		{
+			name:            "from preserved unknown fields",
+			from:            "{type: object, x-kubernetes-preserve-unknown-fields: true}",
+			to:              "{type: object, properties: {a: {type: string}, b: {type: integer}}}",
+			object:          "{a: x, b: y, c: z}",
+			expected:        "{a: x}",
+			expectedDropped: []string{"b TypeMismatch", "c UnknownField"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var from, to spec.Schema
+			if err := yaml.Unmarshal([]byte(tc.from), &from); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tc.to), &to); err != nil {
+				t.Fatal(err)
+			}
+			p, err := conversionProjection(&from, &to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var object, expected any
+			for _, v := range []struct {
+				s   string
+				out *any
+			}{{tc.object, &object}, {tc.expected, &expected}} {
+				j, err := yaml.YAMLToJSON([]byte(v.s))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(j, v.out); err != nil {
+					t.Fatal(err)
+				}
+			}
+			projected, report, err := projectForConversion(object, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dropped []string
+			for _, d := range report.Dropped {
+				dropped = append(dropped, fmt.Sprintf("%s %s", d.Path, d.Reason))
+			}
+			if !reflect.DeepEqual(tc.expectedDropped, dropped) {
+				t.Errorf("expected dropped values %v but got %v", tc.expectedDropped, dropped)
+			}
+			if !reflect.DeepEqual(expected, any(projected)) {
+				t.Errorf("Expected:\n%s\nBut got:\n%s\n", yamlToString(expected), yamlToString(projected))
+			}
+		})
+	}
+}
+
+func TestProjectNumbersToIntegers(t *testing.T) {
+	var from, to spec.Schema
+	if err := yaml.Unmarshal([]byte("{type: object, properties: {a: {type: number}, b: {type: number}}}"), &from); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte("{type: object, properties: {a: {type: integer}, b: {type: integer}}}"), &to); err != nil {
+		t.Fatal(err)
+	}
+	p, err := conversionProjection(&from, &to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projected, report, err := projectForConversion(map[string]any{"a": 3.0, "b": 3.5}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]any{"a": int64(3)}; !reflect.DeepEqual(expected, projected) {
+		t.Errorf("expected %#v but got %#v", expected, projected)
+	}
+	if len(report.Dropped) != 1 || report.Dropped[0].Path != "b" || report.Dropped[0].Reason != DropReasonTypeMismatch {
+		t.Errorf("expected b to be dropped as a type mismatch, but got %v", report.Dropped)
+	}
+}
+
+func TestProjectScalars(t *testing.T) {
+	// The schemas of both versions are the same, so that only the values are checked.
+	var s spec.Schema
+	if err := yaml.Unmarshal([]byte(`
+type: object
+properties:
+  b: {type: boolean}
+  i: {type: integer}
+  num: {type: number}
+  ios: {x-kubernetes-int-or-string: true}
+  nullable: {type: string, nullable: true}
+  notNullable: {type: string}
+  dateTime: {type: string, format: date-time}
+  duration: {type: string, format: duration}
+  quantity: {type: string, format: quantity}
+  list: {type: array, items: {type: integer}}
+  listMap:
+    type: array
+    x-kubernetes-list-type: map
+    x-kubernetes-list-map-keys: [k]
+    items: {type: object, properties: {k: {type: string}}}
+  obj: {type: object, properties: {s: {type: string}}}
+`), &s); err != nil {
+		t.Fatal(err)
+	}
+	p, err := conversionProjection(&s, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name            string
+		object          map[string]any
+		expected        map[string]any
+		expectedDropped []string
+	}{
+		{
+			name:     "valid values are kept",
+			object:   map[string]any{"b": true, "i": int64(1), "num": 1.5, "ios": "50%", "nullable": nil, "dateTime": "2023-04-01T00:00:00Z", "duration": "1h", "quantity": "1Gi"},
+			expected: map[string]any{"b": true, "i": int64(1), "num": 1.5, "ios": "50%", "nullable": nil, "dateTime": "2023-04-01T00:00:00Z", "duration": "1h", "quantity": "1Gi"},
+		},
+		{
+			name:            "values of the wrong type are dropped",
+			object:          map[string]any{"b": "true", "i": "1", "num": true, "ios": false, "obj": "s", "list": map[string]any{}},
+			expected:        map[string]any{},
+			expectedDropped: []string{"b", "i", "ios", "list", "num", "obj"},
+		},
+		{
+			name:     "numbers are coerced",
+			object:   map[string]any{"i": 2.0, "num": gojson.Number("3"), "ios": gojson.Number("4"), "list": []any{int(5), float64(6), gojson.Number("7")}},
+			expected: map[string]any{"i": int64(2), "num": int64(3), "ios": int64(4), "list": []any{int64(5), int64(6), int64(7)}},
+		},
+		{
+			name:            "numbers that are not integers are dropped",
+			object:          map[string]any{"i": 2.5, "list": []any{int64(1), 1.5, gojson.Number("2.5")}},
+			expected:        map[string]any{"list": []any{int64(1)}},
+			expectedDropped: []string{"i", "list[1]", "list[2]"},
+		},
+		{
+			name:            "numbers that overflow int64 are dropped",
+			object:          map[string]any{"i": 9.223372036854775807e18, "list": []any{-9.223372036854775808e18, gojson.Number("9223372036854775808")}},
+			expected:        map[string]any{"list": []any{int64(math.MinInt64)}},
+			expectedDropped: []string{"i", "list[1]"},
+		},
+		{
+			name:            "nulls of fields that are not nullable are dropped",
+			object:          map[string]any{"nullable": nil, "notNullable": nil},
+			expected:        map[string]any{"nullable": nil},
+			expectedDropped: []string{"notNullable"},
+		},
+		{
+			name:            "values of the wrong format are dropped",
+			object:          map[string]any{"dateTime": "yesterday", "duration": "forever", "quantity": "lots"},
+			expected:        map[string]any{},
+			expectedDropped: []string{"dateTime", "duration", "quantity"},
+		},
+		{
+			name:            "list map entries missing keys are dropped",
+			object:          map[string]any{"listMap": []any{map[string]any{"k": "a"}, map[string]any{}, "b"}},
+			expected:        map[string]any{"listMap": []any{map[string]any{"k": "a"}}},
+			expectedDropped: []string{"listMap[1]", "listMap[2]"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			projected, report, err := projectForConversion(tc.object, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dropped []string
+			for _, d := range report.Dropped {
+				dropped = append(dropped, d.Path)
+			}
+			if !reflect.DeepEqual(tc.expected, projected) {
+				t.Errorf("expected %v but got %v", tc.expected, projected)
+			}
+			if !reflect.DeepEqual(tc.expectedDropped, dropped) {
+				t.Errorf("expected dropped paths %v but got %v", tc.expectedDropped, dropped)
+			}
+		})
+	}
+}
+
+func BenchmarkMutateBasicMerge(b *testing.B) {
+	schema, original, patch := loadBenchmarkCase("basicmerge", "basic")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MutateBasicMerge(&schema, original, patch, WithEstimatedCostLimit(0)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompiledMutateBasicMerge(b *testing.B) {
+	schema, original, patch := loadBenchmarkCase("basicmerge", "basic")
+	compiled, err := CompileMutateBasicMerge(&schema, patch, WithEstimatedCostLimit(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := compiled.Apply(original); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompiledMutateApply(b *testing.B) {
+	schema, original, patch := loadBenchmarkCase("apply", "unsettingfields")
+	compiled, err := CompileMutateApply(&schema, patch, WithEstimatedCostLimit(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := compiled.Apply(runtime.DeepCopyJSONValue(original)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	b.Run("object", func(b *testing.B) {
+		schema, original, applyConfiguration := loadMergeBenchmarkCase()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := Merge(&schema, original, applyConfiguration, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("nested objects.apply()", func(b *testing.B) {
+		schema, original, patch := loadBenchmarkCase("apply", "nestedapply")
+		compiled, err := CompileMutateApply(&schema, patch, WithEstimatedCostLimit(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := compiled.Apply(runtime.DeepCopyJSONValue(original)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("nested objects.apply() with an OpenAPI schema", func(b *testing.B) {
+		schema, original, _ := loadBenchmarkCase("apply", "nestedapply")
+		s := &openapi.Schema{Schema: &schema}
+		env, err := newEnv(s, s, false, WithEstimatedCostLimit(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		compiled, err := env.compileExpression("objects.apply(oldObject, Object{spec: Object.spec{widgets: oldObject.spec.widgets.map(w, objects.apply(w, Object.spec.widgets.item{part: 'xyz'}))}})", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := compiled.eval(runtime.DeepCopyJSONValue(original), nil, newCostBudget(RuntimeCostBudget)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMergeCachesMerger(t *testing.T) {
+	schema, original, applyConfiguration := loadMergeBenchmarkCase()
+	if _, err := Merge(&schema, original, applyConfiguration, false); err != nil {
+		t.Fatal(err)
+	}
+	key := mergerKey{schema: &schema}
+	cached, ok := mergers.Load(key)
+	if !ok {
+		t.Fatal("expected the merger of the schema to be cached")
+	}
+	if _, err := Merge(&schema, original, applyConfiguration, false); err != nil {
+		t.Fatal(err)
+	}
+	if reused, _ := mergers.Load(key); reused != cached {
+		t.Error("expected the cached merger to be reused")
+	}
+}
+
+func BenchmarkMerger(b *testing.B) {
+	schema, original, applyConfiguration := loadMergeBenchmarkCase()
+	merger, err := NewMerger(&schema, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := merger.Merge(original, applyConfiguration); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func loadMergeBenchmarkCase() (spec.Schema, any, any) {
+	schema := loadTestSchema()
+	original := loadTestYaml[any](filepath.Join(testdata, "basicmerge", "mutate", "basic", "original.yaml"))
+	applyConfiguration := map[string]any{
+		"spec": map[string]any{
+			"deploymentName": "alpha-deployment",
+			"list":           []any{"a"},
+			"listMap":        []any{map[string]any{"key": "k2", "value": "200"}},
+		},
+	}
+	return schema, original, applyConfiguration
+}
+
+func loadBenchmarkCase(dir, testCase string) (spec.Schema, any, any) {
+	schema := loadTestSchema()
+	testDir := filepath.Join(testdata, dir, "mutate", testCase)
+	original := loadTestYaml[any](filepath.Join(testDir, "original.yaml"))
+	patch := loadTestYaml[any](filepath.Join(testDir, "patch.yaml"))
+	return schema, original, patch
+}
+
+type mutateFn func(schema *spec.Schema, obj any, patch any, opts ...CompileOption) (any, error)
 
 func testMutate(t *testing.T, dir string, mutator mutateFn) {
-	testdata := "../../testdata"
-	schema := loadTestYaml[spec.Schema](filepath.Join(testdata, "v1schema.yaml"))
+	schema := loadTestSchema()
 
 	testDir := filepath.Join(testdata, dir, "mutate")
 	entries, err := os.ReadDir(testDir)
@@ -74,7 +897,11 @@ func testMutate(t *testing.T, dir string, mutator mutateFn) {
 				patch := loadTestYaml[any](filepath.Join(testDir, testCase, "patch.yaml"))
 				expected := loadTestYaml[any](filepath.Join(testDir, testCase, "expected.yaml"))
 
-				merged := mutator(&schema, original, patch)
+				// The lists and strings of the fixture schemas are not bounded.
+				merged, err := mutator(&schema, original, patch, WithEstimatedCostLimit(0))
+				if err != nil {
+					t.Fatal(err)
+				}
 
 				if !reflect.DeepEqual(expected, merged) {
 					t.Errorf("Expected:\n%s\nBut got:\n%s\n", yamlToString(expected), yamlToString(merged))
@@ -84,14 +911,11 @@ func testMutate(t *testing.T, dir string, mutator mutateFn) {
 	}
 }
 
-type convertFn func(fromVersionSchema, toVersionSchema *spec.Schema, toVersionStructuralSchema *schema2.Structural, fromObject, patch any) any
+type convertFn func(fromVersionSchema, toVersionSchema *spec.Schema, fromObject, patch any, opts ...CompileOption) (any, *ConversionReport, error)
 
 func testConvert(t *testing.T, dir string, converter convertFn) {
-	testdata := "../../testdata"
-	v1schema := loadTestYaml[spec.Schema](filepath.Join(testdata, "v1schema.yaml"))
-	v1Structural := loadStructural(filepath.Join(testdata, "v1schema.yaml"))
+	v1schema := loadTestSchema()
 	v2schema := loadTestYaml[spec.Schema](filepath.Join(testdata, "v2schema.yaml"))
-	v2Structural := loadStructural(filepath.Join(testdata, "v2schema.yaml"))
 
 	testDir := filepath.Join(testdata, dir, "convert")
 	entries, err := os.ReadDir(testDir)
@@ -107,13 +931,20 @@ func testConvert(t *testing.T, dir string, converter convertFn) {
 				reversePatch := loadTestYaml[any](filepath.Join(testDir, testCase, "v2tov1.yaml"))
 				expected := loadTestYaml[any](filepath.Join(testDir, testCase, "expected.yaml"))
 
-				merged := converter(&v1schema, &v2schema, v2Structural, original, patch)
+				// The lists and strings of the fixture schemas are not bounded.
+				merged, _, err := converter(&v1schema, &v2schema, original, patch, WithEstimatedCostLimit(0))
+				if err != nil {
+					t.Fatal(err)
+				}
 
 				if !reflect.DeepEqual(expected, merged) {
 					t.Errorf("Expected:\n%s\nBut got:\n%s\n", yamlToString(expected), yamlToString(merged))
 				}
 
-				merged = converter(&v2schema, &v1schema, v1Structural, expected, reversePatch)
+				merged, _, err = converter(&v2schema, &v1schema, expected, reversePatch, WithEstimatedCostLimit(0))
+				if err != nil {
+					t.Fatal(err)
+				}
 
 				if !reflect.DeepEqual(original, merged) {
 					t.Errorf("Expected:\n%s\nBut got:\n%s\n", yamlToString(original), yamlToString(merged))
@@ -131,6 +962,14 @@ func yamlToString(obj any) string {
 	return string(out)
 }
 
+// testdata is the directory of the fixtures shared with the other packages.
+const testdata = "../../testdata"
+
+// loadTestSchema returns the v1 schema of the fixtures.
+func loadTestSchema() spec.Schema {
+	return loadTestYaml[spec.Schema](filepath.Join(testdata, "v1schema.yaml"))
+}
+
 func loadTestYaml[T any](file string) T {
 	var original T
 	bytes, err := os.ReadFile(file)
@@ -148,17 +987,16 @@ func loadTestYaml[T any](file string) T {
 	return original
 }
 
-func loadStructural(file string) *schema2.Structural {
-	v2props := loadTestYaml[v1.JSONSchemaProps](file)
-
-	var out apiextensions.JSONSchemaProps
-	err := v1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(&v2props, &out, nil)
+// yamlValue returns the unstructured value of the YAML.
+func yamlValue(t *testing.T, s string) any {
+	t.Helper()
+	j, err := yaml.YAMLToJSON([]byte(s))
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	structural, err := schema2.NewStructural(&out)
-	if err != nil {
-		panic(err)
+	var v any
+	if err := json.Unmarshal(j, &v); err != nil {
+		t.Fatal(err)
 	}
-	return structural
+	return v
 }
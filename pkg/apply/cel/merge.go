@@ -17,8 +17,12 @@ limitations under the License.
 package cel
 
 import (
+	"errors"
+
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/operators"
+	celtypes "github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 
@@ -27,6 +31,9 @@ import (
 
 type Merger interface {
 	Merge(obj, patch, removals ref.Val) ref.Val
+	// MergeField is Merge for an obj that is the field of parent. It allows values that do not
+	// carry their schema, such as lists, to be merged using the schema of the field.
+	MergeField(parent ref.Val, field string, obj, patch, removals ref.Val) ref.Val
 }
 
 func Objects(merger Merger) cel.EnvOption {
@@ -36,6 +43,16 @@ func Objects(merger Merger) cel.EnvOption {
 const (
 	objectsNamespace = "objects"
 	applyMacro       = "apply"
+	removeMacro      = "remove"
+	removeFunction   = "apply_remove"
+
+	// applyParentVar and applyConfigVar are the variables that objects.apply() binds the parent of
+	// its target and its apply configuration to, so that each is evaluated only once.
+	applyParentVar = "__apply_parent__"
+	applyConfigVar = "__apply_config__"
+	// unusedIterVar is the iteration variable of the comprehensions that bind variables, which
+	// iterate over an empty list.
+	unusedIterVar = "#unused"
 )
 
 type celObjects struct {
@@ -58,13 +75,24 @@ func (c celObjects) CompileOptions() []cel.EnvOption {
 		types.ApplyTypes(),
 		cel.Macros(
 			cel.NewReceiverMacro(applyMacro, 2, celApply),
+			cel.NewReceiverMacro(removeMacro, 1, celRemove),
 		),
 		cel.Function("apply_filter",
 			cel.Overload("apply_filter_object_object", []*cel.Type{paramTypeV, arrayStructType}, paramTypeV,
 				cel.BinaryBinding(func(lhs ref.Val, rhs ref.Val) ref.Val {
 					apply := rhs.(*types.ApplyStruct)
+					if field, ok := apply.GetField().(celtypes.String); ok {
+						return c.merger.MergeField(apply.GetParent(), string(field), lhs, apply.GetObject(), apply.GetRemovals())
+					}
 					return c.merger.Merge(lhs, apply.GetObject(), apply.GetRemovals())
 				}))),
+		// objects.remove() evaluates to its argument. It only marks the argument for removal when
+		// it appears in a list literal of an objects.apply() apply configuration.
+		cel.Function(removeFunction,
+			cel.Overload("apply_remove_object", []*cel.Type{paramTypeV}, paramTypeV,
+				cel.UnaryBinding(func(arg ref.Val) ref.Val {
+					return arg
+				}))),
 	}
 }
 
@@ -91,50 +119,119 @@ func celApply(meh cel.MacroExprHelper, target *exprpb.Expr, args []*exprpb.Expr)
 	object := args[0]
 	varApplyConfig := args[1]
 	switch varApplyConfig.GetExprKind().(type) {
-	case *exprpb.Expr_StructExpr:
-		removals := findRemovals(meh, varApplyConfig, "")
-
-		return meh.GlobalCall("apply_filter",
-			object,
-			meh.NewObject("applystruct",
-				meh.NewObjectFieldInit("object", varApplyConfig, false),
-				meh.NewObjectFieldInit("removals", meh.NewList(removals...), false))), nil
+	case *exprpb.Expr_StructExpr, *exprpb.Expr_ListExpr:
+		// The removal paths refer to the list entries of the evaluated apply configuration, so
+		// that the entries are not evaluated again.
+		removals := findRemovals(meh, varApplyConfig, meh.Ident(applyConfigVar), nil)
+		fields := []*exprpb.Expr_CreateStruct_Entry{
+			meh.NewObjectFieldInit("object", meh.Ident(applyConfigVar), false),
+			meh.NewObjectFieldInit("removals", meh.NewList(removals...), false),
+		}
+		// The schema of a field is found from its parent, since values such as lists do not
+		// carry their schema.
+		sel := object.GetSelectExpr()
+		if sel == nil || sel.GetTestOnly() {
+			return bind(meh, applyConfigVar, varApplyConfig,
+				meh.GlobalCall("apply_filter", object, meh.NewObject("applystruct", fields...))), nil
+		}
+		fields = append(fields,
+			meh.NewObjectFieldInit("parent", meh.Ident(applyParentVar), false),
+			meh.NewObjectFieldInit("field", meh.LiteralString(sel.GetField()), false))
+		object = meh.Select(meh.Ident(applyParentVar), sel.GetField())
+		return bind(meh, applyParentVar, sel.GetOperand(),
+			bind(meh, applyConfigVar, varApplyConfig,
+				meh.GlobalCall("apply_filter", object, meh.NewObject("applystruct", fields...)))), nil
 	default:
 		return nil, &common.Error{
-			Message:  "objects.apply()'s second argument must be an object creation expression",
+			Message:  "objects.apply()'s second argument must be an object, map or list creation expression",
 			Location: meh.OffsetLocation(varApplyConfig.GetId()),
 		}
 	}
 }
 
-// TODO: eliminate string concat with pathPrefix
-func findRemovals(meh cel.MacroExprHelper, literal *exprpb.Expr, pathPrefix string) []*exprpb.Expr {
+// bind returns an expression that evaluates init once, binds its value to the variable name, and
+// evaluates to result, as cel.bind() does.
+func bind(meh cel.MacroExprHelper, name string, init, result *exprpb.Expr) *exprpb.Expr {
+	return meh.Fold(unusedIterVar, meh.NewList(), name, init, meh.LiteralBool(false), meh.Ident(name), result)
+}
+
+func celRemove(meh cel.MacroExprHelper, target *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+	if !macroTargetMatchesNamespace(objectsNamespace, target) {
+		return nil, nil
+	}
+	return meh.GlobalCall(removeFunction, args[0]), nil
+}
+
+// findRemovals returns the paths of all fields, map entries and list entries that the apply
+// configuration literal removes. Each path is a list where each element is either a field name
+// or map key, or the list entry itself. The merger identifies list entries using the
+// x-kubernetes-list-map-keys of the list. value is an expression that accesses the value of the
+// literal in the evaluated apply configuration, which list entries are taken from.
+//
+// Fields and map entries are removed with `?name: optional.none()`. listType=map entries are
+// removed with `objects.remove(<entry>)`.
+func findRemovals(meh cel.MacroExprHelper, literal, value *exprpb.Expr, pathPrefix []*exprpb.Expr) []*exprpb.Expr {
 	var removals []*exprpb.Expr
 	switch literal.GetExprKind().(type) {
 	case *exprpb.Expr_StructExpr:
 		st := literal.GetStructExpr() // map or object
 		for _, e := range st.Entries {
+			key, ok := getPathKey(e)
+			if !ok {
+				continue
+			}
+			path := appendPath(pathPrefix, meh.LiteralString(key))
 			if e.OptionalEntry {
 				switch e.Value.GetExprKind().(type) {
 				case *exprpb.Expr_CallExpr:
 					if e.Value.GetCallExpr().GetFunction() == "none" { // TODO: check target is "optional" as well
-						if key, ok := getPathKey(e); ok {
-							removals = append(removals, meh.LiteralString(pathPrefix+key))
-						}
+						removals = append(removals, newRemovalPath(meh, path))
 					}
 				}
+				// Optional entries may be absent from the evaluated apply configuration, and their
+				// values are never literals.
+				continue
 			}
-			if key, ok := getPathKey(e); ok {
-				removals = append(removals, findRemovals(meh, e.Value, pathPrefix+key+".")...)
+			var entryValue *exprpb.Expr
+			if len(st.GetMessageName()) > 0 {
+				entryValue = meh.Select(meh.Copy(value), key)
+			} else {
+				entryValue = meh.GlobalCall(operators.Index, meh.Copy(value), meh.LiteralString(key))
 			}
+			removals = append(removals, findRemovals(meh, e.Value, entryValue, path)...)
 		}
 	case *exprpb.Expr_ListExpr:
-		// TODO: Support removals from listType=maps. Must identify the removal using the key fields.
+		for i, el := range literal.GetListExpr().GetElements() {
+			// objects.remove() evaluates to its argument, so the entry is also in the evaluated
+			// apply configuration.
+			entry := meh.GlobalCall(operators.Index, meh.Copy(value), meh.LiteralInt(int64(i)))
+			if call := el.GetCallExpr(); call != nil && call.GetFunction() == removeFunction && len(call.GetArgs()) == 1 {
+				removals = append(removals, newRemovalPath(meh, appendPath(pathPrefix, entry)))
+				continue
+			}
+			removals = append(removals, findRemovals(meh, el, entry, appendPath(pathPrefix, entry))...)
+		}
 	}
 
 	return removals
 }
 
+func appendPath(path []*exprpb.Expr, element *exprpb.Expr) []*exprpb.Expr {
+	result := make([]*exprpb.Expr, len(path), len(path)+1)
+	copy(result, path)
+	return append(result, element)
+}
+
+// newRemovalPath returns a list literal of the path. Elements are copied so that each removal path
+// has distinct expression IDs, and are converted to dyn since paths mix field names and list entries.
+func newRemovalPath(meh cel.MacroExprHelper, path []*exprpb.Expr) *exprpb.Expr {
+	elements := make([]*exprpb.Expr, len(path))
+	for i, e := range path {
+		elements[i] = meh.GlobalCall("dyn", meh.Copy(e))
+	}
+	return meh.NewList(elements...)
+}
+
 func getPathKey(e *exprpb.Expr_CreateStruct_Entry) (string, bool) {
 	switch e.GetKeyKind().(type) {
 	case *exprpb.Expr_CreateStruct_Entry_FieldKey:
@@ -150,3 +247,69 @@ func getPathKey(e *exprpb.Expr_CreateStruct_Entry) (string, bool) {
 	}
 	return "", false
 }
+
+// CheckRemovals returns an error if the parsed or checked expression uses objects.remove()
+// anywhere other than as an item of a list literal in the apply configuration literal of an
+// objects.apply(). objects.remove() has no effect anywhere else.
+func CheckRemovals(expr *exprpb.Expr) error {
+	if !checkRemovals(expr, false) {
+		return errors.New("objects.remove() may only be used as an item of a list literal in the apply configuration of objects.apply()")
+	}
+	return nil
+}
+
+// checkRemovals returns false if e contains a misplaced objects.remove(). inApplyConfig is true if
+// e is part of an apply configuration literal, where the items of list literals may be removals.
+func checkRemovals(e *exprpb.Expr, inApplyConfig bool) bool {
+	switch k := e.GetExprKind().(type) {
+	case *exprpb.Expr_CallExpr:
+		call := k.CallExpr
+		if call.GetFunction() == removeFunction {
+			return false
+		}
+		if call.GetTarget() != nil && !checkRemovals(call.GetTarget(), false) {
+			return false
+		}
+		for _, arg := range call.GetArgs() {
+			if !checkRemovals(arg, false) {
+				return false
+			}
+		}
+	case *exprpb.Expr_SelectExpr:
+		return checkRemovals(k.SelectExpr.GetOperand(), false)
+	case *exprpb.Expr_ListExpr:
+		for _, el := range k.ListExpr.GetElements() {
+			if call := el.GetCallExpr(); inApplyConfig && call != nil && call.GetFunction() == removeFunction && len(call.GetArgs()) == 1 {
+				// The removed entry only identifies the entry by its map keys.
+				if !checkRemovals(call.GetArgs()[0], false) {
+					return false
+				}
+				continue
+			}
+			if !checkRemovals(el, inApplyConfig) {
+				return false
+			}
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			if entry.GetMapKey() != nil && !checkRemovals(entry.GetMapKey(), false) {
+				return false
+			}
+			if !checkRemovals(entry.GetValue(), inApplyConfig) {
+				return false
+			}
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		c := k.ComprehensionExpr
+		if c.GetAccuVar() == applyConfigVar {
+			// objects.apply() binds its apply configuration to applyConfigVar.
+			return checkRemovals(c.GetAccuInit(), true) && checkRemovals(c.GetResult(), false)
+		}
+		for _, sub := range []*exprpb.Expr{c.GetIterRange(), c.GetAccuInit(), c.GetLoopCondition(), c.GetLoopStep(), c.GetResult()} {
+			if !checkRemovals(sub, false) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -37,6 +37,10 @@ var (
 type ApplyStruct struct {
 	object   ref.Val
 	removals ref.Val
+	// parent and field are set if the value that the object is applied to is the field of
+	// parent, and are nil otherwise.
+	parent ref.Val
+	field  ref.Val
 }
 
 func (o *ApplyStruct) GetObject() ref.Val {
@@ -47,6 +51,16 @@ func (o *ApplyStruct) GetRemovals() ref.Val {
 	return o.removals
 }
 
+// GetParent returns the object that the value the object is applied to is a field of, or nil.
+func (o *ApplyStruct) GetParent() ref.Val {
+	return o.parent
+}
+
+// GetField returns the name of the field of the parent that the object is applied to, or nil.
+func (o *ApplyStruct) GetField() ref.Val {
+	return o.field
+}
+
 // ConvertToNative implements the ref.Val interface method.
 func (o *ApplyStruct) ConvertToNative(typeDesc reflect.Type) (any, error) {
 	return o.object.ConvertToNative(typeDesc)
@@ -146,9 +160,24 @@ func (tp *applyTypeProvider) FindFieldType(typeName, fieldName string) (*ref.Fie
 				},
 			}, true
 		}
+		if fieldName == "parent" || fieldName == "field" {
+			t := decls.Dyn
+			if fieldName == "field" {
+				t = decls.String
+			}
+			return &ref.FieldType{
+				Type: t,
+				IsSet: func(obj any) bool {
+					return true // TODO
+				},
+				GetFrom: func(obj any) (any, error) {
+					return nil, nil // TODO
+				},
+			}, true
+		}
 		if fieldName == "removals" {
 			return &ref.FieldType{
-				Type: decls.NewListType(decls.String),
+				Type: decls.NewListType(decls.NewListType(decls.Dyn)),
 				IsSet: func(obj any) bool {
 					return true // TODO
 				},
@@ -166,7 +195,7 @@ func (tp *applyTypeProvider) NewValue(typeName string, fields map[string]ref.Val
 	if typeName != ApplyStructType.TypeName() {
 		return tp.baseProvider.NewValue(typeName, fields)
 	}
-	return &ApplyStruct{fields["object"], fields["removals"]}
+	return &ApplyStruct{object: fields["object"], removals: fields["removals"], parent: fields["parent"], field: fields["field"]}
 }
 
 func (tp *applyTypeProvider) NativeToValue(val any) ref.Val {
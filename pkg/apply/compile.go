@@ -0,0 +1,858 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	apiservercel "k8s.io/apiserver/pkg/cel"
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	cel2 "jpbetz.github.com/celpatch/pkg/apply/cel"
+)
+
+// CompiledMutation is a mutation that has been compiled against a schema. It may be applied
+// to any number of objects of that schema, and is safe for concurrent use.
+type CompiledMutation struct {
+	schema *schemaNode
+	merger *Merger
+	// Exactly one of expression and template is set.
+	expression *compiledExpression
+	template   any
+	// costBudget is the runtime cost budget for applying the mutation to an object.
+	costBudget uint64
+	// mergeResult is true if evaluation produces an apply configuration that must be merged into
+	// the object, and false if evaluation produces the mutated object directly (objects.apply()).
+	mergeResult bool
+	// fieldManager, if set, is the field manager that merges the apply configuration.
+	fieldManager string
+	// forceConflicts is true if the field manager overrides fields owned by other managers.
+	forceConflicts bool
+	// matchConditions gate whether the mutation is applied, or are nil if it always is.
+	matchConditions *matchConditions
+}
+
+// CompileMutateBasicMerge compiles a patch of the form `mutation: <expression>` where the expression
+// evaluates to an apply configuration that is merged into the object.
+func CompileMutateBasicMerge(schema *spec.Schema, patch any, opts ...CompileOption) (*CompiledMutation, error) {
+	expression, err := mutationExpression(patch)
+	if err != nil {
+		return nil, err
+	}
+	return compileMutation(schema, expression, true, opts)
+}
+
+// CompileMutateApply compiles a patch of the form `mutation: <expression>` where the expression
+// is applied to the object using objects.apply().
+func CompileMutateApply(schema *spec.Schema, patch any, opts ...CompileOption) (*CompiledMutation, error) {
+	expression, err := mutationExpression(patch)
+	if err != nil {
+		return nil, err
+	}
+	// TODO: replace with AST modification?
+	expression = "objects.apply(oldObject, " + expression + "\n)" // newline to guard against trailing comment
+	return compileMutation(schema, expression, false, opts)
+}
+
+// CompileMutateWithTemplate compiles a patch containing `{$: "<CEL expression>"}` directives.
+func CompileMutateWithTemplate(schema *spec.Schema, patch any, opts ...CompileOption) (*CompiledMutation, error) {
+	s := newSchemaNode(schema)
+	env, err := newEnv(s, s, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	template, err := env.compileTemplate(patch)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMerger(schema, false)
+	if err != nil {
+		return nil, err
+	}
+	o := newCompileOptions(opts)
+	return &CompiledMutation{
+		schema:          s,
+		merger:          m,
+		template:        template,
+		mergeResult:     true,
+		costBudget:      RuntimeCostBudget,
+		fieldManager:    o.fieldManager,
+		forceConflicts:  o.force,
+		matchConditions: env.matchConditions,
+	}, nil
+}
+
+func compileMutation(schema *spec.Schema, expression string, mergeResult bool, opts []CompileOption) (*CompiledMutation, error) {
+	s := newSchemaNode(schema)
+	env, err := newEnv(s, s, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := env.compileExpression(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMerger(schema, false)
+	if err != nil {
+		return nil, err
+	}
+	o := newCompileOptions(opts)
+	return &CompiledMutation{
+		schema:          s,
+		merger:          m,
+		expression:      compiled,
+		mergeResult:     mergeResult,
+		costBudget:      RuntimeCostBudget,
+		fieldManager:    o.fieldManager,
+		forceConflicts:  o.force,
+		matchConditions: env.matchConditions,
+	}, nil
+}
+
+// Apply returns the result of mutating obj. If the match conditions of the mutation are not all
+// true, obj is returned unchanged.
+func (c *CompiledMutation) Apply(obj any) (any, error) {
+	return c.ApplyWithRequest(obj, nil)
+}
+
+// ApplyWithRequest returns the result of mutating obj, with request, an unstructured value such as
+// the attributes of an admission request, as the request variable of the match conditions.
+func (c *CompiledMutation) ApplyWithRequest(obj, request any) (any, error) {
+	result, _, err := c.apply(obj, request)
+	return result, err
+}
+
+// apply returns the result of mutating obj, and whether the match conditions were all true.
+func (c *CompiledMutation) apply(obj, request any) (any, bool, error) {
+	budget := newCostBudget(c.costBudget)
+	matched, err := c.matchConditions.matches(obj, nil, request, budget)
+	if err != nil {
+		return nil, false, err
+	}
+	if !matched {
+		return obj, false, nil
+	}
+	result, err := c.mutate(obj, budget)
+	return result, true, err
+}
+
+// mutate evaluates the expression or template of the mutation and merges the result into obj.
+func (c *CompiledMutation) mutate(obj any, budget *costBudget) (any, error) {
+	var result any
+	var err error
+	if c.expression == nil {
+		a := &applier{oldObject: obj, budget: budget}
+		result, err = a.applyTemplate(c.schema, c.schema, c.template, obj, nil, nil)
+	} else {
+		result, err = c.expression.eval(obj, nil, budget)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.mergeResult {
+		return result, nil
+	}
+	if len(c.fieldManager) > 0 {
+		return c.merger.ApplyAsManager(obj, result, c.fieldManager, c.forceConflicts)
+	}
+	return c.merger.Merge(obj, result)
+}
+
+// Schema returns the schema of the objects that the mutation was compiled for.
+func (c *CompiledMutation) Schema() *spec.Schema {
+	return c.schema.Schema.Schema
+}
+
+// EstimatedCost returns the estimated worst case cost of evaluating all the expressions of the
+// mutation.
+func (c *CompiledMutation) EstimatedCost() uint64 {
+	return addCost(c.matchConditions.estimatedCost(), estimatedCost(c.expression, c.template))
+}
+
+// CompiledConversion is a version conversion that has been compiled against a pair of schemas.
+// It may be applied to any number of objects of the from version, and is safe for concurrent use.
+type CompiledConversion struct {
+	fromVersionSchema *schemaNode
+	toVersionSchema   *schemaNode
+	// projection projects objects of the from version onto the fields that are compatible with
+	// the to version.
+	projection *projection
+	merger     *Merger
+	// Exactly one of expression and template is set.
+	expression *compiledExpression
+	template   any
+	// costBudget is the runtime cost budget for converting an object.
+	costBudget uint64
+	// mergeResult is true if evaluation produces an apply configuration that must be merged into
+	// the projected object, and false if evaluation produces the converted object directly (objects.apply()).
+	mergeResult bool
+	// matchConditions gate whether the expression or template is applied, or are nil if it
+	// always is.
+	matchConditions *matchConditions
+}
+
+// CompileConvertBasicMerge compiles a patch of the form `mutation: <expression>` where the expression
+// evaluates to an apply configuration that is merged into the projected object.
+func CompileConvertBasicMerge(fromVersionSchema, toVersionSchema *spec.Schema, patch any, opts ...CompileOption) (*CompiledConversion, error) {
+	expression, err := mutationExpression(patch)
+	if err != nil {
+		return nil, err
+	}
+	return compileConversion(fromVersionSchema, toVersionSchema, expression, true, opts)
+}
+
+// CompileConvertApply compiles a patch of the form `mutation: <expression>` where the expression
+// is applied to the projected object using objects.apply().
+func CompileConvertApply(fromVersionSchema, toVersionSchema *spec.Schema, patch any, opts ...CompileOption) (*CompiledConversion, error) {
+	expression, err := mutationExpression(patch)
+	if err != nil {
+		return nil, err
+	}
+	expression = "objects.apply(convertedObject, " + expression + "\n)" // newline to guard against trailing comment
+	return compileConversion(fromVersionSchema, toVersionSchema, expression, false, opts)
+}
+
+// CompileConvertWithTemplate compiles a patch containing `{$: "<CEL expression>"}` directives.
+func CompileConvertWithTemplate(fromVersionSchema, toVersionSchema *spec.Schema, patch any, opts ...CompileOption) (*CompiledConversion, error) {
+	oldSchema := newSchemaNode(fromVersionSchema)
+	newSchema := newSchemaNode(toVersionSchema)
+	env, err := newEnv(oldSchema, newSchema, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	template, err := env.compileTemplate(patch)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := conversionProjection(fromVersionSchema, toVersionSchema)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMerger(toVersionSchema, true)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledConversion{
+		fromVersionSchema: oldSchema,
+		toVersionSchema:   newSchema,
+		projection:        projection,
+		merger:            m,
+		template:          template,
+		mergeResult:       true,
+		costBudget:        RuntimeCostBudget,
+		matchConditions:   env.matchConditions,
+	}, nil
+}
+
+func compileConversion(fromVersionSchema, toVersionSchema *spec.Schema, expression string, mergeResult bool, opts []CompileOption) (*CompiledConversion, error) {
+	oldSchema := newSchemaNode(fromVersionSchema)
+	newSchema := newSchemaNode(toVersionSchema)
+	env, err := newEnv(oldSchema, newSchema, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := env.compileExpression(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := conversionProjection(fromVersionSchema, toVersionSchema)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMerger(toVersionSchema, true)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledConversion{
+		fromVersionSchema: oldSchema,
+		toVersionSchema:   newSchema,
+		projection:        projection,
+		merger:            m,
+		expression:        compiled,
+		mergeResult:       mergeResult,
+		costBudget:        RuntimeCostBudget,
+		matchConditions:   env.matchConditions,
+	}, nil
+}
+
+// Apply returns the result of converting fromObject to the to version.
+func (c *CompiledConversion) Apply(fromObject any) (any, error) {
+	result, _, err := c.ApplyWithReport(fromObject)
+	return result, err
+}
+
+// ApplyWithReport returns the result of converting fromObject to the to version, and a report of
+// the values of fromObject that were not carried over to the to version.
+func (c *CompiledConversion) ApplyWithReport(fromObject any) (any, *ConversionReport, error) {
+	return c.ApplyWithRequest(fromObject, nil)
+}
+
+// ApplyWithRequest is ApplyWithReport with request, the unstructured attributes of an admission
+// request, as the request variable of the match conditions.
+func (c *CompiledConversion) ApplyWithRequest(fromObject, request any) (any, *ConversionReport, error) {
+	// Conversion Flow:
+	// 1. Start converting the v1 object to v2 by projecting it onto the fields that are compatible
+	//    with v2, dropping: (a) any fields not in v2, (b) any fields with incompatible types or
+	//    list types (c) any listType=map entries with missing keys.
+	projected, report, err := projectForConversion(fromObject, c.projection)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 2. Skip the expression or template unless the match conditions are all true.
+	budget := newCostBudget(c.costBudget)
+	matched, err := c.matchConditions.matches(fromObject, projected, request, budget)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !matched {
+		return projected, report, nil
+	}
+	// 3. Build the apply configuration, or in the case of objects.apply(), the converted object.
+	var result any
+	if c.expression == nil {
+		a := &applier{oldObject: fromObject, convertedObject: projected, budget: budget}
+		result, err = a.applyTemplate(c.toVersionSchema, c.fromVersionSchema, c.template, fromObject, projected, nil)
+	} else {
+		result, err = c.expression.eval(fromObject, projected, budget)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.mergeResult {
+		return result, report, nil
+	}
+	// 4. Merge the apply configuration with the projected object
+	result, err = c.merger.Merge(projected, result)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, report, nil
+}
+
+// EstimatedCost returns the estimated worst case cost of evaluating all the expressions of the
+// conversion.
+func (c *CompiledConversion) EstimatedCost() uint64 {
+	return addCost(c.matchConditions.estimatedCost(), estimatedCost(c.expression, c.template))
+}
+
+// estimatedCost returns the sum of the estimated costs of the expression, or of all the
+// expressions in the compiled template.
+func estimatedCost(expression *compiledExpression, template any) uint64 {
+	if expression != nil {
+		return expression.estimatedCost
+	}
+	switch t := template.(type) {
+	case *compiledExpression:
+		return t.estimatedCost
+	case map[string]any:
+		var sum uint64
+		for _, v := range t {
+			sum = addCost(sum, estimatedCost(nil, v))
+		}
+		return sum
+	case []any:
+		var sum uint64
+		for _, v := range t {
+			sum = addCost(sum, estimatedCost(nil, v))
+		}
+		return sum
+	default:
+		return 0
+	}
+}
+
+// addCost adds costs, saturating at the maximum uint64 value.
+func addCost(a, b uint64) uint64 {
+	if a+b < a {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// compileEnv is the environment that the expressions of a mutation or conversion are compiled in.
+type compileEnv struct {
+	env             *cel.Env
+	oldObjectSchema common.Schema
+	patchSchema     common.Schema
+	// oldObjectDecl and patchDecl are the declared types of oldObjectSchema and patchSchema.
+	oldObjectDecl *common.DeclType
+	patchDecl     *common.DeclType
+	isConversion  bool
+	// paramsDecl and params are the declared type and value of the params variable, or nil if
+	// there are no params.
+	paramsDecl *common.DeclType
+	params     ref.Val
+	// requestDecl is the declared type of the request variable of match conditions, or nil if
+	// there are no match conditions.
+	requestDecl *common.DeclType
+	// matchConditions are the compiled match conditions, or nil if there are none.
+	matchConditions *matchConditions
+	// estimatedCostLimit is the maximum estimated cost of an expression, or 0 if it is unlimited.
+	estimatedCostLimit uint64
+}
+
+// newEnv returns the environment that mutation and conversion expressions are compiled in.
+func newEnv(oldObjectSchema, patchSchema common.Schema, isConversion bool, opts ...CompileOption) (*compileEnv, error) {
+	baseEnv, err := buildBaseEnv(&celMerger{})
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, "", nil, err)
+	}
+	o := newCompileOptions(opts)
+	paramsDecl, params, err := o.paramsVal()
+	if err != nil {
+		return nil, err
+	}
+	declTypes := []*common.DeclType{}
+	if paramsDecl != nil {
+		declTypes = append(declTypes, paramsDecl)
+	}
+	var requestDecl *common.DeclType
+	if len(o.matchConditions) > 0 {
+		requestDecl = newRequestDecl()
+		declTypes = append(declTypes, requestDecl)
+	}
+
+	var rt *common.OpenAPITypeProvider
+	var patchDecl, oldObjectDecl *common.DeclType
+	if isConversion {
+		patchDecl = common.SchemaDeclType(patchSchema, true).MaybeAssignTypeName(objectTypeName)
+		oldObjectDecl = common.SchemaDeclType(oldObjectSchema, true).MaybeAssignTypeName(oldObjectTypeName)
+		rt, err = common.NewOpenAPITypeProvider(append(declTypes, patchDecl, oldObjectDecl)...)
+		if err != nil {
+			return nil, newError(ErrorTypeSchema, "", nil, err)
+		}
+	} else {
+		patchDecl = common.SchemaDeclType(patchSchema, true).MaybeAssignTypeName(objectTypeName)
+		oldObjectDecl = patchDecl
+		rt, err = common.NewOpenAPITypeProvider(append(declTypes, patchDecl)...)
+		if err != nil {
+			return nil, newError(ErrorTypeSchema, "", nil, err)
+		}
+	}
+
+	envOpts, err := rt.EnvOptions(baseEnv.TypeProvider())
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, err)
+	}
+	envOpts = append(envOpts,
+		cel.Variable(oldObjectVar, oldObjectDecl.CelType()),
+	)
+	if isConversion {
+		envOpts = append(envOpts,
+			cel.Variable(convertedObjectVar, patchDecl.CelType()),
+		)
+	}
+	if paramsDecl != nil {
+		envOpts = append(envOpts, cel.Variable(paramsVar, celType(paramsDecl)))
+	}
+	env, err := baseEnv.Extend(envOpts...)
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, "", nil, err)
+	}
+	e := &compileEnv{
+		env:                env,
+		oldObjectSchema:    oldObjectSchema,
+		patchSchema:        patchSchema,
+		oldObjectDecl:      oldObjectDecl,
+		patchDecl:          patchDecl,
+		isConversion:       isConversion,
+		paramsDecl:         paramsDecl,
+		params:             params,
+		requestDecl:        requestDecl,
+		estimatedCostLimit: o.estimatedCostLimit,
+	}
+	e.matchConditions, err = e.compileMatchConditions(o.matchConditions, o.matchFailurePolicy)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// compiledExpression is a CEL expression that has been compiled and planned.
+type compiledExpression struct {
+	expression string
+	path       *field.Path
+	program    cel.Program
+	// estimatedCost is the estimated worst case cost of evaluating the expression.
+	estimatedCost   uint64
+	oldObjectSchema common.Schema
+	patchSchema     common.Schema
+	isConversion    bool
+	params          ref.Val
+	// scope is set for the expressions of template directives, which may access the oldSelf and
+	// self variables.
+	scope *templatePosition
+}
+
+// compileExpression compiles the expression, which must evaluate to the patch type. path is the
+// location of the expression in the patch and is used to report errors.
+func (e *compileEnv) compileExpression(expression string, path *field.Path) (*compiledExpression, error) {
+	return e.compile(e.env, e.varDecls(), expression, celType(e.patchDecl), path)
+}
+
+// varDecls returns the declared types of the variables of the environment.
+func (e *compileEnv) varDecls() map[string]*common.DeclType {
+	decls := map[string]*common.DeclType{oldObjectVar: e.oldObjectDecl}
+	if e.isConversion {
+		decls[convertedObjectVar] = e.patchDecl
+	}
+	if e.paramsDecl != nil {
+		decls[paramsVar] = e.paramsDecl
+	}
+	return decls
+}
+
+// compileTemplateExpression compiles the expression of a template directive at pos. oldSelf is
+// declared with the type of the old object at pos and, for conversions, self is declared with
+// the type of the converted object at pos. Both are nullable, since there may be no value at pos.
+func (e *compileEnv) compileTemplateExpression(expression string, pos *templatePosition, path *field.Path) (*compiledExpression, error) {
+	vars := []cel.EnvOption{cel.Variable(oldSelfVar, nullableCelType(pos.oldDecl))}
+	decls := e.varDecls()
+	decls[oldSelfVar] = pos.oldDecl
+	if e.isConversion {
+		vars = append(vars, cel.Variable(selfVar, nullableCelType(pos.decl)))
+		decls[selfVar] = pos.decl
+	}
+	env, err := e.env.Extend(vars...)
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, err)
+	}
+	c, err := e.compile(env, decls, expression, celType(pos.decl), path)
+	if err != nil {
+		return nil, err
+	}
+	c.scope = pos
+	return c, nil
+}
+
+// compile compiles the expression in env. decls are the declared types of the variables of env and
+// are used to estimate the cost of the expression.
+func (e *compileEnv) compile(env *cel.Env, decls map[string]*common.DeclType, expression string, expectedType *cel.Type, path *field.Path) (*compiledExpression, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, issues.Err())
+	}
+	if err := checkOutputType(expectedType, ast.OutputType()); err != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, err)
+	}
+	if err := cel2.CheckRemovals(ast.Expr()); err != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, err)
+	}
+	estimator := newCostEstimator(decls)
+	costEst, err := env.EstimateCost(ast, estimator)
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, err)
+	}
+	if e.estimatedCostLimit > 0 && costEst.Max > e.estimatedCostLimit {
+		return nil, newError(ErrorTypeCost, expression, path,
+			fmt.Errorf("estimated cost %d of expression %q exceeds the limit of %d", costEst.Max, expression, e.estimatedCostLimit))
+	}
+	prog, err := env.Program(ast,
+		cel.EvalOptions(cel.OptTrackCost),
+		cel.CostLimit(PerCallCostLimit),
+		cel.CostTracking(estimator.CostEstimator),
+		cel.InterruptCheckFrequency(celconfig.CheckFrequency),
+	)
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, expression, path, err)
+	}
+	return &compiledExpression{
+		expression:      expression,
+		path:            path,
+		program:         prog,
+		estimatedCost:   costEst.Max,
+		oldObjectSchema: e.oldObjectSchema,
+		patchSchema:     e.patchSchema,
+		isConversion:    e.isConversion,
+		params:          e.params,
+	}, nil
+}
+
+// checkOutputType returns an error if a value of the output type of an expression cannot be
+// assigned to the expected type. Output types that are only known at runtime (dyn) are permitted.
+func checkOutputType(expected, output *cel.Type) error {
+	expectedExpr, err := cel.TypeToExprType(expected)
+	if err != nil {
+		return err
+	}
+	outputExpr, err := cel.TypeToExprType(output)
+	if err != nil {
+		return err
+	}
+	if !isAssignable(expectedExpr, outputExpr) {
+		return fmt.Errorf("expected expression to evaluate to %s, but got %s", expected, output)
+	}
+	return nil
+}
+
+func isAssignable(to, from *exprpb.Type) bool {
+	switch {
+	case isDynType(to), isDynType(from), isNullType(from):
+		return true
+	case isNumberType(to, exprpb.Type_DOUBLE) && isNumberType(from, exprpb.Type_INT64):
+		// Integers are valid values of number fields.
+		return true
+	case from.GetWrapper() != exprpb.Type_PRIMITIVE_TYPE_UNSPECIFIED:
+		// Nullable values, such as oldSelf, may be null or of the wrapped type.
+		return from.GetWrapper() == to.GetPrimitive() || from.GetWrapper() == to.GetWrapper()
+	case to.GetListType() != nil && from.GetListType() != nil:
+		return isAssignable(to.GetListType().GetElemType(), from.GetListType().GetElemType())
+	case to.GetMapType() != nil && from.GetMapType() != nil:
+		return isAssignable(to.GetMapType().GetKeyType(), from.GetMapType().GetKeyType()) &&
+			isAssignable(to.GetMapType().GetValueType(), from.GetMapType().GetValueType())
+	default:
+		return proto.Equal(to, from)
+	}
+}
+
+// isDynType returns true if t is only known at runtime.
+func isDynType(t *exprpb.Type) bool {
+	return t.GetDyn() != nil || t.GetTypeParam() != "" || t.GetWellKnown() == exprpb.Type_ANY
+}
+
+// isNumberType returns true if t is the primitive type, or its nullable (wrapper) type.
+func isNumberType(t *exprpb.Type, primitive exprpb.Type_PrimitiveType) bool {
+	return t.GetPrimitive() == primitive || t.GetWrapper() == primitive
+}
+
+func isNullType(t *exprpb.Type) bool {
+	_, ok := t.GetTypeKind().(*exprpb.Type_Null)
+	return ok
+}
+
+// eval evaluates the expression. convertedObject is only used by conversions. The cost of the
+// evaluation is deducted from the budget, if it is non-nil.
+func (c *compiledExpression) eval(oldObject, convertedObject any, budget *costBudget) (any, error) {
+	return c.evalTemplate(oldObject, convertedObject, nil, nil, budget)
+}
+
+// evalTemplate evaluates the expression of a template directive. oldSelf and self are the values
+// of the old and converted objects correlated with the position of the directive, or nil if there
+// are none.
+func (c *compiledExpression) evalTemplate(oldObject, convertedObject, oldSelf, self any, budget *costBudget) (any, error) {
+	activation := c.activation(oldObject, convertedObject)
+	if c.scope != nil {
+		activation.scoped = true
+		activation.oldSelf = scopedVal(oldSelf, c.scope.oldSchema, c.scope.oldDecl)
+		activation.self = scopedVal(self, c.scope.schema, c.scope.decl)
+	}
+	return c.evalActivation(activation, budget)
+}
+
+// activation returns the activation of the oldObject, convertedObject and params variables.
+func (c *compiledExpression) activation(oldObject, convertedObject any) *evaluationActivation {
+	activation := &evaluationActivation{object: common.UnstructuredToVal(oldObject, c.oldObjectSchema), params: c.params}
+	if c.isConversion {
+		activation.conversionObject = common.UnstructuredToVal(convertedObject, c.patchSchema)
+	}
+	return activation
+}
+
+// evalActivation evaluates the expression with the variables of the activation and converts the
+// result to an unstructured value.
+func (c *compiledExpression) evalActivation(activation *evaluationActivation, budget *costBudget) (any, error) {
+	v, details, err := c.program.Eval(activation)
+	if isCostLimitExceeded(err) {
+		return nil, newError(ErrorTypeCost, c.expression, c.path,
+			fmt.Errorf("expression %q exceeded the runtime cost limit of %d", c.expression, PerCallCostLimit))
+	}
+	if err != nil {
+		return nil, evaluationError(c.expression, c.path, err)
+	}
+	if details != nil && details.ActualCost() != nil {
+		if err := budget.consume(c.expression, c.path, *details.ActualCost()); err != nil {
+			return nil, err
+		}
+	}
+	result, err := valueToUnstructured(v)
+	if err != nil {
+		return nil, newError(ErrorTypeEvaluation, c.expression, c.path, err)
+	}
+	return result, nil
+}
+
+// scopedVal returns the CEL value of a scoped variable of the declared type t. If there is no value,
+// it is null or, for lists and maps, which are not nullable, empty.
+func scopedVal(v any, s common.Schema, t *common.DeclType) ref.Val {
+	if s == nil {
+		return types.NullValue
+	}
+	if v == nil {
+		switch {
+		case t != nil && t.IsList():
+			v = []any{}
+		case t != nil && t.IsMap():
+			v = map[string]any{}
+		default:
+			return types.NullValue
+		}
+	}
+	return common.UnstructuredToVal(v, s)
+}
+
+// templatePosition is a position in a template. It tracks the schemas and declared types of both
+// the patch (and converted object) and the old object at the position.
+type templatePosition struct {
+	schema, oldSchema common.Schema
+	decl, oldDecl     *common.DeclType
+}
+
+func (p *templatePosition) property(name string) *templatePosition {
+	return &templatePosition{
+		schema:    propertySchema(p.schema, name),
+		oldSchema: propertySchema(p.oldSchema, name),
+		decl:      propertyDeclType(p.decl, name),
+		oldDecl:   propertyDeclType(p.oldDecl, name),
+	}
+}
+
+func (p *templatePosition) items() *templatePosition {
+	result := &templatePosition{decl: itemsDeclType(p.decl), oldDecl: itemsDeclType(p.oldDecl)}
+	if p.schema != nil {
+		result.schema = p.schema.Items()
+	}
+	if p.oldSchema != nil {
+		result.oldSchema = p.oldSchema.Items()
+	}
+	return result
+}
+
+// propertyDeclType returns the declared type of the property or map value with the given name,
+// or nil if there is none.
+func propertyDeclType(t *common.DeclType, name string) *common.DeclType {
+	switch {
+	case t == nil:
+		return nil
+	case t.IsObject():
+		escaped, ok := apiservercel.Escape(name)
+		if !ok {
+			return nil
+		}
+		if f, ok := t.FindField(escaped); ok {
+			return f.Type
+		}
+		return nil
+	case t.IsMap():
+		return t.ElemType
+	default:
+		return nil
+	}
+}
+
+// itemsDeclType returns the declared type of list items, or nil if t is not a list.
+func itemsDeclType(t *common.DeclType) *common.DeclType {
+	if t == nil || !t.IsList() {
+		return nil
+	}
+	return t.ElemType
+}
+
+// celType returns the CEL type of t, or dyn if there is no declared type.
+func celType(t *common.DeclType) *cel.Type {
+	if t == nil || t.CelType() == nil {
+		return cel.DynType
+	}
+	return t.CelType()
+}
+
+// nullableCelType returns the CEL type of values of the declared type that may be null. Objects
+// are nullable, and the primitive types are replaced with their nullable (wrapper) types. Lists and
+// maps are not nullable.
+func nullableCelType(t *common.DeclType) *cel.Type {
+	ct := celType(t)
+	if exprType, err := cel.TypeToExprType(ct); err == nil && exprType.GetPrimitive() != exprpb.Type_PRIMITIVE_TYPE_UNSPECIFIED {
+		return cel.NullableType(ct)
+	}
+	return ct
+}
+
+// compileTemplate returns a copy of the patch with all `{$: "<CEL expression>"}` directives replaced
+// by their compiled expressions. The patch is checked against the schema as it is traversed.
+func (e *compileEnv) compileTemplate(patch any) (any, error) {
+	root := &templatePosition{schema: e.patchSchema, oldSchema: e.oldObjectSchema, decl: e.patchDecl, oldDecl: e.oldObjectDecl}
+	return e.compileTemplateValue(root, patch, nil)
+}
+
+func (e *compileEnv) compileTemplateValue(pos *templatePosition, patchValue any, path *field.Path) (any, error) {
+	if m, ok := patchValue.(map[string]any); ok {
+		if v, ok := m[templateVar]; ok {
+			expression, ok := v.(string)
+			if !ok {
+				return nil, compileError("", path, "expected %s to be a CEL expression string, but got %T", templateVar, v)
+			}
+			return e.compileTemplateExpression(expression, pos, path)
+		}
+	}
+	schema := pos.schema
+	if schema.Properties() != nil {
+		m, ok := patchValue.(map[string]any)
+		if !ok {
+			return nil, schemaError(path, "expected map, but got %T", patchValue)
+		}
+		result := map[string]any{}
+		for fieldName := range schema.Properties() {
+			if v, ok := m[fieldName]; ok {
+				r, err := e.compileTemplateValue(pos.property(fieldName), v, path.Child(fieldName))
+				if err != nil {
+					return nil, err
+				}
+				result[fieldName] = r
+			}
+		}
+		return result, nil
+	} else if schema.AdditionalProperties() != nil && schema.AdditionalProperties().Schema() != nil {
+		m, ok := patchValue.(map[string]any)
+		if !ok {
+			return nil, schemaError(path, "expected map, but got %T", patchValue)
+		}
+		result := map[string]any{}
+		for k, v := range m {
+			r, err := e.compileTemplateValue(pos.property(k), v, path.Key(k))
+			if err != nil {
+				return nil, err
+			}
+			result[k] = r
+		}
+		return result, nil
+	} else if schema.Items() != nil {
+		l, ok := patchValue.([]any)
+		if !ok {
+			return nil, schemaError(path, "expected slice, but got %T", patchValue)
+		}
+		items := pos.items()
+		result := make([]any, len(l))
+		for i, el := range l {
+			r, err := e.compileTemplateValue(items, el, path.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			result[i] = r
+		}
+		return result, nil
+	} else {
+		return patchValue, nil
+	}
+}
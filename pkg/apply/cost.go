@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/checker"
+	"github.com/google/cel-go/common/overloads"
+	"github.com/google/cel-go/interpreter"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/apiserver/pkg/cel/library"
+)
+
+const (
+	// PerCallCostLimit is the maximum runtime cost of a single evaluation of an expression.
+	PerCallCostLimit = celconfig.PerCallLimit
+	// RuntimeCostBudget is the maximum total runtime cost of all the expressions evaluated to
+	// apply a single mutation or conversion to an object.
+	RuntimeCostBudget = celconfig.RuntimeCELCostBudget
+	// StaticEstimatedCostLimit is the maximum estimated cost of an expression that Kubernetes
+	// permits in the validation rules of CustomResourceDefinitions. It is the default limit of
+	// WithEstimatedCostLimit.
+	StaticEstimatedCostLimit = 10000000
+)
+
+// maxScalarStringSize is the maximum length of an int, uint, double or bool converted to a string.
+const maxScalarStringSize = 32
+
+// newCostEstimator returns a cost estimator that estimates the size of the values of variables
+// using the declared types of the variables.
+func newCostEstimator(vars map[string]*common.DeclType) *costEstimator {
+	sizes := &sizeEstimator{vars: vars, scalarStringArgs: map[int64]bool{}}
+	return &costEstimator{CostEstimator: &library.CostEstimator{SizeEstimator: sizes}, sizes: sizes}
+}
+
+// costEstimator extends the Kubernetes library cost estimator to bound the size of scalars
+// converted to strings, which would otherwise be treated as unbounded.
+type costEstimator struct {
+	*library.CostEstimator
+	sizes *sizeEstimator
+}
+
+func (c *costEstimator) EstimateCallCost(function, overloadID string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	switch overloadID {
+	case overloads.IntToString, overloads.UintToString, overloads.DoubleToString, overloads.BoolToString:
+		// The checker does not use the result size of call estimates, so the argument is recorded
+		// and the size of the call is provided by EstimateSize instead.
+		if len(args) == 1 {
+			c.sizes.scalarStringArgs[args[0].Expr().GetId()] = true
+		}
+	}
+	return c.CostEstimator.EstimateCallCost(function, overloadID, target, args)
+}
+
+type sizeEstimator struct {
+	vars map[string]*common.DeclType
+	// scalarStringArgs contains the IDs of the arguments of scalar to string conversions.
+	scalarStringArgs map[int64]bool
+}
+
+func (c *sizeEstimator) EstimateSize(element checker.AstNode) *checker.SizeEstimate {
+	if call := element.Expr().GetCallExpr(); call != nil && len(call.GetArgs()) == 1 && c.scalarStringArgs[call.GetArgs()[0].GetId()] {
+		return &checker.SizeEstimate{Min: 1, Max: maxScalarStringSize}
+	}
+	path := element.Path()
+	if len(path) == 0 {
+		return nil
+	}
+	currentNode, ok := c.vars[path[0]]
+	if !ok || currentNode == nil {
+		return nil
+	}
+	for _, name := range path[1:] {
+		switch name {
+		case "@items", "@values":
+			if currentNode.ElemType == nil {
+				return nil
+			}
+			currentNode = currentNode.ElemType
+		case "@keys":
+			if currentNode.KeyType == nil {
+				return nil
+			}
+			currentNode = currentNode.KeyType
+		default:
+			if currentNode.IsMap() {
+				// A field selection on a map, such as metadata.labels.app, selects a map value.
+				if currentNode.ElemType == nil {
+					return nil
+				}
+				currentNode = currentNode.ElemType
+				continue
+			}
+			f, ok := currentNode.Fields[name]
+			if !ok || f.Type == nil {
+				return nil
+			}
+			currentNode = f.Type
+		}
+	}
+	return &checker.SizeEstimate{Min: 0, Max: uint64(currentNode.MaxElements)}
+}
+
+func (c *sizeEstimator) EstimateCallCost(function, overloadID string, target *checker.AstNode, args []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// costBudget tracks the runtime cost remaining while applying a mutation or conversion to an object.
+type costBudget struct {
+	limit, remaining uint64
+}
+
+func newCostBudget(limit uint64) *costBudget {
+	return &costBudget{limit: limit, remaining: limit}
+}
+
+// consume deducts the cost of an evaluation of the expression from the budget, returning an
+// error if the budget is exceeded.
+func (b *costBudget) consume(expression string, path *field.Path, cost uint64) error {
+	if b == nil {
+		return nil
+	}
+	if cost > b.remaining {
+		b.remaining = 0
+		return newError(ErrorTypeCost, expression, path,
+			fmt.Errorf("expression %q exceeded the runtime cost budget of %d for the object", expression, b.limit))
+	}
+	b.remaining -= cost
+	return nil
+}
+
+// isCostLimitExceeded returns true if evaluation was cancelled because the per call cost limit
+// was exceeded.
+func isCostLimitExceeded(err error) bool {
+	var cancelled interpreter.EvalCancelledError
+	return errors.As(err, &cancelled) && cancelled.Cause == interpreter.CostLimitExceeded
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+func TestCostLimits(t *testing.T) {
+	schema := loadTestSchema()
+	original := loadTestYaml[map[string]any](filepath.Join(testdata, "basicmerge", "mutate", "basic", "original.yaml"))
+
+	t.Run("estimated cost limit", func(t *testing.T) {
+		expression := "Object{spec: Object.spec{list: oldObject.spec.list.filter(e, e != 'b')}}"
+		// The same list, bounded by the schema.
+		bounded := loadTestSchema()
+		specSchema := bounded.Properties["spec"]
+		list := specSchema.Properties["list"]
+		maxItems, maxLength := int64(16), int64(64)
+		list.MaxItems = &maxItems
+		list.Items.Schema.MaxLength = &maxLength
+		specSchema.Properties["list"] = list
+		bounded.Properties["spec"] = specSchema
+
+		for _, tc := range []struct {
+			name        string
+			schema      *spec.Schema
+			opts        []CompileOption
+			expectError bool
+		}{
+			{name: "unbounded list exceeds the default limit", schema: &schema, expectError: true},
+			{name: "limit of 0 disables the check", schema: &schema, opts: []CompileOption{WithEstimatedCostLimit(0)}},
+			{name: "higher limit", schema: &schema, opts: []CompileOption{WithEstimatedCostLimit(100 * StaticEstimatedCostLimit)}},
+			{name: "lower limit", schema: &bounded, opts: []CompileOption{WithEstimatedCostLimit(10)}, expectError: true},
+			{name: "bounded list is within the default limit", schema: &bounded},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := CompileMutateBasicMerge(tc.schema, map[string]any{"mutation": expression}, tc.opts...)
+				if tc.expectError {
+					expectCostError(t, err, expression)
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	})
+
+	t.Run("runtime cost exceeds limit", func(t *testing.T) {
+		// The estimated cost is not limited, but the runtime cost is.
+		expression := "Object{spec: Object.spec{deploymentName: oldObject.metadata.name.contains('x') ? 'x' : 'y'}}"
+		compiled, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": expression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := runtime.DeepCopyJSON(original)
+		obj["metadata"].(map[string]any)["name"] = strings.Repeat("a", 20*PerCallCostLimit)
+		_, err = compiled.Apply(obj)
+		expectCostError(t, err, expression)
+	})
+
+	t.Run("runtime cost exceeds budget", func(t *testing.T) {
+		patch := map[string]any{"spec": map[string]any{
+			"deploymentName": map[string]any{"$": "oldObject.metadata.name + '-deployment'"},
+			"list":           map[string]any{"$": "oldObject.spec.list.filter(e, e != 'b')"},
+		}}
+		compiled, err := CompileMutateWithTemplate(&schema, patch, WithEstimatedCostLimit(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compiled.EstimatedCost() == 0 {
+			t.Error("expected a non-zero estimated cost")
+		}
+		if _, err := compiled.Apply(original); err != nil {
+			t.Fatal(err)
+		}
+		compiled.costBudget = 5
+		_, err = compiled.Apply(original)
+		var applyErr *Error
+		if !errors.As(err, &applyErr) || applyErr.Type != ErrorTypeCost {
+			t.Fatalf("expected cost error but got %v", err)
+		}
+	})
+}
+
+func expectCostError(t *testing.T, err error, expression string) {
+	t.Helper()
+	var applyErr *Error
+	if !errors.As(err, &applyErr) {
+		t.Fatalf("expected *Error but got %T: %v", err, err)
+	}
+	if applyErr.Type != ErrorTypeCost {
+		t.Errorf("expected error type %s but got %s: %v", ErrorTypeCost, applyErr.Type, err)
+	}
+	if applyErr.Expression != expression {
+		t.Errorf("expected error for expression %q but got %q", expression, applyErr.Expression)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ErrorType identifies which stage of a mutation or conversion failed.
+type ErrorType string
+
+const (
+	// ErrorTypeCompile is used when a CEL expression fails to parse or type check,
+	// or when a patch is not well formed.
+	ErrorTypeCompile ErrorType = "Compile"
+	// ErrorTypeEvaluation is used when a CEL expression fails at runtime.
+	ErrorTypeEvaluation ErrorType = "Evaluation"
+	// ErrorTypeMerge is used when an apply configuration cannot be merged into an object.
+	ErrorTypeMerge ErrorType = "Merge"
+	// ErrorTypeSchema is used when a schema cannot be converted, or when a value does
+	// not match its schema.
+	ErrorTypeSchema ErrorType = "Schema"
+	// ErrorTypeCost is used when the estimated cost of a CEL expression exceeds the limit,
+	// or when evaluation exceeds the runtime cost limit or budget.
+	ErrorTypeCost ErrorType = "Cost"
+	// ErrorTypeConflict is used when an apply configuration sets fields owned by other field
+	// managers, and conflicts are not forced. The Err of the Error is a *ConflictError.
+	ErrorTypeConflict ErrorType = "Conflict"
+)
+
+// Error is returned by all mutation and conversion entry points.
+type Error struct {
+	Type ErrorType
+	// Expression is the CEL expression that failed, if any.
+	Expression string
+	// Path is the location of the failure within the patch, e.g. "spec.listMap[0].value".
+	// It is empty if the failure applies to the patch as a whole.
+	Path string
+	// Err is the underlying cause.
+	Err error
+}
+
+var _ error = &Error{}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(string(e.Type)))
+	b.WriteString(" error")
+	if len(e.Path) > 0 {
+		b.WriteString(" at ")
+		b.WriteString(e.Path)
+	}
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(t ErrorType, expression string, path *field.Path, err error) *Error {
+	return &Error{Type: t, Expression: expression, Path: pathString(path), Err: err}
+}
+
+func compileError(expression string, path *field.Path, format string, args ...any) *Error {
+	return newError(ErrorTypeCompile, expression, path, fmt.Errorf(format, args...))
+}
+
+func schemaError(path *field.Path, format string, args ...any) *Error {
+	return newError(ErrorTypeSchema, "", path, fmt.Errorf(format, args...))
+}
+
+// evaluationError converts an error returned by CEL program evaluation. Errors raised by
+// functions of this package, such as objects.apply() merge failures, are passed through
+// with the expression filled in.
+func evaluationError(expression string, path *field.Path, err error) *Error {
+	if celErr, ok := err.(*types.Err); ok {
+		if inner, ok := celErr.Value().(error); ok {
+			err = inner
+		}
+	}
+	var applyErr *Error
+	if errors.As(err, &applyErr) {
+		if len(applyErr.Expression) == 0 {
+			applyErr.Expression = expression
+		}
+		if len(applyErr.Path) == 0 {
+			applyErr.Path = pathString(path)
+		}
+		return applyErr
+	}
+	return newError(ErrorTypeEvaluation, expression, path, err)
+}
+
+func pathString(path *field.Path) string {
+	if path == nil {
+		return ""
+	}
+	return path.String()
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/structured-merge-diff/v4/fieldpath"
+	"sigs.k8s.io/structured-merge-diff/v4/merge"
+	"sigs.k8s.io/structured-merge-diff/v4/typed"
+)
+
+// strippedFields are the fields that are never owned by field managers, as in the Kubernetes API
+// server. They are removed from the field sets of managers without removing their children, so
+// that, for example, labels are still owned.
+var strippedFields = fieldpath.NewSet(
+	fieldpath.MakePathOrDie("apiVersion"),
+	fieldpath.MakePathOrDie("kind"),
+	fieldpath.MakePathOrDie("metadata"),
+	fieldpath.MakePathOrDie("metadata", "name"),
+	fieldpath.MakePathOrDie("metadata", "namespace"),
+	fieldpath.MakePathOrDie("metadata", "creationTimestamp"),
+	fieldpath.MakePathOrDie("metadata", "selfLink"),
+	fieldpath.MakePathOrDie("metadata", "uid"),
+	fieldpath.MakePathOrDie("metadata", "clusterName"),
+	fieldpath.MakePathOrDie("metadata", "generation"),
+	fieldpath.MakePathOrDie("metadata", "managedFields"),
+	fieldpath.MakePathOrDie("metadata", "resourceVersion"),
+)
+
+// managedFields are the managedFields of an object, decoded into the field sets of its managers.
+type managedFields struct {
+	// managers are the field sets of the managers, keyed by manager identifier.
+	managers fieldpath.ManagedFields
+	// entries are the decoded entries, without their field sets, keyed by manager identifier.
+	entries map[string]metav1.ManagedFieldsEntry
+	// order is the manager identifiers in the order of the entries of the object.
+	order []string
+}
+
+// splitManagedFields returns a copy of obj without metadata.managedFields, and the decoded
+// managedFields.
+func splitManagedFields(obj any) (any, *managedFields, error) {
+	result := &managedFields{managers: fieldpath.ManagedFields{}, entries: map[string]metav1.ManagedFieldsEntry{}}
+	m, ok := obj.(map[string]any)
+	if !ok {
+		return obj, result, nil
+	}
+	metadata, ok := m["metadata"].(map[string]any)
+	if !ok {
+		return obj, result, nil
+	}
+	encoded, ok := metadata["managedFields"]
+	if !ok {
+		return obj, result, nil
+	}
+	stripped := copyMap(m)
+	stripped["metadata"] = copyMap(metadata)
+	delete(stripped["metadata"].(map[string]any), "managedFields")
+
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []metav1.ManagedFieldsEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata.managedFields: %w", err)
+	}
+	for i, entry := range entries {
+		if entry.FieldsType != "FieldsV1" {
+			return nil, nil, fmt.Errorf("invalid metadata.managedFields[%d]: unsupported fieldsType %q", i, entry.FieldsType)
+		}
+		set := &fieldpath.Set{}
+		if entry.FieldsV1 != nil {
+			if err := set.FromJSON(bytes.NewReader(entry.FieldsV1.Raw)); err != nil {
+				return nil, nil, fmt.Errorf("invalid metadata.managedFields[%d].fieldsV1: %w", i, err)
+			}
+		}
+		id, err := managerIdentifier(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := result.entries[id]; ok {
+			return nil, nil, fmt.Errorf("invalid metadata.managedFields[%d]: duplicate entry for manager %q", i, entry.Manager)
+		}
+		entry.FieldsV1 = nil
+		result.managers[id] = fieldpath.NewVersionedSet(set, fieldpath.APIVersion(entry.APIVersion), entry.Operation == metav1.ManagedFieldsOperationApply)
+		result.entries[id] = entry
+		result.order = append(result.order, id)
+	}
+	return stripped, result, nil
+}
+
+// managerIdentifier returns the key of the field set of the manager of the entry. As in the
+// Kubernetes API server, it is the JSON encoding of the entry without its field set and time, and
+// without the apiVersion of appliers, so that an applier has one field set across versions.
+func managerIdentifier(entry metav1.ManagedFieldsEntry) (string, error) {
+	entry.FieldsType = ""
+	entry.FieldsV1 = nil
+	entry.Time = nil
+	if entry.Operation == metav1.ManagedFieldsOperationApply {
+		entry.APIVersion = ""
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// applierEntry returns the entry and identifier of the manager when it applies at the version.
+func applierEntry(manager string, version fieldpath.APIVersion) (metav1.ManagedFieldsEntry, string, error) {
+	entry := metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  metav1.ManagedFieldsOperationApply,
+		APIVersion: string(version),
+	}
+	id, err := managerIdentifier(entry)
+	return entry, id, err
+}
+
+// encode returns the managedFields of the updated field sets of the managers, in the order of
+// the entries they were decoded from, followed by new managers. The time of a manager is updated
+// only if its field set changed.
+func (f *managedFields) encode(updated fieldpath.ManagedFields, applier string, applierEntry metav1.ManagedFieldsEntry) ([]any, error) {
+	order := f.order
+	if _, ok := f.entries[applier]; !ok {
+		order = append(order[:len(order):len(order)], applier)
+	}
+	var entries []metav1.ManagedFieldsEntry
+	for _, id := range order {
+		set, ok := updated[id]
+		if !ok {
+			continue
+		}
+		entry, existed := f.entries[id]
+		if id == applier {
+			entry.Manager, entry.Operation, entry.APIVersion = applierEntry.Manager, applierEntry.Operation, applierEntry.APIVersion
+		}
+		if previous, ok := f.managers[id]; !existed || !ok || !previous.Set().Equals(set.Set()) || previous.APIVersion() != set.APIVersion() {
+			now := metav1.Now().Rfc3339Copy()
+			entry.Time = &now
+		}
+		data, err := set.Set().ToJSON()
+		if err != nil {
+			return nil, err
+		}
+		entry.FieldsType = "FieldsV1"
+		entry.FieldsV1 = &metav1.FieldsV1{Raw: data}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	var result []any
+	if err := utiljson.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// stripManagedFields removes the fields that are never owned from the field sets of the managers,
+// and removes managers that own no fields.
+func stripManagedFields(managers fieldpath.ManagedFields) {
+	for id, set := range managers {
+		stripped := set.Set().Difference(strippedFields)
+		if stripped.Empty() {
+			delete(managers, id)
+			continue
+		}
+		managers[id] = fieldpath.NewVersionedSet(stripped, set.APIVersion(), set.Applied())
+	}
+}
+
+// withManagedFields returns obj with metadata.managedFields set to entries, or removed if there
+// are no entries.
+func withManagedFields(obj any, entries []any) any {
+	m, ok := obj.(map[string]any)
+	if !ok {
+		return obj
+	}
+	metadata, ok := m["metadata"].(map[string]any)
+	if !ok {
+		if len(entries) == 0 {
+			return obj
+		}
+		metadata = map[string]any{}
+		m["metadata"] = metadata
+	}
+	if len(entries) == 0 {
+		delete(metadata, "managedFields")
+	} else {
+		metadata["managedFields"] = entries
+	}
+	return obj
+}
+
+// objectVersion returns the apiVersion of the object, or of the apply configuration if the
+// object has none.
+func objectVersion(obj, patch any) fieldpath.APIVersion {
+	for _, v := range []any{obj, patch} {
+		if m, ok := v.(map[string]any); ok {
+			if apiVersion, ok := m["apiVersion"].(string); ok && len(apiVersion) > 0 {
+				return fieldpath.APIVersion(apiVersion)
+			}
+		}
+	}
+	return ""
+}
+
+// sameSchemaConverter is the merge.Converter of a Merger. A Merger has a single schema, so the
+// field sets of managers recorded at other versions are interpreted using that schema, which is
+// correct as long as the fields they own have the same paths in all versions.
+type sameSchemaConverter struct{}
+
+func (sameSchemaConverter) Convert(object *typed.TypedValue, _ fieldpath.APIVersion) (*typed.TypedValue, error) {
+	return object, nil
+}
+
+func (sameSchemaConverter) IsMissingVersionError(error) bool {
+	return false
+}
+
+// Conflict is a field that an apply configuration sets to a different value than the one set by
+// another field manager.
+type Conflict struct {
+	// Path is the path of the field, e.g. "spec.items[name=\"a\"].value".
+	Path string
+	// Manager is the name of the field manager that owns the field.
+	Manager string
+	// Operation is the operation of the manager's managedFields entry: Apply or Update.
+	Operation string
+}
+
+// ConflictError is the error of an apply that conflicts with other field managers.
+type ConflictError struct {
+	// Conflicts are the conflicting fields, ordered by path and manager.
+	Conflicts []Conflict
+}
+
+// Error implements the error interface.
+func (e *ConflictError) Error() string {
+	var b strings.Builder
+	b.WriteString("apply conflicts with other field managers: ")
+	for i, c := range e.Conflicts {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s is owned by %q", c.Path, c.Manager)
+	}
+	return b.String()
+}
+
+// conflictError returns the conflicts reported by structured-merge-diff, with the manager
+// identifiers resolved to the managers of the managedFields entries.
+func (f *managedFields) conflictError(conflicts merge.Conflicts) *ConflictError {
+	result := &ConflictError{}
+	for _, c := range conflicts {
+		entry := f.entries[c.Manager]
+		result.Conflicts = append(result.Conflicts, Conflict{
+			Path:      strings.TrimPrefix(c.Path.String(), "."),
+			Manager:   entry.Manager,
+			Operation: string(entry.Operation),
+		})
+	}
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		a, b := result.Conflicts[i], result.Conflicts[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Manager < b.Manager
+	})
+	return result
+}
+
+// copyMap returns a shallow copy of m.
+func copyMap(m map[string]any) map[string]any {
+	result := make(map[string]any, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
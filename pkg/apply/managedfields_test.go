@@ -0,0 +1,307 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestMergeAsManager(t *testing.T) {
+	m := managedFieldsTestMerger(t)
+	type apply struct {
+		manager string
+		patch   string
+	}
+	cases := []struct {
+		name    string
+		applies []apply
+		// expectedSpec is the spec after all the applies.
+		expectedSpec string
+		// expectedManagers are the managers of the managedFields, in order, with their fields.
+		expectedManagers string
+	}{
+		{
+			name:             "first apply",
+			applies:          []apply{{"m1", `{spec: {a: "1", b: "2"}}`}},
+			expectedSpec:     `{a: "1", b: "2"}`,
+			expectedManagers: `[{m1: {f:spec: {f:a: {}, f:b: {}}}}]`,
+		},
+		{
+			name: "fields no longer applied are removed",
+			applies: []apply{
+				{"m1", `{spec: {a: "1", b: "2"}}`},
+				{"m1", `{spec: {a: "1"}}`},
+			},
+			expectedSpec:     `{a: "1"}`,
+			expectedManagers: `[{m1: {f:spec: {f:a: {}}}}]`,
+		},
+		{
+			name: "fields owned by another manager are kept",
+			applies: []apply{
+				{"m1", `{spec: {a: "1", b: "2"}}`},
+				{"m2", `{spec: {b: "2"}}`},
+				{"m1", `{spec: {a: "1"}}`},
+			},
+			expectedSpec:     `{a: "1", b: "2"}`,
+			expectedManagers: `[{m1: {f:spec: {f:a: {}}}}, {m2: {f:spec: {f:b: {}}}}]`,
+		},
+		{
+			name: "overridden fields change owner",
+			applies: []apply{
+				{"m1", `{spec: {a: "1", b: "2"}}`},
+				{"m2", `{spec: {b: "3"}}`},
+				{"m1", `{spec: {a: "1"}}`},
+			},
+			expectedSpec:     `{a: "1", b: "3"}`,
+			expectedManagers: `[{m1: {f:spec: {f:a: {}}}}, {m2: {f:spec: {f:b: {}}}}]`,
+		},
+		{
+			name: "list map entries no longer applied are removed",
+			applies: []apply{
+				{"m1", `{spec: {items: [{name: first, value: "1"}, {name: second, value: "2"}]}}`},
+				{"m1", `{spec: {items: [{name: second, value: "2"}]}}`},
+			},
+			expectedSpec:     `{items: [{name: second, value: "2"}]}`,
+			expectedManagers: `[{m1: {f:spec: {f:items: {'k:{"name":"second"}': {.: {}, f:name: {}, f:value: {}}}}}}]`,
+		},
+		{
+			name: "managers that own no fields are removed",
+			applies: []apply{
+				{"m1", `{spec: {a: "1"}}`},
+				{"m2", `{spec: {a: "2"}}`},
+			},
+			expectedSpec:     `{a: "2"}`,
+			expectedManagers: `[{m2: {f:spec: {f:a: {}}}}]`,
+		},
+		{
+			name: "identifying fields are not owned",
+			applies: []apply{
+				{"m1", `{apiVersion: v1, kind: Widget, metadata: {name: w, labels: {l: "1"}}, spec: {a: "1"}}`},
+				{"m1", `{apiVersion: v1, kind: Widget, metadata: {name: w}}`},
+			},
+			expectedSpec:     `null`,
+			expectedManagers: `[]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var obj any = map[string]any{"apiVersion": "v1", "kind": "Widget", "metadata": map[string]any{"name": "w"}, "spec": map[string]any{}}
+			for _, a := range tc.applies {
+				var err error
+				obj, err = m.MergeAsManager(obj, yamlValue(t, a.patch), a.manager)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			result := obj.(map[string]any)
+			if expected := yamlValue(t, tc.expectedSpec); !reflect.DeepEqual(expected, result["spec"]) {
+				t.Errorf("expected spec:\n%s\nBut got:\n%s", yamlToString(expected), yamlToString(result["spec"]))
+			}
+			var managers []any
+			entries, _ := result["metadata"].(map[string]any)["managedFields"].([]any)
+			for _, e := range entries {
+				entry := e.(map[string]any)
+				if entry["operation"] != "Apply" || entry["apiVersion"] != "v1" || entry["fieldsType"] != "FieldsV1" || entry["time"] == nil {
+					t.Errorf("unexpected managedFields entry: %v", entry)
+				}
+				managers = append(managers, map[string]any{entry["manager"].(string): entry["fieldsV1"]})
+			}
+			if expected := yamlValue(t, tc.expectedManagers).([]any); len(expected)+len(managers) > 0 && !reflect.DeepEqual(expected, managers) {
+				t.Errorf("expected managers:\n%s\nBut got:\n%s", yamlToString(expected), yamlToString(managers))
+			}
+		})
+	}
+}
+
+func TestMergeAsManagerErrors(t *testing.T) {
+	schema := loadTestSchema()
+	m, err := NewMerger(&schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name          string
+		obj           string
+		manager       string
+		expectedError string
+	}{
+		{
+			name:          "empty manager",
+			obj:           `{spec: {}}`,
+			expectedError: "merge error: field manager name must not be empty",
+		},
+		{
+			name:          "unsupported fields type",
+			obj:           `{metadata: {managedFields: [{manager: m1, operation: Apply, fieldsType: FieldsV2}]}}`,
+			manager:       "m1",
+			expectedError: `schema error: invalid metadata.managedFields[0]: unsupported fieldsType "FieldsV2"`,
+		},
+		{
+			name:          "duplicate manager",
+			obj:           `{metadata: {managedFields: [{manager: m1, operation: Apply, fieldsType: FieldsV1}, {manager: m1, operation: Apply, fieldsType: FieldsV1}]}}`,
+			manager:       "m1",
+			expectedError: `schema error: invalid metadata.managedFields[1]: duplicate entry for manager "m1"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := m.MergeAsManager(yamlValue(t, tc.obj), map[string]any{}, tc.manager)
+			if err == nil || err.Error() != tc.expectedError {
+				t.Errorf("expected error %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+// managedFieldsTestMerger returns a Merger of widgets with a spec of strings and a list map.
+func managedFieldsTestMerger(t *testing.T) *Merger {
+	t.Helper()
+	var s spec.Schema
+	if err := yaml.Unmarshal([]byte(`
+type: object
+properties:
+  apiVersion: {type: string}
+  kind: {type: string}
+  metadata:
+    type: object
+    properties:
+      name: {type: string}
+      labels: {type: object, additionalProperties: {type: string}}
+  spec:
+    type: object
+    properties:
+      a: {type: string}
+      b: {type: string}
+      items:
+        type: array
+        x-kubernetes-list-type: map
+        x-kubernetes-list-map-keys: [name]
+        items: {type: object, properties: {name: {type: string}, value: {type: string}}}
+`), &s); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMerger(&s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestApplyAsManagerConflicts(t *testing.T) {
+	m := managedFieldsTestMerger(t)
+	initial := yamlValue(t, `{apiVersion: v1, kind: Widget, metadata: {name: w}}`)
+	obj, err := m.ApplyAsManager(initial, yamlValue(t, `{spec: {a: "1", items: [{name: first, value: "1"}]}}`), "m1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name              string
+		patch             string
+		force             bool
+		expectedSpec      string
+		expectedConflicts []Conflict
+	}{
+		{
+			name:         "no conflicts",
+			patch:        `{spec: {b: "2"}}`,
+			expectedSpec: `{a: "1", b: "2", items: [{name: first, value: "1"}]}`,
+		},
+		{
+			name:         "same value is shared",
+			patch:        `{spec: {a: "1"}}`,
+			expectedSpec: `{a: "1", items: [{name: first, value: "1"}]}`,
+		},
+		{
+			name:  "different values conflict",
+			patch: `{spec: {a: "2", items: [{name: first, value: "2"}]}}`,
+			expectedConflicts: []Conflict{
+				{Path: "spec.a", Manager: "m1", Operation: "Apply"},
+				{Path: `spec.items[name="first"].value`, Manager: "m1", Operation: "Apply"},
+			},
+		},
+		{
+			name:         "force overrides conflicts",
+			patch:        `{spec: {a: "2", items: [{name: first, value: "2"}]}}`,
+			force:        true,
+			expectedSpec: `{a: "2", items: [{name: first, value: "2"}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := m.ApplyAsManager(runtime.DeepCopyJSONValue(obj), yamlValue(t, tc.patch), "m2", tc.force)
+			if len(tc.expectedConflicts) > 0 {
+				var applyErr *Error
+				var conflictErr *ConflictError
+				if !errors.As(err, &applyErr) || applyErr.Type != ErrorTypeConflict || !errors.As(err, &conflictErr) {
+					t.Fatalf("expected a conflict error but got %v", err)
+				}
+				if !reflect.DeepEqual(tc.expectedConflicts, conflictErr.Conflicts) {
+					t.Errorf("expected conflicts %v but got %v", tc.expectedConflicts, conflictErr.Conflicts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec := result.(map[string]any)["spec"]
+			if expected := yamlValue(t, tc.expectedSpec); !reflect.DeepEqual(expected, spec) {
+				t.Errorf("expected spec:\n%s\nBut got:\n%s", yamlToString(expected), yamlToString(spec))
+			}
+		})
+	}
+}
+
+func TestFieldManagerForce(t *testing.T) {
+	schema := loadTestSchema()
+	m, err := NewMerger(&schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := m.MergeAsManager(yamlValue(t, `{apiVersion: v1, kind: Object}`), yamlValue(t, `{spec: {deploymentName: d1}}`), "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := map[string]any{"mutation": "Object{spec: Object.spec{deploymentName: 'd2'}}"}
+
+	compiled, err := CompileMutateBasicMerge(&schema, patch, WithFieldManager("m2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applyErr *Error
+	if _, err := compiled.Apply(runtime.DeepCopyJSONValue(obj)); !errors.As(err, &applyErr) || applyErr.Type != ErrorTypeConflict {
+		t.Fatalf("expected a conflict error but got %v", err)
+	}
+
+	compiled, err = CompileMutateBasicMerge(&schema, patch, WithFieldManager("m2"), WithForce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := compiled.Apply(runtime.DeepCopyJSONValue(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := result.(map[string]any)["spec"].(map[string]any)["deploymentName"]; name != "d2" {
+		t.Errorf("expected deploymentName d2 but got %v", name)
+	}
+}
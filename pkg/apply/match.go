@@ -0,0 +1,241 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	apiservercel "k8s.io/apiserver/pkg/cel"
+	"k8s.io/apiserver/pkg/cel/common"
+)
+
+// MatchCondition is a CEL expression that must evaluate to true for a mutation or conversion to
+// be applied. It is evaluated in the same environment as the expressions of the mutation or
+// conversion, with the request variable added.
+type MatchCondition struct {
+	// Name identifies the condition in errors.
+	Name string
+	// Expression is the CEL expression, which must evaluate to a bool.
+	Expression string
+}
+
+const (
+	// maxRequestNameLength bounds the names, namespaces, groups, versions, kinds and resources of
+	// a request, which are DNS subdomains or shorter.
+	maxRequestNameLength = 253
+	// maxUserInfoLength, maxUserInfoGroups and maxUserInfoExtra bound the user of a request.
+	// Kubernetes does not bound them, so they are estimates that make the cost of conditions that
+	// iterate over the user's groups or extra attributes predictable. Larger values are still
+	// evaluated, and their cost is limited at runtime.
+	maxUserInfoLength = 1024
+	maxUserInfoGroups = 64
+	maxUserInfoExtra  = 16
+)
+
+// newRequestDecl returns the declared type of the request variable: the attributes of an
+// admission request, other than its objects and options. It is the request type of Kubernetes
+// validating admission policies, with the sizes of strings, lists and maps bounded so that the
+// cost of conditions that access the request can be estimated.
+func newRequestDecl() *common.DeclType {
+	field := func(name string, declType *common.DeclType, required bool) *common.DeclField {
+		return common.NewDeclField(name, declType, required, nil, nil)
+	}
+	fields := func(fields ...*common.DeclField) map[string]*common.DeclField {
+		result := make(map[string]*common.DeclField, len(fields))
+		for _, f := range fields {
+			result[f.Name] = f
+		}
+		return result
+	}
+	stringType := func(maxLength int64) *common.DeclType {
+		t := common.NewSimpleTypeWithMinSize("string", cel.StringType, types.String(""), apiservercel.MinStringSize)
+		t.MaxElements = maxLength
+		return t
+	}
+	name := stringType(maxRequestNameLength)
+	user := stringType(maxUserInfoLength)
+	gvkType := common.NewObjectType(nil, "kubernetes.GroupVersionKind", fields(
+		field("group", name, true),
+		field("version", name, true),
+		field("kind", name, true),
+	))
+	gvrType := common.NewObjectType(nil, "kubernetes.GroupVersionResource", fields(
+		field("group", name, true),
+		field("version", name, true),
+		field("resource", name, true),
+	))
+	userInfoType := common.NewObjectType(nil, "kubernetes.UserInfo", fields(
+		field("username", user, false),
+		field("uid", user, false),
+		field("groups", common.NewListType(nil, user, maxUserInfoGroups), false),
+		field("extra", common.NewMapType(nil, name, common.NewListType(nil, user, maxUserInfoGroups), maxUserInfoExtra), false),
+	))
+	return common.NewObjectType(nil, "kubernetes.AdmissionRequest", fields(
+		field("uid", name, true),
+		field("kind", gvkType, true),
+		field("resource", gvrType, true),
+		field("subResource", name, false),
+		field("requestKind", gvkType, true),
+		field("requestResource", gvrType, true),
+		field("requestSubResource", name, false),
+		field("name", name, true),
+		field("namespace", name, false),
+		field("operation", name, true),
+		field("userInfo", userInfoType, true),
+		field("dryRun", common.BoolType, false),
+	))
+}
+
+// MatchFailurePolicy is what happens when a match condition fails to evaluate.
+type MatchFailurePolicy string
+
+const (
+	// MatchFailurePolicyFail fails the mutation or conversion.
+	MatchFailurePolicyFail MatchFailurePolicy = "Fail"
+	// MatchFailurePolicyIgnore skips the mutation or conversion, as if the condition were false.
+	MatchFailurePolicyIgnore MatchFailurePolicy = "Ignore"
+)
+
+// WithMatchConditions gates a mutation or conversion on the conditions. A mutation is skipped,
+// leaving the object unchanged, if any condition evaluates to false. A conversion whose
+// conditions are not all true converts objects only by projecting them onto the fields that are
+// compatible with the to version, without its expression or template.
+//
+// Conditions may access oldObject, params and, for conversions, convertedObject. They may also
+// access request, the attributes of the admission request that the object is mutated for, other
+// than its objects and options, which is null unless given to ApplyWithRequest. request is declared
+// with the fields of an admission request, and with bounded sizes so that the cost of conditions
+// that iterate over them, such as request.userInfo.groups, can be estimated.
+//
+// If a condition fails to evaluate and no condition is false, the failure policy decides whether
+// the mutation or conversion fails or is skipped.
+func WithMatchConditions(failurePolicy MatchFailurePolicy, conditions ...MatchCondition) CompileOption {
+	return func(o *compileOptions) {
+		o.matchConditions = conditions
+		o.matchFailurePolicy = failurePolicy
+	}
+}
+
+// matchConditions are the compiled match conditions of a mutation or conversion.
+type matchConditions struct {
+	names         []string
+	conditions    []*compiledExpression
+	failurePolicy MatchFailurePolicy
+}
+
+// compileMatchConditions compiles the conditions in the environment, with the request variable
+// added. It returns nil if there are no conditions. The request type must have been registered
+// with the environment as requestDecl.
+func (e *compileEnv) compileMatchConditions(conditions []MatchCondition, failurePolicy MatchFailurePolicy) (*matchConditions, error) {
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	path := field.NewPath("matchConditions")
+	switch failurePolicy {
+	case MatchFailurePolicyFail, MatchFailurePolicyIgnore:
+	default:
+		return nil, compileError("", nil, "unsupported match condition failure policy %q, must be one of: %s, %s", failurePolicy, MatchFailurePolicyFail, MatchFailurePolicyIgnore)
+	}
+	env, err := e.env.Extend(cel.Variable(requestVar, celType(e.requestDecl)))
+	if err != nil {
+		return nil, newError(ErrorTypeCompile, "", path, err)
+	}
+	decls := e.varDecls()
+	decls[requestVar] = e.requestDecl
+	result := &matchConditions{failurePolicy: failurePolicy}
+	names := map[string]bool{}
+	for i, condition := range conditions {
+		switch {
+		case len(condition.Name) == 0:
+			return nil, compileError("", path.Index(i).Child("name"), "match conditions must have a name")
+		case names[condition.Name]:
+			return nil, compileError("", path.Index(i).Child("name"), "duplicate match condition %q", condition.Name)
+		}
+		names[condition.Name] = true
+		compiled, err := e.compile(env, decls, condition.Expression, cel.BoolType, path.Index(i).Child("expression"))
+		if err != nil {
+			return nil, err
+		}
+		result.names = append(result.names, condition.Name)
+		result.conditions = append(result.conditions, compiled)
+	}
+	return result, nil
+}
+
+// matches returns true if all the conditions are true. The conditions are evaluated in order, and
+// the first condition that is false short-circuits the evaluation: the mutation or conversion is
+// skipped, even if earlier conditions failed with errors. Errors are only returned, or ignored by
+// the failure policy, if no condition is false. Exceeding the cost budget is always an error. A
+// nil matchConditions always matches.
+func (m *matchConditions) matches(oldObject, convertedObject, request any, budget *costBudget) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+	requestVal := ref.Val(types.NullValue)
+	if request != nil {
+		requestVal = types.DefaultTypeAdapter.NativeToValue(request)
+	}
+	var failed error
+	for i, c := range m.conditions {
+		activation := c.activation(oldObject, convertedObject)
+		activation.request = requestVal
+		v, err := c.evalActivation(activation, budget)
+		if err == nil {
+			matched, ok := v.(bool)
+			if ok && !matched {
+				return false, nil
+			}
+			if !ok {
+				err = newError(ErrorTypeEvaluation, c.expression, c.path, fmt.Errorf("expected match condition to evaluate to a bool, but got %T", v))
+			}
+		}
+		if err != nil {
+			var applyErr *Error
+			if errors.As(err, &applyErr) && applyErr.Type == ErrorTypeCost {
+				// Exceeding the cost budget is never ignored.
+				return false, err
+			}
+			if failed == nil {
+				failed = fmt.Errorf("match condition %q failed: %w", m.names[i], err)
+			}
+		}
+	}
+	if failed != nil {
+		if m.failurePolicy == MatchFailurePolicyIgnore {
+			return false, nil
+		}
+		return false, failed
+	}
+	return true, nil
+}
+
+// estimatedCost returns the sum of the estimated costs of the conditions.
+func (m *matchConditions) estimatedCost() uint64 {
+	if m == nil {
+		return 0
+	}
+	var sum uint64
+	for _, c := range m.conditions {
+		sum = addCost(sum, c.estimatedCost)
+	}
+	return sum
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+func TestMatchConditions(t *testing.T) {
+	schema := loadTestSchema()
+	setName := map[string]any{"mutation": `Object{spec: Object.spec{deploymentName: "default"}}`}
+	notPresent := MatchCondition{Name: "not-present", Expression: "!has(oldObject.spec.deploymentName)"}
+	create := MatchCondition{Name: "create", Expression: `request.operation == "CREATE"`}
+	cases := []struct {
+		name          string
+		conditions    []MatchCondition
+		failurePolicy MatchFailurePolicy
+		object        string
+		request       any
+		expectedSpec  string
+		expectedError string
+	}{
+		{
+			name:         "conditions are true",
+			conditions:   []MatchCondition{notPresent},
+			object:       `{spec: {replicas: 1}}`,
+			expectedSpec: `{replicas: 1, deploymentName: default}`,
+		},
+		{
+			name:         "a false condition skips the mutation",
+			conditions:   []MatchCondition{notPresent},
+			object:       `{spec: {replicas: 1, deploymentName: custom}}`,
+			expectedSpec: `{replicas: 1, deploymentName: custom}`,
+		},
+		{
+			name:         "request attributes",
+			conditions:   []MatchCondition{notPresent, create},
+			object:       `{spec: {replicas: 1}}`,
+			request:      map[string]any{"operation": "CREATE"},
+			expectedSpec: `{replicas: 1, deploymentName: default}`,
+		},
+		{
+			name:         "request attributes do not match",
+			conditions:   []MatchCondition{create},
+			object:       `{spec: {replicas: 1}}`,
+			request:      map[string]any{"operation": "UPDATE"},
+			expectedSpec: `{replicas: 1}`,
+		},
+		{
+			name:          "errors fail the mutation",
+			conditions:    []MatchCondition{create},
+			failurePolicy: MatchFailurePolicyFail,
+			object:        `{spec: {replicas: 1}}`,
+			expectedError: `match condition "create" failed: evaluation error at matchConditions[0].expression: no such key: operation`,
+		},
+		{
+			name:          "errors are ignored",
+			conditions:    []MatchCondition{create},
+			failurePolicy: MatchFailurePolicyIgnore,
+			object:        `{spec: {replicas: 1}}`,
+			expectedSpec:  `{replicas: 1}`,
+		},
+		{
+			name:          "false conditions take precedence over errors",
+			conditions:    []MatchCondition{create, notPresent},
+			failurePolicy: MatchFailurePolicyFail,
+			object:        `{spec: {replicas: 1, deploymentName: custom}}`,
+			expectedSpec:  `{replicas: 1, deploymentName: custom}`,
+		},
+		{
+			name:          "conditions must evaluate to a bool",
+			conditions:    []MatchCondition{{Name: "dyn", Expression: "dyn(request.userInfo.username)"}},
+			failurePolicy: MatchFailurePolicyFail,
+			object:        `{spec: {replicas: 1}}`,
+			request:       map[string]any{"userInfo": map[string]any{"username": "admin"}},
+			expectedError: `match condition "dyn" failed: evaluation error at matchConditions[0].expression: expected match condition to evaluate to a bool, but got string`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			failurePolicy := tc.failurePolicy
+			if len(failurePolicy) == 0 {
+				failurePolicy = MatchFailurePolicyFail
+			}
+			compiled, err := CompileMutateBasicMerge(&schema, setName, WithMatchConditions(failurePolicy, tc.conditions...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := compiled.ApplyWithRequest(yamlValue(t, tc.object), tc.request)
+			if len(tc.expectedError) > 0 {
+				if err == nil || err.Error() != tc.expectedError {
+					t.Errorf("expected error %q but got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := yamlValue(t, tc.expectedSpec); !reflect.DeepEqual(expected, result.(map[string]any)["spec"]) {
+				t.Errorf("expected spec %v but got %v", expected, result.(map[string]any)["spec"])
+			}
+		})
+	}
+
+	t.Run("template", func(t *testing.T) {
+		patch := map[string]any{"spec": map[string]any{"deploymentName": map[string]any{"$": `"default"`}}}
+		compiled, err := CompileMutateWithTemplate(&schema, patch, WithMatchConditions(MatchFailurePolicyFail, notPresent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := yamlValue(t, `{spec: {deploymentName: custom}}`)
+		result, err := compiled.Apply(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(obj, result) {
+			t.Errorf("expected the mutation to be skipped but got %v", result)
+		}
+	})
+
+	t.Run("conversion", func(t *testing.T) {
+		v2schema := loadTestYaml[spec.Schema](filepath.Join(testdata, "v2schema.yaml"))
+		patch := map[string]any{"mutation": "Object{spec: Object.spec{copies: oldObject.spec.replicas}}"}
+		scaled := MatchCondition{Name: "scaled", Expression: "oldObject.spec.replicas > 1"}
+		compiled, err := CompileConvertBasicMerge(&schema, &v2schema, patch, WithMatchConditions(MatchFailurePolicyFail, scaled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct{ object, expectedSpec string }{
+			{object: `{spec: {replicas: 2, deploymentName: d}}`, expectedSpec: `{copies: 2, deploymentName: d}`},
+			{object: `{spec: {replicas: 1, deploymentName: d}}`, expectedSpec: `{deploymentName: d}`},
+		} {
+			result, err := compiled.Apply(yamlValue(t, tc.object))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := yamlValue(t, tc.expectedSpec); !reflect.DeepEqual(expected, result.(map[string]any)["spec"]) {
+				t.Errorf("expected spec %v but got %v", expected, result.(map[string]any)["spec"])
+			}
+		}
+	})
+
+	t.Run("pipeline steps are skipped", func(t *testing.T) {
+		compiled, err := CompileMutateBasicMerge(&schema, setName, WithMatchConditions(MatchFailurePolicyFail, create))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewPipeline(PipelineStep{Name: "set", Mutation: compiled})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := p.ApplyWithRequest(yamlValue(t, `{spec: {replicas: 1}}`), map[string]any{"operation": "DELETE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step := result.Steps[0]; !step.Skipped || step.Changed {
+			t.Errorf("expected the step to be skipped but got %+v", step)
+		}
+	})
+
+	for _, tc := range []struct {
+		name          string
+		failurePolicy MatchFailurePolicy
+		conditions    []MatchCondition
+		expectedError string
+	}{
+		{
+			name:          "name required",
+			conditions:    []MatchCondition{{Expression: "true"}},
+			expectedError: "compile error at matchConditions[0].name: match conditions must have a name",
+		},
+		{
+			name:          "duplicate name",
+			conditions:    []MatchCondition{notPresent, notPresent},
+			expectedError: `compile error at matchConditions[1].name: duplicate match condition "not-present"`,
+		},
+		{
+			name:          "not a bool",
+			conditions:    []MatchCondition{{Name: "replicas", Expression: "oldObject.spec.replicas"}},
+			expectedError: "compile error at matchConditions[0].expression: expected expression to evaluate to bool, but got int",
+		},
+		{
+			name:          "unsupported failure policy",
+			failurePolicy: "Retry",
+			conditions:    []MatchCondition{notPresent},
+			expectedError: `compile error: unsupported match condition failure policy "Retry", must be one of: Fail, Ignore`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failurePolicy := tc.failurePolicy
+			if len(failurePolicy) == 0 {
+				failurePolicy = MatchFailurePolicyFail
+			}
+			_, err := CompileMutateBasicMerge(&schema, setName, WithMatchConditions(failurePolicy, tc.conditions...))
+			if err == nil || err.Error() != tc.expectedError {
+				t.Errorf("expected error %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestMatchConditionsIterateRequest(t *testing.T) {
+	schema := loadTestSchema()
+	setName := map[string]any{"mutation": `Object{spec: Object.spec{deploymentName: "default"}}`}
+	// The sizes of the request's fields are bounded, so conditions that iterate over them have an
+	// estimated cost within the limit of CustomResourceDefinition validation rules.
+	admins := MatchCondition{Name: "admins", Expression: `request.userInfo.groups.exists(g, g == "admins") && request.userInfo.extra.all(k, request.userInfo.extra[k].all(v, v.startsWith(k)))`}
+	compiled, err := CompileMutateBasicMerge(&schema, setName,
+		WithEstimatedCostLimit(StaticEstimatedCostLimit),
+		WithMatchConditions(MatchFailurePolicyFail, admins))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		groups   []any
+		expected string
+	}{
+		{groups: []any{"dev", "admins"}, expected: `{replicas: 1, deploymentName: default}`},
+		{groups: []any{"dev"}, expected: `{replicas: 1}`},
+	} {
+		request := map[string]any{"userInfo": map[string]any{"username": "alice", "groups": tc.groups, "extra": map[string]any{"scope": []any{"scope:read"}}}}
+		result, err := compiled.ApplyWithRequest(yamlValue(t, `{spec: {replicas: 1}}`), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := yamlValue(t, tc.expected); !reflect.DeepEqual(expected, result.(map[string]any)["spec"]) {
+			t.Errorf("expected spec %v for groups %v but got %v", expected, tc.groups, result.(map[string]any)["spec"])
+		}
+	}
+}
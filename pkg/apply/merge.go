@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"k8s.io/kube-openapi/pkg/schemaconv"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/structured-merge-diff/v4/merge"
+	smdschema "sigs.k8s.io/structured-merge-diff/v4/schema"
+	"sigs.k8s.io/structured-merge-diff/v4/typed"
+)
+
+// Merger performs server side apply style merges of apply configurations into objects of a
+// single schema. The schema is converted to structured-merge-diff types once, when the Merger
+// is constructed, so a Merger should be reused for all merges against the same schema.
+// A Merger is safe for concurrent use.
+type Merger struct {
+	parser *typed.Parser
+}
+
+// NewMerger returns a Merger for objects of the schema. If preserveUnknownFields is true,
+// apply configurations may add unrecognized fields, otherwise adding unrecognized fields will
+// result in an error.
+func NewMerger(s *spec.Schema, preserveUnknownFields bool) (*Merger, error) {
+	specSchema, err := schemaconv.ToSchemaFromOpenAPI(map[string]*spec.Schema{"root": s}, preserveUnknownFields)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, err)
+	}
+	return &Merger{parser: &typed.Parser{Schema: smdschema.Schema{Types: specSchema.Types}}}, nil
+}
+
+// mergerKey identifies the Mergers cached by cachedMerger.
+type mergerKey struct {
+	schema                *spec.Schema
+	preserveUnknownFields bool
+}
+
+// mergers caches the Mergers of schemas that are merged without a compiled mutation or
+// conversion, by mergerKey.
+var mergers sync.Map
+
+// cachedMerger returns the Merger for objects of the schema, creating it on first use. Schemas are
+// identified by pointer, so they must not be modified after they are first merged with.
+func cachedMerger(s *spec.Schema, preserveUnknownFields bool) (*Merger, error) {
+	key := mergerKey{schema: s, preserveUnknownFields: preserveUnknownFields}
+	if m, ok := mergers.Load(key); ok {
+		return m.(*Merger), nil
+	}
+	m, err := NewMerger(s, preserveUnknownFields)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := mergers.LoadOrStore(key, m)
+	return actual.(*Merger), nil
+}
+
+// Merge performs a server side apply style merge of the patch (apply configuration) to the obj.
+func (m *Merger) Merge(obj, patch any) (any, error) {
+	t := m.parser.Type("root")
+	objT, err := t.FromUnstructured(obj)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, fmt.Errorf("object does not match schema: %w", err))
+	}
+	patchT, err := t.FromUnstructured(patch)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, fmt.Errorf("apply configuration does not match schema: %w", err))
+	}
+	result, err := objT.Merge(patchT)
+	if err != nil {
+		return nil, newError(ErrorTypeMerge, "", nil, err)
+	}
+	return result.AsValue().Unstructured(), nil
+}
+
+// MergeAsManager performs a server side apply of the patch (apply configuration) to the obj as
+// the named field manager, using the managers and field sets recorded in the obj's
+// metadata.managedFields. Unlike Merge, fields that the manager owned from a previous apply but
+// that are no longer in the patch are removed, unless another manager also owns them. The
+// managedFields of the result record the fields owned by each manager after the apply.
+//
+// Fields owned by other managers are overridden by the patch, and the other managers lose
+// ownership of them. Use ApplyAsManager to detect conflicts instead.
+func (m *Merger) MergeAsManager(obj, patch any, manager string) (any, error) {
+	return m.ApplyAsManager(obj, patch, manager, true)
+}
+
+// ApplyAsManager is MergeAsManager with conflict detection. If force is false and the patch
+// changes the value of fields owned by other managers, an *Error of type ErrorTypeConflict is
+// returned that wraps a *ConflictError listing the fields and their managers, and obj is not
+// mutated. If force is true, the conflicting fields are overridden, as with MergeAsManager.
+func (m *Merger) ApplyAsManager(obj, patch any, manager string, force bool) (any, error) {
+	if len(manager) == 0 {
+		return nil, newError(ErrorTypeMerge, "", nil, fmt.Errorf("field manager name must not be empty"))
+	}
+	live, managed, err := splitManagedFields(obj)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, err)
+	}
+	patch, _, err = splitManagedFields(patch)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, err)
+	}
+	t := m.parser.Type("root")
+	liveT, err := t.FromUnstructured(live)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, fmt.Errorf("object does not match schema: %w", err))
+	}
+	patchT, err := t.FromUnstructured(patch)
+	if err != nil {
+		return nil, newError(ErrorTypeSchema, "", nil, fmt.Errorf("apply configuration does not match schema: %w", err))
+	}
+
+	version := objectVersion(obj, patch)
+	entry, id, err := applierEntry(manager, version)
+	if err != nil {
+		return nil, newError(ErrorTypeMerge, "", nil, err)
+	}
+	updater := &merge.Updater{Converter: sameSchemaConverter{}}
+	result, managers, err := updater.Apply(liveT, patchT, version, managed.managers.Copy(), id, force)
+	if err != nil {
+		var conflicts merge.Conflicts
+		if errors.As(err, &conflicts) {
+			return nil, newError(ErrorTypeConflict, "", nil, managed.conflictError(conflicts))
+		}
+		return nil, newError(ErrorTypeMerge, "", nil, err)
+	}
+	if result == nil {
+		// The apply did not change the object.
+		result = liveT
+	}
+	stripManagedFields(managers)
+	entries, err := managed.encode(managers, id, entry)
+	if err != nil {
+		return nil, newError(ErrorTypeMerge, "", nil, err)
+	}
+	return withManagedFields(result.AsValue().Unstructured(), entries), nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"github.com/google/cel-go/common/types/ref"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// CompileOption configures the compilation of a mutation or conversion.
+type CompileOption func(*compileOptions)
+
+type compileOptions struct {
+	params       any
+	hasParams    bool
+	fieldManager string
+	// force is true if mutations with a field manager override fields owned by other managers.
+	force              bool
+	matchConditions    []MatchCondition
+	matchFailurePolicy MatchFailurePolicy
+	// estimatedCostLimit is the maximum estimated cost of an expression, or 0 if it is unlimited.
+	estimatedCostLimit uint64
+}
+
+// WithParams makes params available to the expressions of a mutation or conversion as the params
+// variable. params must be an unstructured value, such as one decoded from JSON or YAML. Its type
+// is inferred from the value itself, with the maximum lengths of strings and lists set to their
+// actual lengths, so the cost of expressions that iterate over params can be estimated. Lists of
+// params must not mix items of different types, and params must not contain nulls.
+func WithParams(params any) CompileOption {
+	return func(o *compileOptions) {
+		o.params = params
+		o.hasParams = true
+	}
+}
+
+// WithFieldManager makes a mutation merge its apply configuration into objects as the named field
+// manager, using Merger.ApplyAsManager, so that fields the manager set when it previously mutated
+// an object, but no longer sets, are removed. A mutation that would change fields owned by other
+// managers fails with an error of type ErrorTypeConflict, unless WithForce is also given. It has
+// no effect on mutations that apply their result using objects.apply(), or on conversions.
+func WithFieldManager(manager string) CompileOption {
+	return func(o *compileOptions) {
+		o.fieldManager = manager
+	}
+}
+
+// WithForce makes a mutation with a field manager override the fields owned by other field
+// managers, and take over their ownership, as a forced server side apply does, instead of failing
+// with an error of type ErrorTypeConflict.
+func WithForce() CompileOption {
+	return func(o *compileOptions) {
+		o.force = true
+	}
+}
+
+// WithEstimatedCostLimit sets the limit above which the estimated worst case cost of an expression
+// is rejected with an error of type ErrorTypeCost when it is compiled. It defaults to
+// StaticEstimatedCostLimit, as for the validation rules of CustomResourceDefinitions. The estimate
+// uses the maxItems, maxProperties and maxLength of the schema to bound the size of values, and is
+// very large for expressions that iterate over values that are not bounded by the schema, such as
+// the lists of built-in types. A limit of 0 disables the check. The runtime cost limit and budget
+// always apply.
+func WithEstimatedCostLimit(limit uint64) CompileOption {
+	return func(o *compileOptions) {
+		o.estimatedCostLimit = limit
+	}
+}
+
+func newCompileOptions(opts []CompileOption) *compileOptions {
+	o := &compileOptions{estimatedCostLimit: StaticEstimatedCostLimit}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// paramsVal returns the declared type and CEL value of the params, or nil if there are none.
+func (o *compileOptions) paramsVal() (*common.DeclType, ref.Val, error) {
+	if !o.hasParams {
+		return nil, nil, nil
+	}
+	schema, err := inferSchema(o.params, field.NewPath(paramsVar))
+	if err != nil {
+		return nil, nil, err
+	}
+	s := newSchemaNode(schema)
+	decl := common.SchemaDeclType(s, false).MaybeAssignTypeName(paramsTypeName)
+	return decl, common.UnstructuredToVal(o.params, s), nil
+}
+
+// inferSchema returns a schema that the unstructured value v conforms to. The items of a list are
+// given the union of the schemas of all the items, and must all be of the same type.
+func inferSchema(v any, path *field.Path) (*spec.Schema, error) {
+	s := &spec.Schema{}
+	switch v := v.(type) {
+	case map[string]any:
+		s.Type = spec.StringOrArray{"object"}
+		s.Properties = make(map[string]spec.Schema, len(v))
+		for k, value := range v {
+			prop, err := inferSchema(value, path.Child(k))
+			if err != nil {
+				return nil, err
+			}
+			s.Properties[k] = *prop
+		}
+	case []any:
+		s.Type = spec.StringOrArray{"array"}
+		n := int64(len(v))
+		s.MaxItems = &n
+		// The items of an empty list are never accessed, so any type will do.
+		items := &spec.Schema{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"string"}, MaxLength: new(int64)}}
+		for i, item := range v {
+			itemSchema, err := inferSchema(item, path.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				items = itemSchema
+			} else if items, err = unionSchema(items, itemSchema, path.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		s.Items = &spec.SchemaOrArray{Schema: items}
+	case string:
+		s.Type = spec.StringOrArray{"string"}
+		n := int64(len(v))
+		s.MaxLength = &n
+	case bool:
+		s.Type = spec.StringOrArray{"boolean"}
+	case int, int32, int64:
+		s.Type = spec.StringOrArray{"integer"}
+	case float32, float64:
+		s.Type = spec.StringOrArray{"number"}
+	case nil:
+		return nil, schemaError(path, "params may not contain null values")
+	default:
+		return nil, schemaError(path, "unsupported params value of type %T", v)
+	}
+	return s, nil
+}
+
+// unionSchema returns a schema that the values of both a and b conform to. a and b must be of the
+// same type.
+func unionSchema(a, b *spec.Schema, path *field.Path) (*spec.Schema, error) {
+	if a.Type[0] != b.Type[0] {
+		return nil, schemaError(path, "the items of a params list must all be of the same type, but got %s and %s", a.Type[0], b.Type[0])
+	}
+	switch a.Type[0] {
+	case "object":
+		for k, prop := range b.Properties {
+			if existing, ok := a.Properties[k]; ok {
+				union, err := unionSchema(&existing, &prop, path.Child(k))
+				if err != nil {
+					return nil, err
+				}
+				prop = *union
+			}
+			a.Properties[k] = prop
+		}
+	case "array":
+		switch {
+		case *a.MaxItems == 0:
+			a.Items = b.Items
+		case *b.MaxItems > 0:
+			items, err := unionSchema(a.Items.Schema, b.Items.Schema, path)
+			if err != nil {
+				return nil, err
+			}
+			a.Items.Schema = items
+		}
+		a.MaxItems = maxOf(a.MaxItems, b.MaxItems)
+	case "string":
+		a.MaxLength = maxOf(a.MaxLength, b.MaxLength)
+	}
+	return a, nil
+}
+
+func maxOf(a, b *int64) *int64 {
+	if *a >= *b {
+		return a
+	}
+	return b
+}
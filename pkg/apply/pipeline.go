@@ -0,0 +1,146 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ReinvocationPolicy is whether a step of a Pipeline is applied again when the steps after it
+// change the object, as with the reinvocationPolicy of mutating admission webhooks.
+type ReinvocationPolicy string
+
+const (
+	// ReinvocationNever applies a step once.
+	ReinvocationNever ReinvocationPolicy = "Never"
+	// ReinvocationIfNeeded applies a step a second time, at most, if the object was changed after
+	// the step was first applied.
+	ReinvocationIfNeeded ReinvocationPolicy = "IfNeeded"
+)
+
+// PipelineStep is a mutation of a Pipeline.
+type PipelineStep struct {
+	// Name identifies the step in results and errors.
+	Name string
+	// Mutation is the mutation of the step.
+	Mutation *CompiledMutation
+	// Reinvocation is whether the step is applied again when later steps change the object.
+	// Defaults to ReinvocationNever.
+	Reinvocation ReinvocationPolicy
+}
+
+// Pipeline applies an ordered list of mutations of the same schema to objects, each mutation to
+// the result of the previous one. After all the steps are applied, if the object was changed
+// after a step with the ReinvocationIfNeeded policy was applied, the step is applied again, in
+// the order of the steps, so that it sees the changes of the later steps. Each step is reapplied
+// at most once, so a Pipeline always terminates, even if its steps undo each other's changes.
+// A Pipeline is safe for concurrent use.
+type Pipeline struct {
+	steps []PipelineStep
+}
+
+// NewPipeline returns a Pipeline of the steps.
+func NewPipeline(steps ...PipelineStep) (*Pipeline, error) {
+	for i, step := range steps {
+		if step.Mutation == nil {
+			return nil, fmt.Errorf("step %d (%q) has no mutation", i, step.Name)
+		}
+		switch step.Reinvocation {
+		case "", ReinvocationNever, ReinvocationIfNeeded:
+		default:
+			return nil, fmt.Errorf("step %d (%q) has unsupported reinvocation policy %q", i, step.Name, step.Reinvocation)
+		}
+	}
+	return &Pipeline{steps: steps}, nil
+}
+
+// PipelineResult is the result of applying a Pipeline to an object.
+type PipelineResult struct {
+	// Object is the object after all the steps were applied. If a step failed, it is the object
+	// before the failed step.
+	Object any
+	// Steps are the results of the steps, in the order they were applied, including reinvocations.
+	Steps []StepResult
+}
+
+// StepResult is the result of applying a step of a Pipeline.
+type StepResult struct {
+	// Name is the name of the step.
+	Name string
+	// Reinvoked is true if the step was applied a second time.
+	Reinvoked bool
+	// Skipped is true if the match conditions of the mutation were not all true.
+	Skipped bool
+	// Changed is true if the step changed the object.
+	Changed bool
+	// Object is the object after the step was applied, or nil if the step failed.
+	Object any
+	// Err is why the step failed.
+	Err error
+}
+
+// Apply applies the steps of the pipeline to obj. If a step fails, no more steps are applied, and
+// the result so far is returned with an error that wraps the error of the step.
+func (p *Pipeline) Apply(obj any) (*PipelineResult, error) {
+	return p.ApplyWithRequest(obj, nil)
+}
+
+// ApplyWithRequest is Apply with request as the request variable of the match conditions of the
+// mutations. Steps whose match conditions are not all true are skipped, leaving the object
+// unchanged, and may still be reinvoked.
+func (p *Pipeline) ApplyWithRequest(obj, request any) (*PipelineResult, error) {
+	result := &PipelineResult{Object: obj}
+	// changes counts the changes made to the object, and invokedAt is the count when each step
+	// was last applied, so that steps can be reapplied if the object changed after them.
+	changes := 0
+	invokedAt := make([]int, len(p.steps))
+	apply := func(i int, reinvoked bool) error {
+		step := p.steps[i]
+		invokedAt[i] = changes
+		mutated, matched, err := step.Mutation.apply(result.Object, request)
+		stepResult := StepResult{Name: step.Name, Reinvoked: reinvoked, Skipped: err == nil && !matched, Err: err}
+		if err == nil {
+			stepResult.Object = mutated
+			stepResult.Changed = !reflect.DeepEqual(result.Object, mutated)
+		}
+		result.Steps = append(result.Steps, stepResult)
+		if err != nil {
+			return fmt.Errorf("step %q failed: %w", step.Name, err)
+		}
+		if stepResult.Changed {
+			changes++
+			invokedAt[i] = changes
+		}
+		result.Object = mutated
+		return nil
+	}
+
+	for i := range p.steps {
+		if err := apply(i, false); err != nil {
+			return result, err
+		}
+	}
+	for i, step := range p.steps {
+		if step.Reinvocation == ReinvocationIfNeeded && invokedAt[i] < changes {
+			if err := apply(i, true); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	schema := loadTestSchema()
+	compile := func(expression string) *CompiledMutation {
+		t.Helper()
+		m, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": expression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	label := compile(`Object{metadata: Object.metadata{labels: {"replicas": string(oldObject.spec.replicas)}}}`)
+	scale := compile(`Object{spec: Object.spec{replicas: 3}}`)
+	increment := compile(`Object{spec: Object.spec{replicas: oldObject.spec.replicas + 1}}`)
+	fail := compile(`Object{spec: Object.spec{replicas: oldObject.spec.replicas / 0}}`)
+
+	cases := []struct {
+		name  string
+		steps []PipelineStep
+		// expectedSteps are the names of the steps applied, with a * for reinvocations and a + for
+		// steps that changed the object.
+		expectedSteps []string
+		expectedSpec  string
+		// expectedLabel is the replicas label of the result.
+		expectedLabel string
+		expectedError string
+	}{
+		{
+			name:          "steps are applied in order",
+			steps:         []PipelineStep{{Name: "scale", Mutation: scale}, {Name: "label", Mutation: label}},
+			expectedSteps: []string{"scale+", "label+"},
+			expectedSpec:  `{replicas: 3}`,
+			expectedLabel: "3",
+		},
+		{
+			name:          "steps are not reinvoked by default",
+			steps:         []PipelineStep{{Name: "label", Mutation: label}, {Name: "scale", Mutation: scale}},
+			expectedSteps: []string{"label+", "scale+"},
+			expectedSpec:  `{replicas: 3}`,
+			expectedLabel: "1",
+		},
+		{
+			name:          "steps are reinvoked if needed",
+			steps:         []PipelineStep{{Name: "label", Mutation: label, Reinvocation: ReinvocationIfNeeded}, {Name: "scale", Mutation: scale}},
+			expectedSteps: []string{"label+", "scale+", "label*+"},
+			expectedSpec:  `{replicas: 3}`,
+			expectedLabel: "3",
+		},
+		{
+			name:          "steps are not reinvoked if the object did not change after them",
+			steps:         []PipelineStep{{Name: "scale", Mutation: scale, Reinvocation: ReinvocationIfNeeded}, {Name: "scale again", Mutation: scale}},
+			expectedSteps: []string{"scale+", "scale again"},
+			expectedSpec:  `{replicas: 3}`,
+		},
+		{
+			name: "steps are reinvoked at most once",
+			steps: []PipelineStep{
+				{Name: "first", Mutation: increment, Reinvocation: ReinvocationIfNeeded},
+				{Name: "second", Mutation: increment, Reinvocation: ReinvocationIfNeeded},
+			},
+			expectedSteps: []string{"first+", "second+", "first*+", "second*+"},
+			expectedSpec:  `{replicas: 5}`,
+		},
+		{
+			name:          "failed steps stop the pipeline",
+			steps:         []PipelineStep{{Name: "scale", Mutation: scale}, {Name: "fail", Mutation: fail}, {Name: "label", Mutation: label}},
+			expectedSteps: []string{"scale+", "fail"},
+			expectedSpec:  `{replicas: 3}`,
+			expectedError: `step "fail" failed: evaluation error: division by zero`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPipeline(tc.steps...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := yamlValue(t, `{metadata: {name: w}, spec: {replicas: 1}}`)
+			result, err := p.Apply(obj)
+			if len(tc.expectedError) > 0 {
+				if err == nil || err.Error() != tc.expectedError {
+					t.Errorf("expected error %q but got %v", tc.expectedError, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var steps []string
+			for _, s := range result.Steps {
+				name := s.Name
+				if s.Reinvoked {
+					name += "*"
+				}
+				if s.Changed {
+					name += "+"
+				}
+				steps = append(steps, name)
+			}
+			if !reflect.DeepEqual(tc.expectedSteps, steps) {
+				t.Errorf("expected steps %v but got %v", tc.expectedSteps, steps)
+			}
+			final := result.Object.(map[string]any)
+			if expected := yamlValue(t, tc.expectedSpec); !reflect.DeepEqual(expected, final["spec"]) {
+				t.Errorf("expected spec %v but got %v", expected, final["spec"])
+			}
+			labels, _ := final["metadata"].(map[string]any)["labels"].(map[string]any)
+			if label, _ := labels["replicas"].(string); label != tc.expectedLabel {
+				t.Errorf("expected replicas label %q but got %q", tc.expectedLabel, label)
+			}
+		})
+	}
+}
+
+func TestNewPipelineErrors(t *testing.T) {
+	schema := loadTestSchema()
+	m, err := CompileMutateBasicMerge(&schema, map[string]any{"mutation": "Object{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPipeline(PipelineStep{Name: "a"}); err == nil || err.Error() != `step 0 ("a") has no mutation` {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewPipeline(PipelineStep{Name: "a", Mutation: m, Reinvocation: "Always"}); err == nil || err.Error() != `step 0 ("a") has unsupported reinvocation policy "Always"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
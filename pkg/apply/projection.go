@@ -0,0 +1,300 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// metaFields are the fields of a resource, and of an embedded resource, that are kept by
+// projections regardless of the schema.
+var metaFields = map[string]bool{
+	"apiVersion": true,
+	"kind":       true,
+	"metadata":   true,
+}
+
+// projection is the set of fields that are compatible between the schemas of two versions: the
+// fields at the same path in both versions with compatible types and list semantics. Objects of
+// the from version are converted to the to version by projecting them onto the compatible fields,
+// which are copied, and dropping all other fields.
+//
+// A projection is computed once for a pair of schemas, and is safe for concurrent use.
+type projection struct {
+	// typ is the type of the to version, or empty if any value is allowed.
+	typ string
+	// format is the format of the to version's strings.
+	format string
+	// intOrString is true if the to version allows integers and strings.
+	intOrString bool
+	// nullable is true if the to version allows null.
+	nullable bool
+	// properties project the properties of an object. Properties that are not compatible are nil.
+	properties map[string]*projection
+	// additionalProperties, if set, projects the fields of an object that are not properties.
+	additionalProperties *projection
+	// preserveUnknownFields is true if the fields of an object that are not properties are kept.
+	preserveUnknownFields bool
+	// embeddedResource is true if the apiVersion, kind and metadata fields of an object are kept.
+	embeddedResource bool
+	// items projects the items of a list.
+	items *projection
+	// listMapKeys are the keys of a listType=map list. Items that are missing a key are dropped.
+	listMapKeys []string
+}
+
+// newProjection returns the projection from the from schema to the to schema, or nil if no
+// values of the from schema are compatible with the to schema. A nil from schema allows any
+// value, such as the fields of an x-kubernetes-preserve-unknown-fields object, and values are
+// then checked against the to schema when they are projected.
+func newProjection(from, to *spec.Schema) *projection {
+	if to == nil || !compatibleTypes(from, to) || !compatibleListTypes(from, to) {
+		return nil
+	}
+	p := &projection{
+		typ:                   schemaType(to),
+		format:                to.Format,
+		intOrString:           isIntOrString(to),
+		nullable:              to.Nullable,
+		preserveUnknownFields: isPreserveUnknownFields(to),
+		embeddedResource:      isEmbeddedResource(to),
+		listMapKeys:           listMapKeys(to),
+	}
+	if p.intOrString {
+		p.typ = ""
+	}
+	if len(to.Properties) > 0 {
+		p.properties = map[string]*projection{}
+		for name := range to.Properties {
+			toProp := to.Properties[name]
+			// Properties that are not compatible are recorded as nil, so that they are dropped
+			// even if unknown fields are preserved.
+			if fromProp, ok := fromField(from, name); ok {
+				p.properties[name] = newProjection(fromProp, &toProp)
+			} else {
+				p.properties[name] = nil
+			}
+		}
+	}
+	if to.AdditionalProperties != nil && to.AdditionalProperties.Schema != nil {
+		var fromAdditional *spec.Schema
+		if from != nil && from.AdditionalProperties != nil {
+			fromAdditional = from.AdditionalProperties.Schema
+		}
+		if from == nil || fromAdditional != nil || isPreserveUnknownFields(from) {
+			p.additionalProperties = newProjection(fromAdditional, to.AdditionalProperties.Schema)
+		}
+		// The properties of the from version are fields of the additional properties of the to
+		// version.
+		if from != nil && len(from.Properties) > 0 {
+			p.properties = map[string]*projection{}
+			for name := range from.Properties {
+				fromProp := from.Properties[name]
+				p.properties[name] = newProjection(&fromProp, to.AdditionalProperties.Schema)
+			}
+		}
+	}
+	if to.Items != nil && to.Items.Schema != nil {
+		var fromItems *spec.Schema
+		if from != nil && from.Items != nil {
+			fromItems = from.Items.Schema
+		}
+		p.items = newProjection(fromItems, to.Items.Schema)
+	}
+	return p
+}
+
+// fromField returns the schema of the field of objects of the from schema, or nil if the from
+// schema allows any value for the field. It returns false if objects of the from schema do not
+// have the field.
+func fromField(from *spec.Schema, name string) (*spec.Schema, bool) {
+	if from == nil {
+		return nil, true
+	}
+	if prop, ok := from.Properties[name]; ok {
+		return &prop, true
+	}
+	if from.AdditionalProperties != nil && from.AdditionalProperties.Schema != nil {
+		return from.AdditionalProperties.Schema, true
+	}
+	return nil, isPreserveUnknownFields(from) || len(from.Type) == 0
+}
+
+// compatibleTypes returns true if some values of the from schema are valid for the to schema.
+func compatibleTypes(from, to *spec.Schema) bool {
+	if from == nil || isIntOrString(from) || len(from.Type) == 0 {
+		// The values are checked when they are projected.
+		return true
+	}
+	fromType, toType := schemaType(from), schemaType(to)
+	switch {
+	case isIntOrString(to):
+		return fromType == "integer" || fromType == "number" || fromType == "string"
+	case len(toType) == 0 || fromType == toType:
+		return true
+	case fromType == "integer" && toType == "number":
+		return true
+	case fromType == "number" && toType == "integer":
+		// Numbers with integral values are coerced to integers when they are projected, and
+		// other numbers are dropped.
+		return true
+	}
+	return false
+}
+
+// compatibleListTypes returns true if the lists of the from schema have the semantics of the list
+// type of the to schema: the items of a listType=set list of the to version must be unique, and
+// the items of a listType=map list of the to version must have unique keys.
+func compatibleListTypes(from, to *spec.Schema) bool {
+	if from == nil || schemaType(to) != "array" {
+		return true
+	}
+	switch listType(to) {
+	case "set":
+		return listType(from) == "set"
+	case "map":
+		return listType(from) == "map" && reflect.DeepEqual(listMapKeys(from), listMapKeys(to))
+	}
+	return true
+}
+
+// project returns the projection of v onto the compatible fields, and false if v is not
+// compatible at all. The result shares no maps or lists with v. The values that are dropped from
+// within v are recorded in the report, which may be nil, at their paths relative to path.
+func (p *projection) project(v any, isResourceRoot bool, path *field.Path, report *ConversionReport) (any, bool) {
+	if v == nil || p.intOrString {
+		return coerceScalar(v, p.scalarSchema())
+	}
+	switch p.typ {
+	case "object":
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		result := make(map[string]any, len(m))
+		for k, fieldValue := range m {
+			if (isResourceRoot || p.embeddedResource) && metaFields[k] {
+				result[k] = runtime.DeepCopyJSONValue(fieldValue)
+				continue
+			}
+			child, isProperty := p.properties[k]
+			if !isProperty {
+				child = p.additionalProperties
+			}
+			switch {
+			case child != nil:
+				if projected, ok := child.project(fieldValue, false, path.Child(k), report); ok {
+					result[k] = projected
+				} else {
+					report.record(path.Child(k), DropReasonTypeMismatch, fieldValue)
+				}
+			case isProperty:
+				report.record(path.Child(k), DropReasonTypeMismatch, fieldValue)
+			case p.preserveUnknownFields:
+				result[k] = runtime.DeepCopyJSONValue(fieldValue)
+			default:
+				report.record(path.Child(k), DropReasonUnknownField, fieldValue)
+			}
+		}
+		return result, true
+	case "array":
+		l, ok := v.([]any)
+		if !ok {
+			return nil, false
+		}
+		result := make([]any, 0, len(l))
+		for i, item := range l {
+			switch {
+			case p.items == nil:
+				report.record(path.Index(i), DropReasonTypeMismatch, item)
+			case !hasListMapKeys(item, p.listMapKeys):
+				report.record(path.Index(i), DropReasonMissingMapKey, item)
+			default:
+				if projected, ok := p.items.project(item, false, path.Index(i), report); ok {
+					result = append(result, projected)
+				} else {
+					report.record(path.Index(i), DropReasonTypeMismatch, item)
+				}
+			}
+		}
+		return result, true
+	case "":
+		return runtime.DeepCopyJSONValue(v), true
+	default:
+		return coerceScalar(v, p.scalarSchema())
+	}
+}
+
+func (p *projection) scalarSchema() scalarSchema {
+	return scalarSchema{typ: p.typ, format: p.format, intOrString: p.intOrString, nullable: p.nullable}
+}
+
+// hasListMapKeys returns true if item is an object with all the keys.
+func hasListMapKeys(item any, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	m, ok := item.(map[string]any)
+	if !ok {
+		return false
+	}
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func schemaType(s *spec.Schema) string {
+	if len(s.Type) == 0 {
+		return ""
+	}
+	return s.Type[0]
+}
+
+func isIntOrString(s *spec.Schema) bool {
+	v, _ := s.Extensions.GetBool("x-kubernetes-int-or-string")
+	return v
+}
+
+func isPreserveUnknownFields(s *spec.Schema) bool {
+	v, _ := s.Extensions.GetBool("x-kubernetes-preserve-unknown-fields")
+	return v
+}
+
+func isEmbeddedResource(s *spec.Schema) bool {
+	v, _ := s.Extensions.GetBool("x-kubernetes-embedded-resource")
+	return v
+}
+
+func listType(s *spec.Schema) string {
+	v, _ := s.Extensions.GetString("x-kubernetes-list-type")
+	return v
+}
+
+func listMapKeys(s *spec.Schema) []string {
+	if listType(s) != "map" {
+		return nil
+	}
+	keys, _ := s.Extensions.GetStringSlice("x-kubernetes-list-map-keys")
+	return keys
+}
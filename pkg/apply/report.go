@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DropReason is why a value of an object was not carried over by a conversion.
+type DropReason string
+
+const (
+	// DropReasonUnknownField is a field that does not exist in the to version.
+	DropReasonUnknownField DropReason = "UnknownField"
+	// DropReasonTypeMismatch is a value whose type, format, list type or nullability is not
+	// compatible with the field of the to version.
+	DropReasonTypeMismatch DropReason = "TypeMismatch"
+	// DropReasonMissingMapKey is an entry of a listType=map list that is missing a map key of the
+	// to version.
+	DropReasonMissingMapKey DropReason = "MissingMapKey"
+)
+
+// DroppedValue is a value of an object that was not carried over by a conversion.
+type DroppedValue struct {
+	// Path is the path of the value in the object that was converted.
+	Path string
+	// Reason is why the value was dropped.
+	Reason DropReason
+	// Value is the value that was dropped.
+	Value any
+}
+
+// ConversionReport describes the values of an object that a conversion did not carry over to the
+// to version by projecting the object onto the fields that are compatible with the to version.
+// The mutation or template of the conversion may still have converted a dropped value, for
+// example, to a field with a different name.
+type ConversionReport struct {
+	// Dropped are the dropped values, ordered by path.
+	Dropped []DroppedValue
+}
+
+// Warnings returns a message for each dropped value, suitable for admission warnings or logs.
+func (r *ConversionReport) Warnings() []string {
+	if r == nil {
+		return nil
+	}
+	warnings := make([]string, len(r.Dropped))
+	for i, d := range r.Dropped {
+		var reason string
+		switch d.Reason {
+		case DropReasonUnknownField:
+			reason = "the field does not exist in the to version"
+		case DropReasonTypeMismatch:
+			reason = "the value is not compatible with the field of the to version"
+		case DropReasonMissingMapKey:
+			reason = "the list entry is missing a map key of the to version"
+		default:
+			reason = string(d.Reason)
+		}
+		warnings[i] = fmt.Sprintf("%s: not carried over by the conversion: %s", d.Path, reason)
+	}
+	return warnings
+}
+
+// record adds a dropped value to the report. It is a no-op for a nil report.
+func (r *ConversionReport) record(path *field.Path, reason DropReason, value any) {
+	if r == nil {
+		return
+	}
+	r.Dropped = append(r.Dropped, DroppedValue{Path: path.String(), Reason: reason, Value: value})
+}
+
+// sort orders the dropped values by path, since objects are traversed in no particular order.
+func (r *ConversionReport) sort() {
+	sort.SliceStable(r.Dropped, func(i, j int) bool {
+		return r.Dropped[i].Path < r.Dropped[j].Path
+	})
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/duration"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+)
+
+// scalarSchema is the part of a schema that constrains scalar values.
+type scalarSchema struct {
+	typ         string
+	format      string
+	intOrString bool
+	nullable    bool
+}
+
+// coerceScalar returns v as a value of the schema, and false if v is not valid for the schema.
+// Values are converted to the representation used by unstructured objects where that is lossless:
+// integral numbers of integer fields are converted to int64, json.Numbers to int64 or float64,
+// and quantities, times and durations of string fields to strings of their formats.
+func coerceScalar(v any, s scalarSchema) (any, bool) {
+	if v == nil {
+		return nil, s.nullable
+	}
+	if s.intOrString {
+		if str, ok := v.(string); ok {
+			return str, true
+		}
+		return toInt64(v)
+	}
+	switch s.typ {
+	case "integer":
+		return toInt64(v)
+	case "number":
+		return toNumber(v)
+	case "string":
+		return toFormattedString(v, s.format)
+	case "boolean":
+		b, ok := v.(bool)
+		return b, ok
+	case "object", "array":
+		// Scalars are never valid for objects and lists.
+		return nil, false
+	default:
+		return v, true
+	}
+}
+
+// toInt64 returns v as an int64 if it is an integer, or a number with an integral value.
+func toInt64(v any) (any, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case float64:
+		// float64(math.MaxInt64) rounds up to 2^63, which does not fit in an int64.
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < -math.MinInt64 {
+			return int64(v), true
+		}
+	case float32:
+		return toInt64(float64(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := v.Float64(); err == nil {
+			return toInt64(f)
+		}
+	}
+	return nil, false
+}
+
+// toNumber returns v as an int64 or float64 if it is a number.
+func toNumber(v any) (any, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := v.Float64(); err == nil {
+			return f, true
+		}
+		return nil, false
+	}
+	return toInt64(v)
+}
+
+// toFormattedString returns v as a string if it is valid for the format. The date-time, date,
+// duration and quantity formats are checked; all other formats accept any string.
+func toFormattedString(v any, format string) (any, bool) {
+	switch v := v.(type) {
+	case string:
+		switch format {
+		case "date-time":
+			return v, strfmt.IsDateTime(v)
+		case "date":
+			return v, strfmt.IsDate(v)
+		case "duration":
+			_, err := strfmt.ParseDuration(v)
+			return v, err == nil
+		case "quantity":
+			_, err := resource.ParseQuantity(v)
+			return v, err == nil
+		}
+		return v, true
+	case duration.Duration:
+		if format == "duration" {
+			return time.Duration(v.Seconds*int64(time.Second) + int64(v.Nanos)).String(), true
+		}
+	case time.Duration:
+		if format == "duration" {
+			return v.String(), true
+		}
+	case time.Time:
+		if format == "date-time" {
+			return v.UTC().Format(time.RFC3339), true
+		}
+	case resource.Quantity:
+		if format == "quantity" {
+			return v.String(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apply
+
+import (
+	"sync"
+
+	"k8s.io/apiserver/pkg/cel/common"
+	"k8s.io/apiserver/pkg/cel/openapi"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// schemaNode adapts a spec.Schema to common.Schema. Unlike openapi.Schema, which creates new
+// adapters for nested schemas each time they are accessed, the nested nodes of a schemaNode are
+// created once. This gives each position in the schema a stable identity that data derived from
+// the schema, such as the Merger used by objects.apply(), can be cached on.
+type schemaNode struct {
+	*openapi.Schema
+
+	properties           map[string]common.Schema
+	items                common.Schema
+	additionalProperties common.SchemaOrBool
+
+	withTypeAndObjectMetaOnce sync.Once
+	withTypeAndObjectMeta     *schemaNode
+
+	mergerOnce sync.Once
+	merger     *Merger
+	mergerErr  error
+}
+
+var _ common.Schema = (*schemaNode)(nil)
+
+func newSchemaNode(s *spec.Schema) *schemaNode {
+	n := &schemaNode{Schema: &openapi.Schema{Schema: s}}
+	if s.Properties != nil {
+		n.properties = make(map[string]common.Schema, len(s.Properties))
+		for name, prop := range s.Properties {
+			prop := prop
+			n.properties[name] = newSchemaNode(&prop)
+		}
+	}
+	if s.Items != nil && s.Items.Schema != nil {
+		n.items = newSchemaNode(s.Items.Schema)
+	}
+	if s.AdditionalProperties != nil {
+		sb := &schemaOrBool{allows: s.AdditionalProperties.Allows}
+		if s.AdditionalProperties.Schema != nil {
+			sb.schema = newSchemaNode(s.AdditionalProperties.Schema)
+		}
+		n.additionalProperties = sb
+	}
+	return n
+}
+
+func (n *schemaNode) Properties() map[string]common.Schema {
+	return n.properties
+}
+
+func (n *schemaNode) Items() common.Schema {
+	return n.items
+}
+
+func (n *schemaNode) AdditionalProperties() common.SchemaOrBool {
+	return n.additionalProperties
+}
+
+func (n *schemaNode) WithTypeAndObjectMeta() common.Schema {
+	n.withTypeAndObjectMetaOnce.Do(func() {
+		s := withTypeAndObjectMeta(n.Schema.Schema)
+		if s == n.Schema.Schema {
+			n.withTypeAndObjectMeta = n
+		} else {
+			n.withTypeAndObjectMeta = newSchemaNode(s)
+		}
+	})
+	return n.withTypeAndObjectMeta
+}
+
+// withTypeAndObjectMeta ensures the kind, apiVersion and metadata.name and metadata.generateName
+// properties are specified, making a shallow copy of the provided schema if needed. Unlike
+// common.WithTypeAndObjectMeta, any other metadata properties declared by the schema, such as
+// labels and annotations, are retained so that mutations can read and modify them.
+func withTypeAndObjectMeta(s *spec.Schema) *spec.Schema {
+	if s.Properties != nil &&
+		s.Properties["kind"].Type.Contains("string") &&
+		s.Properties["apiVersion"].Type.Contains("string") &&
+		s.Properties["metadata"].Type.Contains("object") &&
+		s.Properties["metadata"].Properties != nil &&
+		s.Properties["metadata"].Properties["name"].Type.Contains("string") &&
+		s.Properties["metadata"].Properties["generateName"].Type.Contains("string") {
+		return s
+	}
+	result := *s
+	props := make(map[string]spec.Schema, len(s.Properties))
+	for k, prop := range s.Properties {
+		props[k] = prop
+	}
+	stringType := spec.StringProperty()
+	props["kind"] = *stringType
+	props["apiVersion"] = *stringType
+
+	metadata := props["metadata"]
+	if !metadata.Type.Contains("object") {
+		metadata = spec.Schema{SchemaProps: spec.SchemaProps{Type: []string{"object"}}}
+	}
+	metadataProps := make(map[string]spec.Schema, len(metadata.Properties)+2)
+	for k, prop := range metadata.Properties {
+		metadataProps[k] = prop
+	}
+	// Names are DNS subdomains, which are at most 253 characters. Declaring this bounds the
+	// estimated cost of expressions that use the name.
+	nameType := spec.StringProperty().WithMaxLength(253)
+	metadataProps["name"] = *nameType
+	metadataProps["generateName"] = *nameType
+	metadata.Properties = metadataProps
+	props["metadata"] = metadata
+
+	result.Properties = props
+	return &result
+}
+
+// getMerger returns the Merger for this position in the schema, creating it on first use.
+func (n *schemaNode) getMerger() (*Merger, error) {
+	n.mergerOnce.Do(func() {
+		n.merger, n.mergerErr = NewMerger(n.Schema.Schema, false)
+	})
+	return n.merger, n.mergerErr
+}
+
+type schemaOrBool struct {
+	schema common.Schema
+	allows bool
+}
+
+func (sb *schemaOrBool) Schema() common.Schema {
+	return sb.schema
+}
+
+func (sb *schemaOrBool) Allows() bool {
+	return sb.allows
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package builtin resolves the schemas of built-in Kubernetes types, such as Pod and Deployment,
+// from OpenAPI v3 documents that are embedded in the binary, so that they are available offline.
+package builtin
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// documents holds the OpenAPI v3 documents of the built-in group versions, as served by the
+// kube-apiserver at /openapi/v3/<path>. Each file is named by its path with "/" replaced by "__".
+//
+//go:embed openapi/*_openapi.json
+var documents embed.FS
+
+const (
+	documentDir    = "openapi"
+	documentSuffix = "_openapi.json"
+	refPrefix      = "#/components/schemas/"
+	extGVK         = "x-kubernetes-group-version-kind"
+)
+
+// Resolver resolves the schemas of built-in types by GroupVersionKind. Documents are parsed the
+// first time a schema of their group version is resolved. A Resolver is safe for concurrent use.
+type Resolver struct {
+	lock   sync.Mutex
+	groups map[schema.GroupVersion]*groupVersion
+}
+
+var _ resolver.SchemaResolver = (*Resolver)(nil)
+
+// NewResolver returns a Resolver for the embedded OpenAPI documents.
+func NewResolver() *Resolver {
+	return &Resolver{groups: map[schema.GroupVersion]*groupVersion{}}
+}
+
+// groupVersion holds the parsed OpenAPI document of a group version and the schemas that have
+// been resolved from it.
+type groupVersion struct {
+	components map[string]*spec.Schema
+	kinds      map[string]string
+	resolved   map[string]*spec.Schema
+}
+
+// ResolveSchema returns the schema of the built-in type identified by gvk. All references in the
+// schema are resolved, so the schema is self-contained and can be used with the apply package.
+// The returned schema is shared and must not be modified. If there is no built-in type for gvk,
+// the returned error wraps resolver.ErrSchemaNotFound.
+func (r *Resolver) ResolveSchema(gvk schema.GroupVersionKind) (*spec.Schema, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	gv, err := r.groupVersion(gvk.GroupVersion())
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := gv.resolved[gvk.Kind]; ok {
+		return s, nil
+	}
+	name, ok := gv.kinds[gvk.Kind]
+	if !ok {
+		return nil, fmt.Errorf("cannot resolve group version kind %q: %w", gvk, resolver.ErrSchemaNotFound)
+	}
+	s, err := populateRefs(gv.components, gv.components[name], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve group version kind %q: %w", gvk, err)
+	}
+	gv.resolved[gvk.Kind] = s
+	return s, nil
+}
+
+// GroupVersionKinds returns the GroupVersionKinds of all the built-in types, sorted.
+func (r *Resolver) GroupVersionKinds() ([]schema.GroupVersionKind, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries, err := fs.ReadDir(documents, documentDir)
+	if err != nil {
+		return nil, err
+	}
+	var result []schema.GroupVersionKind
+	for _, entry := range entries {
+		gv, err := groupVersionFromPath(strings.TrimSuffix(entry.Name(), documentSuffix))
+		if err != nil {
+			return nil, err
+		}
+		doc, err := r.groupVersion(gv)
+		if err != nil {
+			return nil, err
+		}
+		for kind := range doc.kinds {
+			result = append(result, gv.WithKind(kind))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result, nil
+}
+
+func (r *Resolver) groupVersion(gv schema.GroupVersion) (*groupVersion, error) {
+	if doc, ok := r.groups[gv]; ok {
+		return doc, nil
+	}
+	data, err := documents.ReadFile(documentDir + "/" + strings.ReplaceAll(pathFromGroupVersion(gv), "/", "__") + documentSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot resolve group version %q: %w", gv, resolver.ErrSchemaNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Components struct {
+			Schemas map[string]*spec.Schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document of group version %q: %w", gv, err)
+	}
+	result := &groupVersion{
+		components: doc.Components.Schemas,
+		kinds:      map[string]string{},
+		resolved:   map[string]*spec.Schema{},
+	}
+	for name, s := range doc.Components.Schemas {
+		var gvks []schema.GroupVersionKind
+		if err := s.Extensions.GetObject(extGVK, &gvks); err != nil {
+			return nil, fmt.Errorf("failed to parse %s of %s: %w", extGVK, name, err)
+		}
+		for _, gvk := range gvks {
+			// The document also includes types of other group versions, such as the
+			// DeleteOptions and WatchEvent of every group version.
+			if gvk.GroupVersion() == gv {
+				result.kinds[gvk.Kind] = name
+			}
+		}
+	}
+	r.groups[gv] = result
+	return result, nil
+}
+
+func pathFromGroupVersion(gv schema.GroupVersion) string {
+	if len(gv.Group) == 0 {
+		return "api/" + gv.Version
+	}
+	return "apis/" + gv.Group + "/" + gv.Version
+}
+
+func groupVersionFromPath(name string) (schema.GroupVersion, error) {
+	parts := strings.Split(name, "__")
+	switch {
+	case len(parts) == 2 && parts[0] == "api":
+		return schema.GroupVersion{Version: parts[1]}, nil
+	case len(parts) == 3 && parts[0] == "apis":
+		return schema.GroupVersion{Group: parts[1], Version: parts[2]}, nil
+	default:
+		return schema.GroupVersion{}, fmt.Errorf("unrecognized OpenAPI document name %q", name)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builtin
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+var (
+	podGVK        = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	deploymentGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+)
+
+func TestResolveSchema(t *testing.T) {
+	r := NewResolver()
+	pod, err := r.ResolveSchema(podGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pod.Properties["metadata"].Properties["uid"]; !ok {
+		t.Errorf("expected metadata.uid to be resolved")
+	}
+	containers := pod.Properties["spec"].Properties["containers"]
+	if listType, _ := containers.Extensions.GetString(extListType); listType != "map" {
+		t.Errorf("expected containers to be a map list, but got list type %q", listType)
+	}
+	if keys, _ := containers.Extensions.GetStringSlice(extListMapKeys); !reflect.DeepEqual(keys, []string{"name"}) {
+		t.Errorf("expected containers to be keyed by name, but got %v", keys)
+	}
+	limits := containers.Items.Schema.Properties["resources"].Properties["limits"]
+	if isIntOrString, _ := limits.AdditionalProperties.Schema.Extensions.GetBool(extIntOrString); !isIntOrString {
+		t.Errorf("expected quantities to be int-or-string")
+	}
+
+	again, err := r.ResolveSchema(podGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != pod {
+		t.Errorf("expected resolved schemas to be cached")
+	}
+
+	gvks, err := r.GroupVersionKinds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[schema.GroupVersionKind]bool{}
+	for _, gvk := range gvks {
+		found[gvk] = true
+	}
+	for _, gvk := range []schema.GroupVersionKind{podGVK, deploymentGVK, {Version: "v1", Kind: "Service"}, {Group: "batch", Version: "v1", Kind: "Job"}} {
+		if !found[gvk] {
+			t.Errorf("expected %v in GroupVersionKinds", gvk)
+		}
+	}
+}
+
+func TestResolveSchemaNotFound(t *testing.T) {
+	r := NewResolver()
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "group.example.com", Version: "v1", Kind: "Example"},
+		{Group: "apps", Version: "v1", Kind: "Pod"},
+		{Version: "v1", Kind: "Example"},
+	} {
+		_, err := r.ResolveSchema(gvk)
+		if !errors.Is(err, resolver.ErrSchemaNotFound) {
+			t.Errorf("expected schema of %v to not be found, but got %v", gvk, err)
+		}
+	}
+}
+
+func TestMutateBuiltin(t *testing.T) {
+	r := NewResolver()
+	cases := []struct {
+		name     string
+		gvk      schema.GroupVersionKind
+		mutate   func(s *spec.Schema, obj any) (any, error)
+		original string
+		expected string
+	}{
+		{
+			name: "inject sidecar",
+			gvk:  podGVK,
+			original: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+`,
+			mutate: func(s *spec.Schema, obj any) (any, error) {
+				return apply.MutateBasicMerge(s, obj, map[string]any{"mutation": `
+Object{
+  spec: Object.spec{
+    containers: [
+      Object.spec.containers.item{
+        name: "proxy",
+        image: "proxy:" + oldObject.metadata.name
+      }
+    ]
+  }
+}`})
+			},
+			expected: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+  - name: proxy
+    image: proxy:web
+`,
+		},
+		{
+			name: "default imagePullPolicy of deployment container",
+			gvk:  deploymentGVK,
+			original: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:1.0
+        resources:
+          limits:
+            cpu: 500m
+            memory: 1
+`,
+			mutate: func(s *spec.Schema, obj any) (any, error) {
+				return apply.MutateWithTemplate(s, obj, unmarshal(`
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        imagePullPolicy: {$: "oldSelf == null ? 'Always' : oldSelf"}
+`))
+			},
+			expected: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:1.0
+        imagePullPolicy: Always
+        resources:
+          limits:
+            cpu: 500m
+            memory: 1
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := r.ResolveSchema(tc.gvk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := tc.mutate(s, unmarshal(tc.original))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := unmarshal(tc.expected)
+			if !reflect.DeepEqual(expected, result) {
+				t.Errorf("expected %v but got %v", expected, result)
+			}
+		})
+	}
+}
+
+func unmarshal(s string) any {
+	data, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		panic(err)
+	}
+	var result any
+	if err := json.Unmarshal(data, &result); err != nil {
+		panic(err)
+	}
+	return result
+}
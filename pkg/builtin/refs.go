@@ -0,0 +1,156 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builtin
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+const (
+	extIntOrString           = "x-kubernetes-int-or-string"
+	extPreserveUnknown       = "x-kubernetes-preserve-unknown-fields"
+	extListType              = "x-kubernetes-list-type"
+	extListMapKeys           = "x-kubernetes-list-map-keys"
+	extPatchStrategy         = "x-kubernetes-patch-strategy"
+	extPatchMergeKey         = "x-kubernetes-patch-merge-key"
+	formatIntOrString        = "int-or-string"
+	patchStrategyMerge       = "merge"
+	patchStrategyMergeRetain = "merge,retainKeys"
+)
+
+// populateRefs returns a copy of the schema with all references replaced by the referred
+// schemas from components, and with the schema normalized by normalize. resolving holds the names
+// of the schemas that are being resolved by the callers, and is used to detect recursive types,
+// which cannot be represented without references.
+func populateRefs(components map[string]*spec.Schema, s *spec.Schema, resolving []string) (*spec.Schema, error) {
+	result := *s
+	if ref, ok := refOf(s); ok {
+		name := strings.TrimPrefix(ref, refPrefix)
+		for _, r := range resolving {
+			if r == name {
+				return nil, fmt.Errorf("recursive reference to %s", name)
+			}
+		}
+		referred, ok := components[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve reference %q: %w", ref, resolver.ErrSchemaNotFound)
+		}
+		resolving = append(resolving[:len(resolving):len(resolving)], name)
+		result = *referred
+		if len(s.Description) > 0 {
+			result.Description = s.Description
+		}
+	}
+
+	if len(result.Properties) > 0 {
+		props := make(map[string]spec.Schema, len(result.Properties))
+		for name, prop := range result.Properties {
+			populated, err := populateRefs(components, &prop, resolving)
+			if err != nil {
+				return nil, err
+			}
+			props[name] = *populated
+		}
+		result.Properties = props
+	}
+	if result.AdditionalProperties != nil && result.AdditionalProperties.Schema != nil {
+		populated, err := populateRefs(components, result.AdditionalProperties.Schema, resolving)
+		if err != nil {
+			return nil, err
+		}
+		result.AdditionalProperties = &spec.SchemaOrBool{Allows: result.AdditionalProperties.Allows, Schema: populated}
+	}
+	if result.Items != nil && result.Items.Schema != nil {
+		populated, err := populateRefs(components, result.Items.Schema, resolving)
+		if err != nil {
+			return nil, err
+		}
+		result.Items = &spec.SchemaOrArray{Schema: populated}
+	}
+	normalize(&result)
+	return &result, nil
+}
+
+// refOf returns the reference of the schema, if it has one. Like the kube-apiserver's resolver,
+// it accepts references that are wrapped in allOf, which is how the OpenAPI v3 documents of
+// built-in types preserve the description of fields that refer to other types.
+func refOf(s *spec.Schema) (string, bool) {
+	if s.Ref.GetURL() != nil {
+		return s.Ref.String(), true
+	}
+	for _, allOf := range s.AllOf {
+		if ref, ok := refOf(&allOf); ok {
+			return ref, ok
+		}
+	}
+	return "", false
+}
+
+// normalize rewrites the parts of a built-in schema that are expressed differently than in a
+// CustomResourceDefinition schema, so that the apply package interprets them the same way as
+// the kube-apiserver does:
+//
+//   - IntOrString and Quantity, which are declared with oneOf, are marked
+//     x-kubernetes-int-or-string.
+//   - Objects with no declared fields, such as RawExtension and FieldsV1, are marked
+//     x-kubernetes-preserve-unknown-fields.
+//   - Lists that declare a merge patch strategy instead of a list type are given the list type
+//     that server side apply uses for them: a map keyed by the patch merge key, or a set if there
+//     is no patch merge key.
+func normalize(s *spec.Schema) {
+	s.Ref = spec.Ref{}
+	s.AllOf = nil
+	s.Extensions = copyExtensions(s.Extensions)
+
+	if s.Format == formatIntOrString || len(s.OneOf) > 0 {
+		s.Type = nil
+		s.Format = ""
+		s.OneOf = nil
+		s.Extensions.Add(extIntOrString, true)
+		return
+	}
+	if s.Type.Contains("object") && len(s.Properties) == 0 && s.AdditionalProperties == nil {
+		s.Extensions.Add(extPreserveUnknown, true)
+	}
+	if s.Type.Contains("array") {
+		if _, ok := s.Extensions.GetString(extListType); ok {
+			return
+		}
+		strategy, _ := s.Extensions.GetString(extPatchStrategy)
+		if strategy != patchStrategyMerge && strategy != patchStrategyMergeRetain {
+			return
+		}
+		if key, ok := s.Extensions.GetString(extPatchMergeKey); ok {
+			s.Extensions.Add(extListType, "map")
+			s.Extensions.Add(extListMapKeys, []any{key})
+		} else {
+			s.Extensions.Add(extListType, "set")
+		}
+	}
+}
+
+func copyExtensions(e spec.Extensions) spec.Extensions {
+	result := make(spec.Extensions, len(e))
+	for k, v := range e {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package crd loads the schemas of CustomResourceDefinition versions in the forms needed to mutate
+// and convert custom resources with the apply package.
+package crd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+// CustomResourceDefinition is a loaded CustomResourceDefinition manifest.
+type CustomResourceDefinition struct {
+	*apiextensionsv1.CustomResourceDefinition
+}
+
+// Load parses a CustomResourceDefinition manifest in YAML or JSON form.
+func Load(data []byte) (*CustomResourceDefinition, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := json.Unmarshal(j, crd); err != nil {
+		return nil, err
+	}
+	if crd.Kind != "CustomResourceDefinition" {
+		return nil, fmt.Errorf("expected kind CustomResourceDefinition, but got %q", crd.Kind)
+	}
+	return &CustomResourceDefinition{CustomResourceDefinition: crd}, nil
+}
+
+// LoadFile parses the CustomResourceDefinition manifest in file.
+func LoadFile(file string) (*CustomResourceDefinition, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	crd, err := Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CustomResourceDefinition from %s: %w", file, err)
+	}
+	return crd, nil
+}
+
+// VersionNames returns the names of the versions of the CustomResourceDefinition.
+func (c *CustomResourceDefinition) VersionNames() []string {
+	names := make([]string, len(c.Spec.Versions))
+	for i, v := range c.Spec.Versions {
+		names[i] = v.Name
+	}
+	return names
+}
+
+// Version returns the schemas of the named version. If name is empty, the CustomResourceDefinition
+// must have exactly one version, which is returned.
+func (c *CustomResourceDefinition) Version(name string) (*Version, error) {
+	if len(name) == 0 {
+		if len(c.Spec.Versions) != 1 {
+			return nil, fmt.Errorf("CustomResourceDefinition has %d versions, a version must be specified", len(c.Spec.Versions))
+		}
+		name = c.Spec.Versions[0].Name
+	}
+	for _, v := range c.Spec.Versions {
+		if v.Name != name {
+			continue
+		}
+		if v.Schema == nil || v.Schema.OpenAPIV3Schema == nil {
+			return nil, fmt.Errorf("version %q of the CustomResourceDefinition has no schema", name)
+		}
+		return NewVersion(name, v.Schema.OpenAPIV3Schema)
+	}
+	return nil, fmt.Errorf("CustomResourceDefinition has no version %q", name)
+}
+
+// Version holds the schema of a version of a custom resource in the forms needed by the apply
+// package.
+type Version struct {
+	// Name is the name of the version.
+	Name string
+	// Schema is the OpenAPI schema of the version. Unlike the schema declared in the
+	// CustomResourceDefinition, it includes the apiVersion, kind and metadata fields that are
+	// implicitly part of the root of every custom resource and of every
+	// x-kubernetes-embedded-resource.
+	Schema *spec.Schema
+	// Structural is the structural schema of the version, as used for pruning.
+	Structural *structuralschema.Structural
+	// Merger merges apply configurations into objects of the version.
+	Merger *apply.Merger
+}
+
+// NewVersion returns the schemas of a version of a custom resource with the schema props.
+func NewVersion(name string, props *apiextensionsv1.JSONSchemaProps) (*Version, error) {
+	var internal apiextensions.JSONSchemaProps
+	if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(props, &internal, nil); err != nil {
+		return nil, err
+	}
+	structural, err := structuralschema.NewStructural(&internal)
+	if err != nil {
+		return nil, fmt.Errorf("schema of version %q is not structural: %w", name, err)
+	}
+
+	data, err := json.Marshal(withImplicitFields(props, true))
+	if err != nil {
+		return nil, err
+	}
+	s := &spec.Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	merger, err := apply.NewMerger(s, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Version{Name: name, Schema: s, Structural: structural, Merger: merger}, nil
+}
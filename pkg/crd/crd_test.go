@@ -0,0 +1,218 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+func TestLoadFile(t *testing.T) {
+	c, err := LoadFile("../../testdata/crd.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c.VersionNames(); !reflect.DeepEqual(names, []string{"v1", "v2"}) {
+		t.Errorf("expected versions [v1 v2] but got %v", names)
+	}
+	v1, err := c.Version("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := v1.Schema.Properties["metadata"]
+	for _, field := range []string{"name", "uid", "labels", "ownerReferences", "managedFields"} {
+		if _, ok := metadata.Properties[field]; !ok {
+			t.Errorf("expected implicit metadata field %s", field)
+		}
+	}
+	if _, ok := v1.Structural.Properties["spec"]; !ok {
+		t.Errorf("expected spec in structural schema")
+	}
+
+	obj := unmarshal(t, `
+apiVersion: group.example.com/v1
+kind: Example
+metadata:
+  name: alpha
+  uid: "1234"
+  labels:
+    app: alpha
+spec:
+  replicas: 1
+`)
+	result, err := apply.MutateWithTemplate(v1.Schema, obj, unmarshal(t, `
+metadata:
+  labels:
+    uid: {$: "oldObject.metadata.uid"}
+spec:
+  replicas: {$: "size(oldObject.metadata.labels)"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := unmarshal(t, `
+apiVersion: group.example.com/v1
+kind: Example
+metadata:
+  name: alpha
+  uid: "1234"
+  labels:
+    app: alpha
+    uid: "1234"
+spec:
+  replicas: 1
+`)
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %v but got %v", expected, result)
+	}
+
+	v2, err := c.Version("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, _, err := apply.ConvertWithTemplate(v1.Schema, v2.Schema, obj, unmarshal(t, `
+spec:
+  copies: {$: "oldObject.spec.replicas"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copies := converted.(map[string]any)["spec"].(map[string]any)["copies"]; copies != int64(1) {
+		t.Errorf("expected spec.copies of 1 but got %v", copies)
+	}
+}
+
+func TestEmbeddedResource(t *testing.T) {
+	c, err := Load([]byte(`
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: templates.group.example.com
+spec:
+  group: group.example.com
+  names:
+    kind: Template
+    plural: templates
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              template:
+                type: object
+                x-kubernetes-embedded-resource: true
+                properties:
+                  metadata:
+                    type: object
+                    properties:
+                      name:
+                        type: string
+                        maxLength: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Version("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := v.Schema.Properties["spec"].Properties["template"]
+	for _, field := range []string{"apiVersion", "kind", "metadata"} {
+		if _, ok := template.Properties[field]; !ok {
+			t.Errorf("expected implicit field %s in embedded resource", field)
+		}
+	}
+	metadata := template.Properties["metadata"]
+	if _, ok := metadata.Properties["labels"]; !ok {
+		t.Errorf("expected implicit metadata field labels in embedded resource")
+	}
+	if name := metadata.Properties["name"]; name.MaxLength == nil || *name.MaxLength != 10 {
+		t.Errorf("expected declared metadata.name schema to be retained, but got %v", name)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name          string
+		manifest      string
+		version       string
+		expectedError string
+	}{
+		{
+			name:          "wrong kind",
+			manifest:      "apiVersion: v1\nkind: ConfigMap\n",
+			expectedError: `expected kind CustomResourceDefinition, but got "ConfigMap"`,
+		},
+		{
+			name:          "version required",
+			manifest:      "kind: CustomResourceDefinition\nspec:\n  versions:\n  - name: v1\n  - name: v2\n",
+			expectedError: "a version must be specified",
+		},
+		{
+			name:          "missing version",
+			manifest:      "kind: CustomResourceDefinition\nspec:\n  versions:\n  - name: v1\n",
+			version:       "v2",
+			expectedError: `no version "v2"`,
+		},
+		{
+			name:          "missing schema",
+			manifest:      "kind: CustomResourceDefinition\nspec:\n  versions:\n  - name: v1\n",
+			version:       "v1",
+			expectedError: `version "v1" of the CustomResourceDefinition has no schema`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := Load([]byte(tc.manifest))
+			if err == nil {
+				_, err = c.Version(tc.version)
+			}
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func unmarshal(t *testing.T, s string) any {
+	t.Helper()
+	data, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result any
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crd
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// withImplicitFields returns a copy of the schema with the apiVersion, kind and metadata fields
+// added to the root (if isResourceRoot) and to every x-kubernetes-embedded-resource. Fields that
+// are declared by the schema are retained; in particular, the schema may declare some metadata
+// fields, such as name, and the remaining metadata fields are added.
+func withImplicitFields(s *apiextensionsv1.JSONSchemaProps, isResourceRoot bool) *apiextensionsv1.JSONSchemaProps {
+	if s == nil {
+		return nil
+	}
+	result := s.DeepCopy()
+	addImplicitFields(result, isResourceRoot)
+	return result
+}
+
+func addImplicitFields(s *apiextensionsv1.JSONSchemaProps, isResourceRoot bool) {
+	for k, prop := range s.Properties {
+		addImplicitFields(&prop, false)
+		s.Properties[k] = prop
+	}
+	if s.Items != nil && s.Items.Schema != nil {
+		addImplicitFields(s.Items.Schema, false)
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		addImplicitFields(s.AdditionalProperties.Schema, false)
+	}
+	if !isResourceRoot && !s.XEmbeddedResource {
+		return
+	}
+
+	if len(s.Type) == 0 {
+		s.Type = "object"
+	}
+	if s.Properties == nil {
+		s.Properties = map[string]apiextensionsv1.JSONSchemaProps{}
+	}
+	if _, ok := s.Properties["apiVersion"]; !ok {
+		s.Properties["apiVersion"] = stringSchema()
+	}
+	if _, ok := s.Properties["kind"]; !ok {
+		s.Properties["kind"] = stringSchema()
+	}
+	metadata := objectMetaSchema()
+	for k, prop := range s.Properties["metadata"].Properties {
+		metadata.Properties[k] = prop
+	}
+	s.Properties["metadata"] = metadata
+}
+
+// objectMetaSchema returns the schema of ObjectMeta.
+func objectMetaSchema() apiextensionsv1.JSONSchemaProps {
+	stringMap := apiextensionsv1.JSONSchemaProps{
+		Type:                 "object",
+		AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{Allows: true, Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"}},
+	}
+	listTypeSet := "set"
+	listTypeMap := "map"
+	listTypeAtomic := "atomic"
+	preserveUnknownFields := true
+	return apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"name":                       stringSchema(),
+			"generateName":               stringSchema(),
+			"namespace":                  stringSchema(),
+			"selfLink":                   stringSchema(),
+			"uid":                        stringSchema(),
+			"resourceVersion":            stringSchema(),
+			"generation":                 {Type: "integer", Format: "int64"},
+			"creationTimestamp":          {Type: "string", Format: "date-time"},
+			"deletionTimestamp":          {Type: "string", Format: "date-time"},
+			"deletionGracePeriodSeconds": {Type: "integer", Format: "int64"},
+			"labels":                     stringMap,
+			"annotations":                stringMap,
+			"finalizers": {
+				Type:      "array",
+				XListType: &listTypeSet,
+				Items:     &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"}},
+			},
+			"ownerReferences": {
+				Type:         "array",
+				XListType:    &listTypeMap,
+				XListMapKeys: []string{"uid"},
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{
+					Type:     "object",
+					Required: []string{"apiVersion", "kind", "name", "uid"},
+					Properties: map[string]apiextensionsv1.JSONSchemaProps{
+						"apiVersion":         stringSchema(),
+						"kind":               stringSchema(),
+						"name":               stringSchema(),
+						"uid":                stringSchema(),
+						"controller":         {Type: "boolean"},
+						"blockOwnerDeletion": {Type: "boolean"},
+					},
+				}},
+			},
+			"managedFields": {
+				Type:      "array",
+				XListType: &listTypeAtomic,
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{
+					Type: "object",
+					Properties: map[string]apiextensionsv1.JSONSchemaProps{
+						"manager":     stringSchema(),
+						"operation":   stringSchema(),
+						"apiVersion":  stringSchema(),
+						"time":        {Type: "string", Format: "date-time"},
+						"fieldsType":  stringSchema(),
+						"fieldsV1":    {Type: "object", XPreserveUnknownFields: &preserveUnknownFields},
+						"subresource": stringSchema(),
+					},
+				}},
+			},
+		},
+	}
+}
+
+func stringSchema() apiextensionsv1.JSONSchemaProps {
+	return apiextensionsv1.JSONSchemaProps{Type: "string"}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonpatch creates RFC 6902 JSON Patches that describe the changes made to unstructured
+// objects, such as the changes made by a mutation, for admission responses, audit logs and review.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+// Operation is an RFC 6902 JSON Patch operation.
+type Operation struct {
+	// Op is add, remove or replace.
+	Op string
+	// Path is the JSON Pointer (RFC 6901) of the value the operation applies to.
+	Path string
+	// Value is the value of add and replace operations.
+	Value any
+}
+
+// MarshalJSON encodes the operation, including its value unless it is a remove, since a null value
+// is meaningful for add and replace operations.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+	return json.Marshal(struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}{o.Op, o.Path, o.Value})
+}
+
+// Create returns the JSON Patch operations that change the original object into the mutated
+// object, in the order they must be applied. Objects are diffed field by field, in the order of
+// the field names, so that patches are deterministic.
+//
+// The schema of the objects, which may be nil, is used to diff lists. The items of
+// x-kubernetes-list-type=map lists are matched by their map keys, and those of
+// x-kubernetes-list-type=set lists by their values, so that items that are added to or removed
+// from a list are added and removed individually, and the paths of changes to the items that
+// remain are stable, as long as the items that remain are in the same order and have unique keys;
+// otherwise the list is replaced. Other lists are diffed item by item if their lengths are the
+// same, and are replaced otherwise.
+func Create(s *spec.Schema, original, mutated any) []Operation {
+	return diff(nil, "", s, original, mutated)
+}
+
+func diff(ops []Operation, path string, s *spec.Schema, before, after any) []Operation {
+	switch after := after.(type) {
+	case map[string]any:
+		if before, ok := before.(map[string]any); ok {
+			return diffMap(ops, path, s, before, after)
+		}
+	case []any:
+		if before, ok := before.([]any); ok {
+			return diffList(ops, path, s, before, after)
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		ops = append(ops, Operation{Op: "replace", Path: path, Value: after})
+	}
+	return ops
+}
+
+func diffMap(ops []Operation, path string, s *spec.Schema, before, after map[string]any) []Operation {
+	for _, k := range sortedKeys(before) {
+		if _, ok := after[k]; !ok {
+			ops = append(ops, Operation{Op: "remove", Path: path + "/" + escape(k)})
+		}
+	}
+	for _, k := range sortedKeys(after) {
+		fieldPath := path + "/" + escape(k)
+		beforeValue, ok := before[k]
+		if !ok {
+			ops = append(ops, Operation{Op: "add", Path: fieldPath, Value: after[k]})
+			continue
+		}
+		ops = diff(ops, fieldPath, fieldSchema(s, k), beforeValue, after[k])
+	}
+	return ops
+}
+
+func diffList(ops []Operation, path string, s *spec.Schema, before, after []any) []Operation {
+	var items *spec.Schema
+	if s != nil && s.Items != nil {
+		items = s.Items.Schema
+	}
+	var key func(any) (string, bool)
+	switch listType(s) {
+	case "map":
+		keys, _ := s.Extensions.GetStringSlice("x-kubernetes-list-map-keys")
+		key = func(item any) (string, bool) { return mapKey(item, keys) }
+	case "set":
+		key = setKey
+	}
+	if key != nil {
+		if keyed, ok := diffKeyedList(ops, path, items, before, after, key); ok {
+			return keyed
+		}
+	}
+	if key != nil || len(before) != len(after) {
+		if !reflect.DeepEqual(before, after) {
+			ops = append(ops, Operation{Op: "replace", Path: path, Value: after})
+		}
+		return ops
+	}
+	for i := range after {
+		ops = diff(ops, path+"/"+strconv.Itoa(i), items, before[i], after[i])
+	}
+	return ops
+}
+
+// diffKeyedList diffs lists whose items are identified by their keys. Items that are not in the
+// mutated list are removed, from last to first so that the indexes of the items before them are
+// unchanged, and then the items of the mutated list are added or diffed in order. It returns false
+// if the items do not have unique keys, or if the items that remain are reordered, in which case
+// the list is replaced.
+func diffKeyedList(ops []Operation, path string, items *spec.Schema, before, after []any, key func(any) (string, bool)) ([]Operation, bool) {
+	beforeKeys, ok := itemKeys(before, key)
+	if !ok {
+		return nil, false
+	}
+	afterKeys, ok := itemKeys(after, key)
+	if !ok {
+		return nil, false
+	}
+	afterIndexes := make(map[string]int, len(afterKeys))
+	for i, k := range afterKeys {
+		afterIndexes[k] = i
+	}
+	beforeIndexes := make(map[string]int, len(beforeKeys))
+	last := -1
+	for i, k := range beforeKeys {
+		beforeIndexes[k] = i
+		if j, ok := afterIndexes[k]; ok {
+			if j < last {
+				return nil, false
+			}
+			last = j
+		}
+	}
+
+	for i := len(before) - 1; i >= 0; i-- {
+		if _, ok := afterIndexes[beforeKeys[i]]; !ok {
+			ops = append(ops, Operation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+	}
+	for j, k := range afterKeys {
+		itemPath := path + "/" + strconv.Itoa(j)
+		i, ok := beforeIndexes[k]
+		if !ok {
+			ops = append(ops, Operation{Op: "add", Path: itemPath, Value: after[j]})
+			continue
+		}
+		ops = diff(ops, itemPath, items, before[i], after[j])
+	}
+	return ops, true
+}
+
+// itemKeys returns the keys of the items, or false if an item has no key or the keys are not
+// unique.
+func itemKeys(items []any, key func(any) (string, bool)) ([]string, bool) {
+	keys := make([]string, len(items))
+	seen := make(map[string]bool, len(items))
+	for i, item := range items {
+		k, ok := key(item)
+		if !ok || seen[k] {
+			return nil, false
+		}
+		seen[k] = true
+		keys[i] = k
+	}
+	return keys, true
+}
+
+// mapKey returns the values of the map keys of an item of a listType=map list, encoded as JSON.
+// Keys that are not set are null.
+func mapKey(item any, keys []string) (string, bool) {
+	m, ok := item.(map[string]any)
+	if !ok || len(keys) == 0 {
+		return "", false
+	}
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		values[i] = m[k]
+	}
+	return setKey(values)
+}
+
+// setKey returns the item of a listType=set list, encoded as JSON.
+func setKey(item any) (string, bool) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// fieldSchema returns the schema of the field of objects of the schema, or nil if it is unknown.
+func fieldSchema(s *spec.Schema, name string) *spec.Schema {
+	if s == nil {
+		return nil
+	}
+	if prop, ok := s.Properties[name]; ok {
+		return &prop
+	}
+	if s.AdditionalProperties != nil {
+		return s.AdditionalProperties.Schema
+	}
+	return nil
+}
+
+func listType(s *spec.Schema) string {
+	if s == nil {
+		return ""
+	}
+	v, _ := s.Extensions.GetString("x-kubernetes-list-type")
+	return v
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape escapes a field name for use as a JSON Pointer (RFC 6901) reference token.
+func escape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
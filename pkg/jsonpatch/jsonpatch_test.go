@@ -0,0 +1,258 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+)
+
+const testSchema = `
+type: object
+properties:
+  listMap:
+    type: array
+    x-kubernetes-list-type: map
+    x-kubernetes-list-map-keys: [name, port]
+    items:
+      type: object
+      properties:
+        name: {type: string}
+        port: {type: integer}
+        value: {type: string}
+  set:
+    type: array
+    x-kubernetes-list-type: set
+    items: {type: string}
+  atomic:
+    type: array
+    items:
+      type: object
+      properties:
+        value: {type: string}
+  byName:
+    type: object
+    additionalProperties:
+      type: array
+      x-kubernetes-list-type: map
+      x-kubernetes-list-map-keys: [name]
+      items:
+        type: object
+        properties:
+          name: {type: string}
+          value: {type: string}
+`
+
+func TestCreate(t *testing.T) {
+	var s spec.Schema
+	if err := yaml.Unmarshal([]byte(testSchema), &s); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		schema   *spec.Schema
+		before   string
+		after    string
+		expected string
+	}{
+		{
+			name:     "no schema",
+			before:   `{"a/b": x, removed: 1, nested: {list: [1, 2], same: true}}`,
+			after:    `{"a/b": z, "m~n": null, nested: {list: [1], same: true}}`,
+			expected: `[{"op":"remove","path":"/removed"},{"op":"replace","path":"/a~1b","value":"z"},{"op":"add","path":"/m~0n","value":null},{"op":"replace","path":"/nested/list","value":[1]}]`,
+		},
+		{
+			name:     "unchanged",
+			schema:   &s,
+			before:   `{listMap: [{name: a, port: 1}], set: [a]}`,
+			after:    `{listMap: [{name: a, port: 1}], set: [a]}`,
+			expected: `[]`,
+		},
+		{
+			name:   "list map items are matched by key",
+			schema: &s,
+			before: `{listMap: [{name: a, port: 1, value: "1"}, {name: a, port: 2, value: "2"}, {name: b, port: 1, value: "3"}]}`,
+			after:  `{listMap: [{name: x, port: 1}, {name: a, port: 1, value: "1"}, {name: b, port: 1, value: "4"}, {name: z, port: 1}]}`,
+			expected: `[{"op":"remove","path":"/listMap/1"},{"op":"add","path":"/listMap/0","value":{"name":"x","port":1}},` +
+				`{"op":"replace","path":"/listMap/2/value","value":"4"},{"op":"add","path":"/listMap/3","value":{"name":"z","port":1}}]`,
+		},
+		{
+			name:     "reordered list map items are replaced",
+			schema:   &s,
+			before:   `{listMap: [{name: a, port: 1}, {name: b, port: 1}]}`,
+			after:    `{listMap: [{name: b, port: 1}, {name: a, port: 1}]}`,
+			expected: `[{"op":"replace","path":"/listMap","value":[{"name":"b","port":1},{"name":"a","port":1}]}]`,
+		},
+		{
+			name:     "list map items with duplicate keys are replaced",
+			schema:   &s,
+			before:   `{listMap: [{name: a, port: 1}, {name: a, port: 1}]}`,
+			after:    `{listMap: [{name: a, port: 1}]}`,
+			expected: `[{"op":"replace","path":"/listMap","value":[{"name":"a","port":1}]}]`,
+		},
+		{
+			name:     "set items are matched by value",
+			schema:   &s,
+			before:   `{set: [a, b, c]}`,
+			after:    `{set: [a, x, c, d]}`,
+			expected: `[{"op":"remove","path":"/set/1"},{"op":"add","path":"/set/1","value":"x"},{"op":"add","path":"/set/3","value":"d"}]`,
+		},
+		{
+			name:     "atomic list items of the same length are diffed by index",
+			schema:   &s,
+			before:   `{atomic: [{value: a}, {value: b}]}`,
+			after:    `{atomic: [{value: a}, {value: c}]}`,
+			expected: `[{"op":"replace","path":"/atomic/1/value","value":"c"}]`,
+		},
+		{
+			name:     "atomic lists of different lengths are replaced",
+			schema:   &s,
+			before:   `{atomic: [{value: a}, {value: b}]}`,
+			after:    `{atomic: [{value: a}]}`,
+			expected: `[{"op":"replace","path":"/atomic","value":[{"value":"a"}]}]`,
+		},
+		{
+			name:     "additional properties",
+			schema:   &s,
+			before:   `{byName: {first: [{name: a, value: "1"}, {name: b}]}}`,
+			after:    `{byName: {first: [{name: b}], second: []}}`,
+			expected: `[{"op":"remove","path":"/byName/first/0"},{"op":"add","path":"/byName/second","value":[]}]`,
+		},
+		{
+			name:     "type changes are replaced",
+			schema:   &s,
+			before:   `{set: [a]}`,
+			after:    `{set: null}`,
+			expected: `[{"op":"replace","path":"/set","value":null}]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, after := yamlValue(t, tc.before), yamlValue(t, tc.after)
+			ops := Create(tc.schema, before, after)
+			data, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) == 0 {
+				data = []byte("[]")
+			}
+			if string(data) != tc.expected {
+				t.Errorf("expected patch %s but got %s", tc.expected, data)
+			}
+			patched, err := applyPatch(runtime.DeepCopyJSONValue(before), ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(after, patched) {
+				t.Errorf("expected the patch to produce %v but got %v", after, patched)
+			}
+		})
+	}
+}
+
+func yamlValue(t *testing.T, s string) any {
+	t.Helper()
+	data, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result any
+	if err := utiljson.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// applyPatch applies the add, remove and replace operations of a JSON Patch to an unstructured
+// object.
+func applyPatch(obj any, ops []Operation) (any, error) {
+	for _, op := range ops {
+		var tokens []string
+		if len(op.Path) > 0 {
+			tokens = strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		}
+		for i, token := range tokens {
+			tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		}
+		var err error
+		obj, err = applyOperation(obj, op.Op, tokens, runtime.DeepCopyJSONValue(op.Value))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return obj, nil
+}
+
+func applyOperation(obj any, op string, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	switch o := obj.(type) {
+	case map[string]any:
+		if len(tokens) == 1 {
+			_, ok := o[tokens[0]]
+			switch {
+			case op == "remove" && ok:
+				delete(o, tokens[0])
+			case op == "add" || (op == "replace" && ok):
+				o[tokens[0]] = value
+			default:
+				return nil, fmt.Errorf("no such field %q", tokens[0])
+			}
+			return o, nil
+		}
+		child, ok := o[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("no such field %q", tokens[0])
+		}
+		updated, err := applyOperation(child, op, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		o[tokens[0]] = updated
+		return o, nil
+	case []any:
+		i, err := strconv.Atoi(tokens[0])
+		if len(tokens) == 1 && op == "add" && err == nil && i >= 0 && i <= len(o) {
+			return append(o[:i], append([]any{value}, o[i:]...)...), nil
+		}
+		if err != nil || i < 0 || i >= len(o) {
+			return nil, fmt.Errorf("invalid index %q", tokens[0])
+		}
+		if len(tokens) == 1 && op == "remove" {
+			return append(o[:i], o[i+1:]...), nil
+		}
+		updated, err := applyOperation(o[i], op, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		o[i] = updated
+		return o, nil
+	default:
+		return nil, fmt.Errorf("cannot apply %s to %T", op, obj)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/crd"
+)
+
+// versionPair is a conversion from one version to another.
+type versionPair struct {
+	from, to string
+}
+
+// CompiledConversionPolicy is a ConversionPolicy whose rules have been compiled against the
+// schemas of their versions. It is safe for concurrent use.
+type CompiledConversionPolicy struct {
+	Policy *ConversionPolicy
+
+	conversions map[versionPair]*apply.CompiledConversion
+	// chains are the rules that convert each pair of versions, in the order they are applied.
+	chains map[versionPair][]versionPair
+}
+
+// CompileConversionPolicy compiles the rules of the policy using the schemas of the versions
+// returned by version, such as the Version method of the CustomResourceDefinition of the
+// custom resources. The policy must have been defaulted and validated, as Load does.
+func CompileConversionPolicy(p *ConversionPolicy, version func(name string) (*crd.Version, error)) (*CompiledConversionPolicy, error) {
+	var opts []apply.CompileOption
+	if p.Spec.Params != nil {
+		opts = append(opts, apply.WithParams(p.Spec.Params))
+	}
+	c := &CompiledConversionPolicy{
+		Policy:      p,
+		conversions: map[versionPair]*apply.CompiledConversion{},
+		chains:      shortestChains(&p.Spec),
+	}
+	for _, rule := range p.Spec.Rules {
+		from, err := version(rule.From)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve version %s of ConversionPolicy %q: %w", rule.From, p.Name, err)
+		}
+		to, err := version(rule.To)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve version %s of ConversionPolicy %q: %w", rule.To, p.Name, err)
+		}
+		ruleOpts := opts
+		if len(rule.MatchConditions) > 0 {
+			ruleOpts = append(opts[:len(opts):len(opts)], matchConditionsOption(rule.MatchConditions, rule.FailurePolicy))
+		}
+		var conversion *apply.CompiledConversion
+		switch rule.Mode {
+		case ModeApply:
+			conversion, err = apply.CompileConvertApply(from.Schema, to.Schema, map[string]any{"mutation": rule.Mutation}, ruleOpts...)
+		case ModeTemplate:
+			conversion, err = apply.CompileConvertWithTemplate(from.Schema, to.Schema, rule.Template, ruleOpts...)
+		default:
+			conversion, err = apply.CompileConvertBasicMerge(from.Schema, to.Schema, map[string]any{"mutation": rule.Mutation}, ruleOpts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile the conversion from %s to %s of ConversionPolicy %q: %w", rule.From, rule.To, p.Name, err)
+		}
+		c.conversions[versionPair{from: rule.From, to: rule.To}] = conversion
+	}
+	return c, nil
+}
+
+// GroupKind returns the group and kind of the custom resources that the policy converts.
+func (c *CompiledConversionPolicy) GroupKind() schema.GroupKind {
+	return schema.GroupKind{Group: c.Policy.Spec.Group, Kind: c.Policy.Spec.Kind}
+}
+
+// Chain returns the versions that objects are converted through, in order, to convert them from
+// one version to another, including both the from and to versions. It returns nil if the
+// versions cannot be converted.
+func (c *CompiledConversionPolicy) Chain(from, to string) []string {
+	chain, ok := c.chains[versionPair{from: from, to: to}]
+	if !ok {
+		return nil
+	}
+	versions := []string{from}
+	for _, step := range chain {
+		versions = append(versions, step.to)
+	}
+	return versions
+}
+
+// Convert returns the result of converting obj to the version toVersion. obj is converted by the
+// rule from its version to toVersion or, if there is none, by the shortest chain of rules through
+// intermediate versions. The apiVersion of the result is set to toVersion. obj is returned
+// unchanged if it is already of version toVersion.
+func (c *CompiledConversionPolicy) Convert(obj any, toVersion string) (any, error) {
+	result, _, err := c.ConvertWithReport(obj, toVersion)
+	return result, err
+}
+
+// ConvertWithReport is Convert, and also returns a report of the values that the rules did not
+// carry over. The report of a chain of rules combines the reports of all its rules, in order, and
+// the paths of each are relative to the object the rule converted.
+func (c *CompiledConversionPolicy) ConvertWithReport(obj any, toVersion string) (any, *apply.ConversionReport, error) {
+	u, ok := obj.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("expected an object, but got %T", obj)
+	}
+	apiVersion, _ := u["apiVersion"].(string)
+	kind, _ := u["kind"].(string)
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid apiVersion: %w", err)
+	}
+	if gv.Group != c.Policy.Spec.Group || kind != c.Policy.Spec.Kind {
+		return nil, nil, fmt.Errorf("ConversionPolicy %q converts %s, but got %s %s", c.Policy.Name, c.GroupKind(), apiVersion, kind)
+	}
+	report := &apply.ConversionReport{}
+	if gv.Version == toVersion {
+		return obj, report, nil
+	}
+	chain, ok := c.chains[versionPair{from: gv.Version, to: toVersion}]
+	if !ok {
+		return nil, nil, fmt.Errorf("ConversionPolicy %q has no conversion from %s to %s", c.Policy.Name, gv.Version, toVersion)
+	}
+	for _, step := range chain {
+		result, stepReport, err := c.conversions[step].ApplyWithReport(obj)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to convert from %s to %s: %w", step.from, step.to, err)
+		}
+		converted, ok := result.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("conversion from %s to %s returned %T rather than an object", step.from, step.to, result)
+		}
+		converted["apiVersion"] = schema.GroupVersion{Group: c.Policy.Spec.Group, Version: step.to}.String()
+		report.Dropped = append(report.Dropped, stepReport.Dropped...)
+		obj = converted
+	}
+	return obj, report, nil
+}
+
+// shortestChains returns the shortest chain of rules that converts each pair of versions that can
+// be converted. Where there are several shortest chains, chains through the hub are preferred,
+// then chains through the versions that are listed first.
+func shortestChains(spec *ConversionPolicySpec) map[versionPair][]versionPair {
+	order := spec.Versions
+	if spec.Topology == TopologyHubAndSpoke {
+		order = []string{spec.Hub}
+		for _, v := range spec.Versions {
+			if v != spec.Hub {
+				order = append(order, v)
+			}
+		}
+	}
+	rules := map[versionPair]bool{}
+	for _, rule := range spec.Rules {
+		rules[versionPair{from: rule.From, to: rule.To}] = true
+	}
+
+	chains := map[versionPair][]versionPair{}
+	for _, from := range spec.Versions {
+		// Breadth first search from the from version.
+		paths := map[string][]versionPair{from: nil}
+		queue := []string{from}
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			for _, next := range order {
+				step := versionPair{from: v, to: next}
+				if _, visited := paths[next]; visited || !rules[step] {
+					continue
+				}
+				path := make([]versionPair, len(paths[v]), len(paths[v])+1)
+				copy(path, paths[v])
+				paths[next] = append(path, step)
+				queue = append(queue, next)
+			}
+		}
+		for to, path := range paths {
+			if to != from {
+				chains[versionPair{from: from, to: to}] = path
+			}
+		}
+	}
+	return chains
+}
+
+// uncoveredPairs returns the pairs of versions that must be converted according to the topology,
+// but are not.
+func uncoveredPairs(spec *ConversionPolicySpec) []versionPair {
+	var uncovered []versionPair
+	if spec.Topology == TopologyHubAndSpoke {
+		rules := map[versionPair]bool{}
+		for _, rule := range spec.Rules {
+			rules[versionPair{from: rule.From, to: rule.To}] = true
+		}
+		for _, v := range spec.Versions {
+			if v == spec.Hub {
+				continue
+			}
+			for _, pair := range []versionPair{{from: v, to: spec.Hub}, {from: spec.Hub, to: v}} {
+				if !rules[pair] {
+					uncovered = append(uncovered, pair)
+				}
+			}
+		}
+		return uncovered
+	}
+	chains := shortestChains(spec)
+	for _, from := range spec.Versions {
+		for _, to := range spec.Versions {
+			pair := versionPair{from: from, to: to}
+			if _, ok := chains[pair]; from != to && !ok {
+				uncovered = append(uncovered, pair)
+			}
+		}
+	}
+	return uncovered
+}
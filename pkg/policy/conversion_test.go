@@ -0,0 +1,270 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"jpbetz.github.com/celpatch/pkg/crd"
+)
+
+func TestConversionPolicy(t *testing.T) {
+	c := compileWidgetConversion(t, loadWidgetConversion(t))
+	cases := []struct {
+		name          string
+		object        string
+		toVersion     string
+		expectedChain []string
+		expected      string
+		// expectedDropped are the paths of the values that the rules did not carry over.
+		expectedDropped []string
+	}{
+		{
+			name:            "spoke to hub",
+			object:          "apiVersion: policy.example.com/v1\nkind: Widget\nspec: {size: 3, color: red}\n",
+			toVersion:       "v2",
+			expectedChain:   []string{"v1", "v2"},
+			expected:        "apiVersion: policy.example.com/v2\nkind: Widget\nspec: {replicas: 3, color: red}\n",
+			expectedDropped: []string{"spec.size"},
+		},
+		{
+			name:            "hub to spoke",
+			object:          "apiVersion: policy.example.com/v2\nkind: Widget\nspec: {replicas: 3}\n",
+			toVersion:       "v3",
+			expectedChain:   []string{"v2", "v3"},
+			expected:        "apiVersion: policy.example.com/v3\nkind: Widget\nspec: {count: 3}\n",
+			expectedDropped: []string{"spec.replicas"},
+		},
+		{
+			name:            "spoke to spoke through the hub",
+			object:          "apiVersion: policy.example.com/v1\nkind: Widget\nspec: {size: 3, color: red}\n",
+			toVersion:       "v3",
+			expectedChain:   []string{"v1", "v2", "v3"},
+			expected:        "apiVersion: policy.example.com/v3\nkind: Widget\nspec: {count: 3, color: red}\n",
+			expectedDropped: []string{"spec.size", "spec.replicas"},
+		},
+		{
+			name:      "same version",
+			object:    "apiVersion: policy.example.com/v3\nkind: Widget\nspec: {count: 3}\n",
+			toVersion: "v3",
+			expected:  "apiVersion: policy.example.com/v3\nkind: Widget\nspec: {count: 3}\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			obj := unmarshal(t, tc.object)
+			if tc.expectedChain != nil {
+				from := obj.(map[string]any)["apiVersion"].(string)[len("policy.example.com/"):]
+				if chain := c.Chain(from, tc.toVersion); !reflect.DeepEqual(tc.expectedChain, chain) {
+					t.Errorf("expected chain %v but got %v", tc.expectedChain, chain)
+				}
+			}
+			result, report, err := c.ConvertWithReport(obj, tc.toVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := unmarshal(t, tc.expected); !reflect.DeepEqual(expected, result) {
+				t.Errorf("expected:\n%v\nbut got:\n%v", expected, result)
+			}
+			var dropped []string
+			for _, d := range report.Dropped {
+				dropped = append(dropped, d.Path)
+			}
+			if !reflect.DeepEqual(tc.expectedDropped, dropped) {
+				t.Errorf("expected dropped values %v but got %v", tc.expectedDropped, dropped)
+			}
+		})
+	}
+
+	_, err := c.Convert(unmarshal(t, "apiVersion: policy.example.com/v1\nkind: Gadget\n"), "v2")
+	if err == nil || !strings.Contains(err.Error(), `ConversionPolicy "widgets" converts Widget.policy.example.com, but got policy.example.com/v1 Gadget`) {
+		t.Errorf("expected an error for the wrong kind, but got %v", err)
+	}
+}
+
+func TestConversionPolicyMesh(t *testing.T) {
+	p := loadWidgetConversion(t)
+	// Convert around a cycle of versions, without a hub.
+	p.Spec.Topology = TopologyMesh
+	p.Spec.Hub = ""
+	p.Spec.Rules = []ConversionRule{
+		{From: "v1", To: "v2", Mode: ModeMerge, Mutation: "Object{spec: Object.spec{replicas: oldObject.spec.size}}"},
+		{From: "v2", To: "v3", Mode: ModeMerge, Mutation: "Object{spec: Object.spec{count: oldObject.spec.replicas}}"},
+		{From: "v3", To: "v1", Mode: ModeMerge, Mutation: "Object{spec: Object.spec{size: oldObject.spec.count}}"},
+	}
+	if errs := ValidateConversionPolicy(p); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	c := compileWidgetConversion(t, p)
+	if chain := c.Chain("v2", "v1"); !reflect.DeepEqual([]string{"v2", "v3", "v1"}, chain) {
+		t.Errorf("expected v2 to be converted to v1 through v3, but got %v", chain)
+	}
+	result, err := c.Convert(unmarshal(t, "apiVersion: policy.example.com/v2\nkind: Widget\nspec: {replicas: 5}\n"), "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := unmarshal(t, "apiVersion: policy.example.com/v1\nkind: Widget\nspec: {size: 5}\n")
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected:\n%v\nbut got:\n%v", expected, result)
+	}
+}
+
+func TestConversionPolicyMatchConditions(t *testing.T) {
+	p := loadWidgetConversion(t)
+	// Sizes are only carried over to v2 if they are positive.
+	p.Spec.Rules[0].MatchConditions = []MatchCondition{{Name: "positive", Expression: "oldObject.spec.size > 0"}}
+	c := compileWidgetConversion(t, p)
+	for _, tc := range []struct{ object, expected string }{
+		{
+			object:   "apiVersion: policy.example.com/v1\nkind: Widget\nspec: {size: 3, color: red}\n",
+			expected: "apiVersion: policy.example.com/v2\nkind: Widget\nspec: {replicas: 3, color: red}\n",
+		},
+		{
+			object:   "apiVersion: policy.example.com/v1\nkind: Widget\nspec: {size: 0, color: red}\n",
+			expected: "apiVersion: policy.example.com/v2\nkind: Widget\nspec: {color: red}\n",
+		},
+	} {
+		result, err := c.Convert(unmarshal(t, tc.object), "v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := unmarshal(t, tc.expected); !reflect.DeepEqual(expected, result) {
+			t.Errorf("expected:\n%v\nbut got:\n%v", expected, result)
+		}
+	}
+}
+
+func TestValidateConversionPolicy(t *testing.T) {
+	cases := []struct {
+		name          string
+		modify        func(p *ConversionPolicySpec)
+		expectedError string
+	}{
+		{
+			name:          "one version",
+			modify:        func(p *ConversionPolicySpec) { p.Versions = p.Versions[:1]; p.Rules = nil; p.Hub = "v1" },
+			expectedError: "spec.versions: Required value: at least two versions are required",
+		},
+		{
+			name:          "duplicate version",
+			modify:        func(p *ConversionPolicySpec) { p.Versions = append(p.Versions, "v1") },
+			expectedError: `spec.versions[3]: Duplicate value: "v1"`,
+		},
+		{
+			name:          "no hub",
+			modify:        func(p *ConversionPolicySpec) { p.Hub = "" },
+			expectedError: "spec.hub: Required value: required when topology is HubAndSpoke",
+		},
+		{
+			name:          "hub is not a version",
+			modify:        func(p *ConversionPolicySpec) { p.Hub = "v4" },
+			expectedError: `spec.hub: Invalid value: "v4": must be one of the versions`,
+		},
+		{
+			name:          "hub of mesh",
+			modify:        func(p *ConversionPolicySpec) { p.Topology = TopologyMesh },
+			expectedError: "spec.hub: Forbidden: may only be set when topology is HubAndSpoke",
+		},
+		{
+			name:          "rule of unknown version",
+			modify:        func(p *ConversionPolicySpec) { p.Rules[0].From = "v4" },
+			expectedError: `spec.rules[0].from: Invalid value: "v4": must be one of the versions`,
+		},
+		{
+			name:          "rule to the same version",
+			modify:        func(p *ConversionPolicySpec) { p.Rules[0].To = "v1" },
+			expectedError: `spec.rules[0].to: Invalid value: "v1": must differ from the from version`,
+		},
+		{
+			name:          "duplicate rule",
+			modify:        func(p *ConversionPolicySpec) { p.Rules = append(p.Rules, p.Rules[0]) },
+			expectedError: `spec.rules[4]: Duplicate value: "v1 to v2"`,
+		},
+		{
+			name:          "rule without mutation",
+			modify:        func(p *ConversionPolicySpec) { p.Rules[0].Mutation = "" },
+			expectedError: "spec.rules[0].mutation: Required value",
+		},
+		{
+			name: "match condition without name",
+			modify: func(p *ConversionPolicySpec) {
+				p.Rules[0].MatchConditions = []MatchCondition{{Expression: "true"}}
+			},
+			expectedError: "spec.rules[0].matchConditions[0].name: Required value",
+		},
+		{
+			name:          "unsupported rule failure policy",
+			modify:        func(p *ConversionPolicySpec) { p.Rules[0].FailurePolicy = "Retry" },
+			expectedError: `spec.rules[0].failurePolicy: Unsupported value: "Retry"`,
+		},
+		{
+			name:          "spoke not converted to hub",
+			modify:        func(p *ConversionPolicySpec) { p.Rules = p.Rules[:2] },
+			expectedError: "spec.rules: Required value: no conversion from v3 to v2",
+		},
+		{
+			name: "mesh not covered",
+			modify: func(p *ConversionPolicySpec) {
+				p.Topology = TopologyMesh
+				p.Hub = ""
+				p.Rules = p.Rules[:3]
+			},
+			expectedError: "spec.rules: Required value: no conversion from v1 to v3",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := loadWidgetConversion(t)
+			tc.modify(&p.Spec)
+			errs := ValidateConversionPolicy(p)
+			if len(errs) == 0 {
+				t.Fatal("expected errors")
+			}
+			if !strings.Contains(errs.ToAggregate().Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, errs)
+			}
+		})
+	}
+}
+
+func loadWidgetConversion(t *testing.T) *ConversionPolicy {
+	t.Helper()
+	policies, err := LoadFile(filepath.Join(testdata, "policy/widget-conversion.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies.ConversionPolicies) != 1 {
+		t.Fatalf("expected 1 ConversionPolicy but got %d", len(policies.ConversionPolicies))
+	}
+	return policies.ConversionPolicies[0]
+}
+
+func compileWidgetConversion(t *testing.T, p *ConversionPolicy) *CompiledConversionPolicy {
+	t.Helper()
+	widgets, err := crd.LoadFile(filepath.Join(testdata, "policy/widget-crd.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := CompileConversionPolicy(p, widgets.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
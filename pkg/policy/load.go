@@ -0,0 +1,313 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	kjson "sigs.k8s.io/json"
+	"sigs.k8s.io/yaml"
+)
+
+// Policies are the policies loaded from a file.
+type Policies struct {
+	MutationPolicies   []*MutationPolicy
+	ConversionPolicies []*ConversionPolicy
+}
+
+// Load parses the MutationPolicies and ConversionPolicies in data, which may contain any number of
+// YAML documents or a single JSON document. The policies are defaulted and validated.
+func Load(data []byte) (*Policies, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	policies := &Policies{}
+	for i := 0; ; i++ {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return policies, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		if err := policies.decode(doc); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+	}
+}
+
+// LoadFile parses the MutationPolicies and ConversionPolicies in file.
+func LoadFile(file string) (*Policies, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policies from %s: %w", file, err)
+	}
+	return policies, nil
+}
+
+func (p *Policies) decode(doc []byte) error {
+	j, err := yaml.YAMLToJSON(doc)
+	if err != nil {
+		return err
+	}
+	typeMeta := &metav1.TypeMeta{}
+	if err := json.Unmarshal(j, typeMeta); err != nil {
+		return err
+	}
+	if typeMeta.APIVersion != SchemeGroupVersion.String() {
+		return fmt.Errorf("expected apiVersion %s, but got %q", SchemeGroupVersion, typeMeta.APIVersion)
+	}
+	switch typeMeta.Kind {
+	case "MutationPolicy":
+		policy := &MutationPolicy{}
+		if err := decodeStrict(j, policy); err != nil {
+			return err
+		}
+		SetMutationPolicyDefaults(policy)
+		if errs := ValidateMutationPolicy(policy); len(errs) > 0 {
+			return fmt.Errorf("invalid MutationPolicy %q: %w", policy.Name, errs.ToAggregate())
+		}
+		p.MutationPolicies = append(p.MutationPolicies, policy)
+	case "ConversionPolicy":
+		policy := &ConversionPolicy{}
+		if err := decodeStrict(j, policy); err != nil {
+			return err
+		}
+		SetConversionPolicyDefaults(policy)
+		if errs := ValidateConversionPolicy(policy); len(errs) > 0 {
+			return fmt.Errorf("invalid ConversionPolicy %q: %w", policy.Name, errs.ToAggregate())
+		}
+		p.ConversionPolicies = append(p.ConversionPolicies, policy)
+	default:
+		return fmt.Errorf("expected kind MutationPolicy or ConversionPolicy, but got %q", typeMeta.Kind)
+	}
+	return nil
+}
+
+// decodeStrict decodes the JSON document j into v, and returns an error for unknown and duplicate
+// fields. Integers are decoded as int64 rather than float64, as the apply package requires.
+func decodeStrict(j []byte, v any) error {
+	strictErrs, err := kjson.UnmarshalStrict(j, v, kjson.DisallowUnknownFields)
+	if err != nil {
+		return err
+	}
+	return utilerrors.NewAggregate(strictErrs)
+}
+
+// SetMutationPolicyDefaults sets the defaults of the unset fields of the policy.
+func SetMutationPolicyDefaults(p *MutationPolicy) {
+	if len(p.Spec.Mode) == 0 {
+		p.Spec.Mode = ModeMerge
+	}
+	if len(p.Spec.FailurePolicy) == 0 {
+		p.Spec.FailurePolicy = Fail
+	}
+}
+
+// SetConversionPolicyDefaults sets the defaults of the unset fields of the policy.
+func SetConversionPolicyDefaults(p *ConversionPolicy) {
+	if len(p.Spec.Topology) == 0 {
+		p.Spec.Topology = TopologyMesh
+	}
+	for i := range p.Spec.Rules {
+		if len(p.Spec.Rules[i].Mode) == 0 {
+			p.Spec.Rules[i].Mode = ModeMerge
+		}
+	}
+}
+
+// ValidateMutationPolicy returns the errors of the policy, which must have been defaulted.
+func ValidateMutationPolicy(p *MutationPolicy) field.ErrorList {
+	var errs field.ErrorList
+	if len(p.Name) == 0 {
+		errs = append(errs, field.Required(field.NewPath("metadata", "name"), ""))
+	}
+	spec := field.NewPath("spec")
+	errs = append(errs, validateMatch(&p.Spec.Match, spec.Child("match"))...)
+	errs = append(errs, validateMutation(p.Spec.Mode, p.Spec.Mutation, p.Spec.Template, spec)...)
+	errs = append(errs, validateMatchConditions(p.Spec.MatchConditions, spec.Child("matchConditions"))...)
+	errs = append(errs, validateFailurePolicy(p.Spec.FailurePolicy, spec.Child("failurePolicy"))...)
+	return errs
+}
+
+func validateFailurePolicy(failurePolicy FailurePolicyType, path *field.Path) field.ErrorList {
+	switch failurePolicy {
+	case Fail, Ignore:
+		return nil
+	default:
+		return field.ErrorList{field.NotSupported(path, failurePolicy, []string{string(Fail), string(Ignore)})}
+	}
+}
+
+func validateMatchConditions(conditions []MatchCondition, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	names := map[string]bool{}
+	for i, condition := range conditions {
+		switch {
+		case len(condition.Name) == 0:
+			errs = append(errs, field.Required(path.Index(i).Child("name"), ""))
+		case names[condition.Name]:
+			errs = append(errs, field.Duplicate(path.Index(i).Child("name"), condition.Name))
+		}
+		names[condition.Name] = true
+		if len(condition.Expression) == 0 {
+			errs = append(errs, field.Required(path.Index(i).Child("expression"), ""))
+		}
+	}
+	return errs
+}
+
+// validateMutation validates the mode, mutation and template fields at path.
+func validateMutation(mode Mode, mutation string, template any, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	switch mode {
+	case ModeMerge, ModeApply:
+		if len(mutation) == 0 {
+			errs = append(errs, field.Required(path.Child("mutation"), fmt.Sprintf("required when mode is %s", mode)))
+		}
+		if template != nil {
+			errs = append(errs, field.Forbidden(path.Child("template"), fmt.Sprintf("may only be set when mode is %s", ModeTemplate)))
+		}
+	case ModeTemplate:
+		if template == nil {
+			errs = append(errs, field.Required(path.Child("template"), fmt.Sprintf("required when mode is %s", ModeTemplate)))
+		}
+		if len(mutation) > 0 {
+			errs = append(errs, field.Forbidden(path.Child("mutation"), fmt.Sprintf("may not be set when mode is %s", ModeTemplate)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(path.Child("mode"), mode, []string{string(ModeMerge), string(ModeApply), string(ModeTemplate)}))
+	}
+	return errs
+}
+
+func validateMatch(m *Match, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if len(m.Kinds) == 0 {
+		errs = append(errs, field.Required(path.Child("kinds"), "at least one kind is required"))
+	}
+	for i, kind := range m.Kinds {
+		if len(kind.Version) == 0 {
+			errs = append(errs, field.Required(path.Child("kinds").Index(i).Child("version"), ""))
+		}
+		if len(kind.Kind) == 0 {
+			errs = append(errs, field.Required(path.Child("kinds").Index(i).Child("kind"), ""))
+		}
+	}
+	for i, ns := range m.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(path.Child("namespaces").Index(i), ns, msg))
+		}
+	}
+	if m.ObjectSelector != nil {
+		errs = append(errs, metav1validation.ValidateLabelSelector(m.ObjectSelector, metav1validation.LabelSelectorValidationOptions{}, path.Child("objectSelector"))...)
+	}
+	return errs
+}
+
+// ValidateConversionPolicy returns the errors of the policy, which must have been defaulted. The
+// rules must convert between all the pairs of versions required by the topology.
+func ValidateConversionPolicy(p *ConversionPolicy) field.ErrorList {
+	var errs field.ErrorList
+	if len(p.Name) == 0 {
+		errs = append(errs, field.Required(field.NewPath("metadata", "name"), ""))
+	}
+	spec := field.NewPath("spec")
+	if len(p.Spec.Group) == 0 {
+		errs = append(errs, field.Required(spec.Child("group"), ""))
+	}
+	if len(p.Spec.Kind) == 0 {
+		errs = append(errs, field.Required(spec.Child("kind"), ""))
+	}
+	if len(p.Spec.Versions) < 2 {
+		errs = append(errs, field.Required(spec.Child("versions"), "at least two versions are required"))
+	}
+	versions := map[string]bool{}
+	for i, v := range p.Spec.Versions {
+		switch {
+		case len(v) == 0:
+			errs = append(errs, field.Required(spec.Child("versions").Index(i), ""))
+		case versions[v]:
+			errs = append(errs, field.Duplicate(spec.Child("versions").Index(i), v))
+		}
+		versions[v] = true
+	}
+
+	switch p.Spec.Topology {
+	case TopologyMesh:
+		if len(p.Spec.Hub) > 0 {
+			errs = append(errs, field.Forbidden(spec.Child("hub"), fmt.Sprintf("may only be set when topology is %s", TopologyHubAndSpoke)))
+		}
+	case TopologyHubAndSpoke:
+		if len(p.Spec.Hub) == 0 {
+			errs = append(errs, field.Required(spec.Child("hub"), fmt.Sprintf("required when topology is %s", TopologyHubAndSpoke)))
+		} else if !versions[p.Spec.Hub] {
+			errs = append(errs, field.Invalid(spec.Child("hub"), p.Spec.Hub, "must be one of the versions"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(spec.Child("topology"), p.Spec.Topology, []string{string(TopologyMesh), string(TopologyHubAndSpoke)}))
+	}
+
+	rules := map[versionPair]bool{}
+	for i, rule := range p.Spec.Rules {
+		path := spec.Child("rules").Index(i)
+		if !versions[rule.From] {
+			errs = append(errs, field.Invalid(path.Child("from"), rule.From, "must be one of the versions"))
+		}
+		if !versions[rule.To] {
+			errs = append(errs, field.Invalid(path.Child("to"), rule.To, "must be one of the versions"))
+		} else if rule.To == rule.From {
+			errs = append(errs, field.Invalid(path.Child("to"), rule.To, "must differ from the from version"))
+		}
+		pair := versionPair{from: rule.From, to: rule.To}
+		if rules[pair] {
+			errs = append(errs, field.Duplicate(path, fmt.Sprintf("%s to %s", rule.From, rule.To)))
+		}
+		rules[pair] = true
+		errs = append(errs, validateMutation(rule.Mode, rule.Mutation, rule.Template, path)...)
+		errs = append(errs, validateMatchConditions(rule.MatchConditions, path.Child("matchConditions"))...)
+		if len(rule.FailurePolicy) > 0 {
+			errs = append(errs, validateFailurePolicy(rule.FailurePolicy, path.Child("failurePolicy"))...)
+		}
+	}
+	if len(errs) > 0 {
+		// Coverage is only meaningful for valid versions and rules.
+		return errs
+	}
+
+	for _, pair := range uncoveredPairs(&p.Spec) {
+		errs = append(errs, field.Required(spec.Child("rules"), fmt.Sprintf("no conversion from %s to %s", pair.from, pair.to)))
+	}
+	return errs
+}
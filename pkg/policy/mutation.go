@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/cel/openapi/resolver"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+)
+
+// CompiledMutationPolicy is a MutationPolicy whose mutation has been compiled against the schemas
+// of all the kinds it matches. It is safe for concurrent use.
+type CompiledMutationPolicy struct {
+	Policy *MutationPolicy
+
+	kinds      []schema.GroupVersionKind
+	mutations  map[schema.GroupVersionKind]*apply.CompiledMutation
+	namespaces map[string]bool
+	selector   labels.Selector
+}
+
+// CompileMutationPolicy compiles the mutation of the policy for each of the kinds it matches, using
+// the schemas resolved by schemas. The policy must have been defaulted and validated, as Load does.
+func CompileMutationPolicy(p *MutationPolicy, schemas resolver.SchemaResolver) (*CompiledMutationPolicy, error) {
+	c := &CompiledMutationPolicy{
+		Policy:    p,
+		mutations: map[schema.GroupVersionKind]*apply.CompiledMutation{},
+		selector:  labels.Everything(),
+	}
+	if len(p.Spec.Match.Namespaces) > 0 {
+		c.namespaces = map[string]bool{}
+		for _, ns := range p.Spec.Match.Namespaces {
+			c.namespaces[ns] = true
+		}
+	}
+	if p.Spec.Match.ObjectSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.Match.ObjectSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objectSelector of MutationPolicy %q: %w", p.Name, err)
+		}
+		c.selector = selector
+	}
+
+	var opts []apply.CompileOption
+	if p.Spec.Params != nil {
+		opts = append(opts, apply.WithParams(p.Spec.Params))
+	}
+	if len(p.Spec.MatchConditions) > 0 {
+		opts = append(opts, matchConditionsOption(p.Spec.MatchConditions, p.Spec.FailurePolicy))
+	}
+	for _, kind := range p.Spec.Match.Kinds {
+		gvk := schema.GroupVersionKind(kind)
+		if _, ok := c.mutations[gvk]; ok {
+			continue
+		}
+		s, err := schemas.ResolveSchema(gvk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the schema of %s for MutationPolicy %q: %w", gvk, p.Name, err)
+		}
+		var mutation *apply.CompiledMutation
+		switch p.Spec.Mode {
+		case ModeApply:
+			mutation, err = apply.CompileMutateApply(s, map[string]any{"mutation": p.Spec.Mutation}, opts...)
+		case ModeTemplate:
+			mutation, err = apply.CompileMutateWithTemplate(s, p.Spec.Template, opts...)
+		default:
+			mutation, err = apply.CompileMutateBasicMerge(s, map[string]any{"mutation": p.Spec.Mutation}, opts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile MutationPolicy %q for %s: %w", p.Name, gvk, err)
+		}
+		c.kinds = append(c.kinds, gvk)
+		c.mutations[gvk] = mutation
+	}
+	return c, nil
+}
+
+// Kinds returns the kinds of the objects that the policy matches.
+func (c *CompiledMutationPolicy) Kinds() []schema.GroupVersionKind {
+	return c.kinds
+}
+
+// Schema returns the schema of the objects of the kind gvk that the policy was compiled for, or nil
+// if the policy does not match the kind.
+func (c *CompiledMutationPolicy) Schema(gvk schema.GroupVersionKind) *spec.Schema {
+	mutation, ok := c.mutations[gvk]
+	if !ok {
+		return nil
+	}
+	return mutation.Schema()
+}
+
+// Matches returns true if the policy mutates objects of the kind gvk, in the namespace, with the
+// labels. namespace is empty for objects that are not namespaced.
+func (c *CompiledMutationPolicy) Matches(gvk schema.GroupVersionKind, namespace string, objectLabels map[string]string) bool {
+	if _, ok := c.mutations[gvk]; !ok {
+		return false
+	}
+	if c.namespaces != nil && !c.namespaces[namespace] {
+		return false
+	}
+	return c.selector.Matches(labels.Set(objectLabels))
+}
+
+// Apply returns the result of mutating obj, which is of the kind gvk. Whether the policy matches
+// obj is not checked, but obj is returned unchanged if the match conditions of the policy are not
+// all true. If the mutation fails and the failure policy is Ignore, obj is returned unchanged.
+func (c *CompiledMutationPolicy) Apply(gvk schema.GroupVersionKind, obj any) (any, error) {
+	return c.ApplyWithRequest(gvk, obj, nil)
+}
+
+// ApplyWithRequest is Apply with request, the unstructured attributes of an admission request, as
+// the request variable of the match conditions.
+func (c *CompiledMutationPolicy) ApplyWithRequest(gvk schema.GroupVersionKind, obj, request any) (any, error) {
+	mutation, ok := c.mutations[gvk]
+	if !ok {
+		return nil, fmt.Errorf("MutationPolicy %q does not match %s", c.Policy.Name, gvk)
+	}
+	result, err := mutation.ApplyWithRequest(obj, request)
+	if err != nil {
+		if c.Policy.Spec.FailurePolicy == Ignore {
+			return obj, nil
+		}
+		return nil, fmt.Errorf("MutationPolicy %q failed: %w", c.Policy.Name, err)
+	}
+	return result, nil
+}
+
+// matchConditionsOption returns the option that compiles the match conditions of a policy or rule.
+// An unset failure policy is Fail.
+func matchConditionsOption(conditions []MatchCondition, failurePolicy FailurePolicyType) apply.CompileOption {
+	if len(failurePolicy) == 0 {
+		failurePolicy = Fail
+	}
+	compiled := make([]apply.MatchCondition, len(conditions))
+	for i, c := range conditions {
+		compiled[i] = apply.MatchCondition{Name: c.Name, Expression: c.Expression}
+	}
+	return apply.WithMatchConditions(apply.MatchFailurePolicy(failurePolicy), compiled...)
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/builtin"
+)
+
+const testdata = "../../testdata"
+
+var (
+	podGVK        = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	deploymentGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+)
+
+func TestLoadFile(t *testing.T) {
+	policies, err := LoadFile(filepath.Join(testdata, "policy/policies.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies.MutationPolicies) != 2 || len(policies.ConversionPolicies) != 0 {
+		t.Fatalf("expected 2 MutationPolicies but got %d, and no ConversionPolicies but got %d", len(policies.MutationPolicies), len(policies.ConversionPolicies))
+	}
+	injectProxy, teamLabel := policies.MutationPolicies[0], policies.MutationPolicies[1]
+	if injectProxy.Name != "inject-proxy" || teamLabel.Name != "team-label" {
+		t.Errorf("expected policies inject-proxy and team-label but got %s and %s", injectProxy.Name, teamLabel.Name)
+	}
+	if injectProxy.Spec.Mode != ModeMerge || injectProxy.Spec.FailurePolicy != Fail {
+		t.Errorf("expected mode and failure policy to default to %s and %s, but got %s and %s", ModeMerge, Fail, injectProxy.Spec.Mode, injectProxy.Spec.FailurePolicy)
+	}
+	if teamLabel.Spec.Mode != ModeTemplate || teamLabel.Spec.FailurePolicy != Ignore {
+		t.Errorf("expected mode %s and failure policy %s, but got %s and %s", ModeTemplate, Ignore, teamLabel.Spec.Mode, teamLabel.Spec.FailurePolicy)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	const header = "apiVersion: celpatch.jpbetz.github.com/v1alpha1\nkind: MutationPolicy\nmetadata: {name: p}\n"
+	const match = "  match: {kinds: [{version: v1, kind: Pod}]}\n"
+	cases := []struct {
+		name          string
+		data          string
+		expectedError string
+	}{
+		{
+			name:          "wrong apiVersion",
+			data:          "apiVersion: v1\nkind: Pod\n",
+			expectedError: `expected apiVersion celpatch.jpbetz.github.com/v1alpha1, but got "v1"`,
+		},
+		{
+			name:          "wrong kind",
+			data:          "apiVersion: celpatch.jpbetz.github.com/v1alpha1\nkind: Pod\n",
+			expectedError: `expected kind MutationPolicy or ConversionPolicy, but got "Pod"`,
+		},
+		{
+			name:          "unknown field",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n  mutations: Object{}\n",
+			expectedError: `unknown field "spec.mutations"`,
+		},
+		{
+			name:          "no name",
+			data:          "apiVersion: celpatch.jpbetz.github.com/v1alpha1\nkind: MutationPolicy\nspec:\n" + match + "  mutation: Object{}\n",
+			expectedError: "metadata.name: Required value",
+		},
+		{
+			name:          "no kinds",
+			data:          header + "spec:\n  mutation: Object{}\n",
+			expectedError: "spec.match.kinds: Required value",
+		},
+		{
+			name:          "kind without version",
+			data:          header + "spec:\n  match: {kinds: [{kind: Pod}]}\n  mutation: Object{}\n",
+			expectedError: "spec.match.kinds[0].version: Required value",
+		},
+		{
+			name:          "invalid namespace",
+			data:          header + "spec:\n  match: {kinds: [{version: v1, kind: Pod}], namespaces: [Default]}\n  mutation: Object{}\n",
+			expectedError: `spec.match.namespaces[0]: Invalid value: "Default"`,
+		},
+		{
+			name:          "invalid object selector",
+			data:          header + "spec:\n  match: {kinds: [{version: v1, kind: Pod}], objectSelector: {matchExpressions: [{key: app, operator: Exists, values: [web]}]}}\n  mutation: Object{}\n",
+			expectedError: "spec.match.objectSelector.matchExpressions[0].values: Forbidden",
+		},
+		{
+			name:          "no mutation",
+			data:          header + "spec:\n" + match,
+			expectedError: "spec.mutation: Required value: required when mode is Merge",
+		},
+		{
+			name:          "template in merge mode",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n  template: {}\n",
+			expectedError: "spec.template: Forbidden: may only be set when mode is Template",
+		},
+		{
+			name:          "no template",
+			data:          header + "spec:\n" + match + "  mode: Template\n",
+			expectedError: "spec.template: Required value: required when mode is Template",
+		},
+		{
+			name:          "unsupported mode",
+			data:          header + "spec:\n" + match + "  mode: Replace\n  mutation: Object{}\n",
+			expectedError: `spec.mode: Unsupported value: "Replace"`,
+		},
+		{
+			name:          "unsupported failure policy",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n  failurePolicy: Retry\n",
+			expectedError: `spec.failurePolicy: Unsupported value: "Retry"`,
+		},
+		{
+			name:          "duplicate match condition",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n  matchConditions: [{name: a, expression: 'true'}, {name: a, expression: 'false'}]\n",
+			expectedError: `spec.matchConditions[1].name: Duplicate value: "a"`,
+		},
+		{
+			name:          "match condition without expression",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n  matchConditions: [{name: a}]\n",
+			expectedError: "spec.matchConditions[0].expression: Required value",
+		},
+		{
+			name:          "error in second document",
+			data:          header + "spec:\n" + match + "  mutation: Object{}\n---\n" + header,
+			expectedError: "document 1:",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load([]byte(tc.data))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestCompiledMutationPolicy(t *testing.T) {
+	policies, err := LoadFile(filepath.Join(testdata, "policy/policies.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := builtin.NewResolver()
+	injectProxy, err := CompileMutationPolicy(policies.MutationPolicies[0], schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamLabel, err := CompileMutationPolicy(policies.MutationPolicies[1], schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := map[string]string{"app": "web"}
+	matchCases := []struct {
+		name      string
+		policy    *CompiledMutationPolicy
+		gvk       schema.GroupVersionKind
+		namespace string
+		labels    map[string]string
+		expected  bool
+	}{
+		{name: "matching pod", policy: injectProxy, gvk: podGVK, namespace: "default", labels: web, expected: true},
+		{name: "other kind", policy: injectProxy, gvk: deploymentGVK, namespace: "default", labels: web},
+		{name: "other namespace", policy: injectProxy, gvk: podGVK, namespace: "kube-system", labels: web},
+		{name: "other labels", policy: injectProxy, gvk: podGVK, namespace: "default", labels: map[string]string{"app": "db"}},
+		{name: "any namespace and labels", policy: teamLabel, gvk: deploymentGVK, namespace: "kube-system", expected: true},
+	}
+	for _, tc := range matchCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if matches := tc.policy.Matches(tc.gvk, tc.namespace, tc.labels); matches != tc.expected {
+				t.Errorf("expected Matches to return %v", tc.expected)
+			}
+		})
+	}
+
+	pod := unmarshal(t, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  labels: {app: web}
+spec:
+  containers:
+  - {name: app, image: "app:1.0"}
+`)
+	result, err := injectProxy.Apply(podGVK, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = teamLabel.Apply(podGVK, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := unmarshal(t, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  labels: {app: web, team: payments}
+spec:
+  containers:
+  - {name: app, image: "app:1.0"}
+  - {name: proxy, image: "proxy:1.0", args: ["--port=15001"]}
+`)
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected:\n%v\nbut got:\n%v", expected, result)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	pod := unmarshal(t, "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n")
+	for _, failurePolicy := range []FailurePolicyType{Fail, Ignore} {
+		t.Run(string(failurePolicy), func(t *testing.T) {
+			p := &MutationPolicy{Spec: MutationPolicySpec{
+				Match:         Match{Kinds: []metav1.GroupVersionKind{metav1.GroupVersionKind(podGVK)}},
+				Mutation:      "Object{metadata: Object.metadata{annotations: {'app': oldObject.metadata.labels['app']}}}",
+				FailurePolicy: failurePolicy,
+			}}
+			p.Name = "app-annotation"
+			SetMutationPolicyDefaults(p)
+			compiled, err := CompileMutationPolicy(p, builtin.NewResolver())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The pod has no labels, so the mutation fails.
+			result, err := compiled.Apply(podGVK, pod)
+			switch failurePolicy {
+			case Fail:
+				if err == nil || !strings.Contains(err.Error(), `MutationPolicy "app-annotation" failed`) {
+					t.Errorf("expected the mutation to fail, but got %v", err)
+				}
+			case Ignore:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(pod, result) {
+					t.Errorf("expected the pod to be unchanged, but got %v", result)
+				}
+			}
+		})
+	}
+}
+
+func TestMutationPolicyMatchConditions(t *testing.T) {
+	p := &MutationPolicy{Spec: MutationPolicySpec{
+		Match:    Match{Kinds: []metav1.GroupVersionKind{metav1.GroupVersionKind(podGVK)}},
+		Mutation: "Object{metadata: Object.metadata{annotations: {'owner': 'platform'}}}",
+		MatchConditions: []MatchCondition{
+			{Name: "create", Expression: "request.operation == 'CREATE' && request.userInfo.username != 'admin'"},
+			{Name: "not-annotated", Expression: "!has(oldObject.metadata.annotations)"},
+		},
+	}}
+	p.Name = "owner-annotation"
+	SetMutationPolicyDefaults(p)
+	if errs := ValidateMutationPolicy(p); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	compiled, err := CompileMutationPolicy(p, builtin.NewResolver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name          string
+		pod           string
+		request       any
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "conditions are true",
+			pod:      "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+			request:  map[string]any{"operation": "CREATE", "userInfo": map[string]any{"username": "alice"}},
+			expected: "apiVersion: v1\nkind: Pod\nmetadata: {name: web, annotations: {owner: platform}}\n",
+		},
+		{
+			name:     "other operation",
+			pod:      "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+			request:  map[string]any{"operation": "UPDATE", "userInfo": map[string]any{"username": "alice"}},
+			expected: "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+		},
+		{
+			name:     "other user",
+			pod:      "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+			request:  map[string]any{"operation": "CREATE", "userInfo": map[string]any{"username": "admin"}},
+			expected: "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+		},
+		{
+			name:     "already annotated",
+			pod:      "apiVersion: v1\nkind: Pod\nmetadata: {name: web, annotations: {owner: bob}}\n",
+			request:  map[string]any{"operation": "CREATE", "userInfo": map[string]any{"username": "alice"}},
+			expected: "apiVersion: v1\nkind: Pod\nmetadata: {name: web, annotations: {owner: bob}}\n",
+		},
+		{
+			name:          "no request",
+			pod:           "apiVersion: v1\nkind: Pod\nmetadata: {name: web}\n",
+			expectedError: `MutationPolicy "owner-annotation" failed: match condition "create" failed`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := compiled.ApplyWithRequest(podGVK, unmarshal(t, tc.pod), tc.request)
+			if len(tc.expectedError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Errorf("expected error containing %q but got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := unmarshal(t, tc.expected); !reflect.DeepEqual(expected, result) {
+				t.Errorf("expected:\n%v\nbut got:\n%v", expected, result)
+			}
+		})
+	}
+}
+
+func unmarshal(t *testing.T, s string) any {
+	t.Helper()
+	j, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result any
+	if err := utiljson.Unmarshal(j, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
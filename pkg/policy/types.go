@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy defines the declarative configuration of mutations and conversions, which may be
+// shipped as files of YAML documents, and compiles them with the apply package.
+package policy
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the configuration types.
+const GroupName = "celpatch.jpbetz.github.com"
+
+// SchemeGroupVersion is the group and version of the configuration types.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// MutationPolicy mutates the objects it matches with a CEL expression or template.
+type MutationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MutationPolicySpec `json:"spec"`
+}
+
+// MutationPolicySpec is the specification of a MutationPolicy.
+type MutationPolicySpec struct {
+	// Match selects the objects that are mutated.
+	Match Match `json:"match"`
+	// Mode is how the mutation is applied. Defaults to Merge.
+	Mode Mode `json:"mode,omitempty"`
+	// Mutation is the CEL expression of a Merge or Apply mode policy.
+	Mutation string `json:"mutation,omitempty"`
+	// Template is the template of a Template mode policy, containing `{$: "<CEL expression>"}`
+	// directives.
+	Template any `json:"template,omitempty"`
+	// Params are made available to the expressions of the policy as the params variable.
+	Params any `json:"params,omitempty"`
+	// MatchConditions must all evaluate to true for a matched object to be mutated. They may
+	// access the object as oldObject, params and the attributes of the admission request, other
+	// than its objects and options, as request. request is null when the policy is applied
+	// outside of admission.
+	MatchConditions []MatchCondition `json:"matchConditions,omitempty"`
+	// FailurePolicy is what happens when the mutation, or one of its match conditions, fails.
+	// Defaults to Fail.
+	FailurePolicy FailurePolicyType `json:"failurePolicy,omitempty"`
+}
+
+// MatchCondition is a CEL expression that must evaluate to true for a mutation or conversion rule
+// to be applied.
+type MatchCondition struct {
+	// Name identifies the condition, and must be unique among the conditions of a policy or rule.
+	Name string `json:"name"`
+	// Expression is the CEL expression, which must evaluate to a bool.
+	Expression string `json:"expression"`
+}
+
+// Match selects objects by their kind, namespace and labels. An object is matched if it is
+// matched by all the criteria.
+type Match struct {
+	// Kinds are the kinds of the objects that are matched. At least one kind is required.
+	Kinds []metav1.GroupVersionKind `json:"kinds"`
+	// Namespaces, if not empty, limits the matched objects to those in the namespaces. Objects
+	// that are not namespaced are not matched if namespaces are given.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ObjectSelector, if set, limits the matched objects to those with matching labels.
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+}
+
+// Mode is how the mutation of a MutationPolicy is applied.
+type Mode string
+
+const (
+	// ModeMerge merges the apply configuration that the mutation evaluates to into the object.
+	ModeMerge Mode = "Merge"
+	// ModeApply applies the mutation to the object using objects.apply().
+	ModeApply Mode = "Apply"
+	// ModeTemplate evaluates the directives of the template and merges the result into the object.
+	ModeTemplate Mode = "Template"
+)
+
+// FailurePolicyType is what happens when a mutation fails.
+type FailurePolicyType string
+
+const (
+	// Fail returns the error of the failed mutation.
+	Fail FailurePolicyType = "Fail"
+	// Ignore leaves the object unchanged if the mutation fails.
+	Ignore FailurePolicyType = "Ignore"
+)
+
+// ConversionPolicy converts custom resources between the versions of a CustomResourceDefinition
+// with a CEL expression or template for each pair of versions that is converted directly.
+type ConversionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ConversionPolicySpec `json:"spec"`
+}
+
+// ConversionPolicySpec is the specification of a ConversionPolicy.
+type ConversionPolicySpec struct {
+	// Group is the API group of the custom resources.
+	Group string `json:"group"`
+	// Kind is the kind of the custom resources.
+	Kind string `json:"kind"`
+	// Versions are the versions that objects are converted between. At least two versions are
+	// required.
+	Versions []string `json:"versions"`
+	// Topology is which pairs of versions must be converted by a rule. Defaults to Mesh.
+	Topology Topology `json:"topology,omitempty"`
+	// Hub is the version that all other versions are converted to and from when the topology is
+	// HubAndSpoke.
+	Hub string `json:"hub,omitempty"`
+	// Params are made available to the expressions of all the rules as the params variable.
+	Params any `json:"params,omitempty"`
+	// Rules are the direct conversions between pairs of versions.
+	Rules []ConversionRule `json:"rules"`
+}
+
+// Topology is which pairs of versions of a ConversionPolicy must be converted by a rule. Objects
+// are converted between versions that have no rule by chaining the rules of intermediate versions.
+type Topology string
+
+const (
+	// TopologyMesh requires that every version can be converted to every other version, either by
+	// a rule or by a chain of rules through intermediate versions.
+	TopologyMesh Topology = "Mesh"
+	// TopologyHubAndSpoke requires rules that convert every version to and from the hub. Other
+	// versions are converted through the hub, unless there is a rule that converts them directly.
+	TopologyHubAndSpoke Topology = "HubAndSpoke"
+)
+
+// ConversionRule converts objects from one version to another.
+type ConversionRule struct {
+	// From is the version that objects are converted from.
+	From string `json:"from"`
+	// To is the version that objects are converted to.
+	To string `json:"to"`
+	// Mode is how the mutation is applied to the object converted from the from version. Defaults
+	// to Merge.
+	Mode Mode `json:"mode,omitempty"`
+	// Mutation is the CEL expression of a Merge or Apply mode rule.
+	Mutation string `json:"mutation,omitempty"`
+	// Template is the template of a Template mode rule.
+	Template any `json:"template,omitempty"`
+	// MatchConditions must all evaluate to true for the mutation of the rule to be applied. When
+	// they are not, objects are converted only by dropping the fields that are not compatible with
+	// the to version. They may access oldObject, convertedObject and params. request is null.
+	MatchConditions []MatchCondition `json:"matchConditions,omitempty"`
+	// FailurePolicy is what happens when a match condition fails to evaluate. Fail fails the
+	// conversion, and Ignore converts the object as if a condition were false. Unset is Fail.
+	FailurePolicy FailurePolicyType `json:"failurePolicy,omitempty"`
+}
@@ -0,0 +1,359 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package roundtrip
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+const (
+	// maxGeneratedItems is the maximum number of items generated for a list or map, beyond its
+	// minimum number of items.
+	maxGeneratedItems = 3
+	// maxGeneratedLength is the maximum length of a generated string, beyond its minimum length.
+	maxGeneratedLength = 8
+	// maxOptionalDepth is the depth beyond which optional fields are not generated.
+	maxOptionalDepth = 6
+	// defaultIntegerBound bounds generated integers that have no minimum or maximum.
+	defaultIntegerBound = 1000
+)
+
+// generator generates random values that are valid for a schema.
+type generator struct {
+	rand *rand.Rand
+}
+
+// object generates a random object of the root schema of a resource. The apiVersion, kind and
+// metadata fields are not generated, since conversions do not change them.
+func (g *generator) object(s *spec.Schema) any {
+	return g.value(s, 0, true)
+}
+
+func (g *generator) value(s *spec.Schema, depth int, isResourceRoot bool) any {
+	if len(s.Enum) > 0 {
+		return enumValue(s.Enum[g.rand.Intn(len(s.Enum))], s)
+	}
+	if isIntOrString(s) {
+		if g.rand.Intn(2) == 0 {
+			return int64(g.rand.Intn(defaultIntegerBound))
+		}
+		return fmt.Sprintf("%d%%", g.rand.Intn(100))
+	}
+	switch schemaType(s) {
+	case "object":
+		return g.objectValue(s, depth, isResourceRoot)
+	case "array":
+		return g.array(s, depth)
+	case "string":
+		return g.string(s)
+	case "integer":
+		return g.integer(s)
+	case "number":
+		return g.number(s)
+	case "boolean":
+		return g.rand.Intn(2) == 0
+	default:
+		// Values of fields with no type, such as x-kubernetes-preserve-unknown-fields, are not
+		// checked by conversions, so an empty object is sufficient.
+		return map[string]any{}
+	}
+}
+
+// enumValue returns a value of the enum of the schema as a value of an unstructured object. Enum
+// values are decoded from schemas as float64s, so the integral values of integer and int-or-string
+// fields are converted to int64.
+func enumValue(v any, s *spec.Schema) any {
+	f, ok := v.(float64)
+	if !ok || (schemaType(s) != "integer" && !isIntOrString(s)) {
+		return v
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which does not fit in an int64.
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < -math.MinInt64 {
+		return int64(f)
+	}
+	return v
+}
+
+func (g *generator) objectValue(s *spec.Schema, depth int, isResourceRoot bool) any {
+	result := map[string]any{}
+	if len(s.Properties) > 0 {
+		required := map[string]bool{}
+		for _, name := range s.Required {
+			required[name] = true
+		}
+		for _, name := range sortedKeys(s.Properties) {
+			if isResourceRoot && isImplicitField(name) {
+				continue
+			}
+			prop := s.Properties[name]
+			if !required[name] && (depth >= maxOptionalDepth || g.rand.Intn(2) == 0) {
+				continue
+			}
+			result[name] = g.value(&prop, depth+1, isEmbeddedResource(&prop))
+		}
+	} else if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		n := g.count(s.MinProperties, s.MaxProperties, depth)
+		for i := 0; i < n; i++ {
+			result[fmt.Sprintf("key%d", i)] = g.value(s.AdditionalProperties.Schema, depth+1, isEmbeddedResource(s.AdditionalProperties.Schema))
+		}
+	}
+	if isEmbeddedResource(s) {
+		result["apiVersion"] = "example.com/v1"
+		result["kind"] = "Embedded"
+	}
+	return result
+}
+
+func (g *generator) array(s *spec.Schema, depth int) any {
+	if s.Items == nil || s.Items.Schema == nil {
+		return []any{}
+	}
+	items := s.Items.Schema
+	n := g.count(s.MinItems, s.MaxItems, depth)
+	keys := listMapKeys(s)
+	if len(keys) > 0 {
+		// Key fields are required, even if the schema of the items does not say so.
+		withKeys := *items
+		withKeys.Required = append(append([]string{}, items.Required...), keys...)
+		items = &withKeys
+	}
+	result := make([]any, 0, n)
+	seen := map[string]bool{}
+	// Items of sets and maps must be unique, so discard generated duplicates. A few attempts are
+	// made for each item, since small enums and ranges may not have enough unique values.
+	for attempts := 0; len(result) < n && attempts < 4*n; attempts++ {
+		item := g.value(items, depth+1, isEmbeddedResource(items))
+		switch listType(s) {
+		case "set":
+			id := fmt.Sprintf("%#v", item)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		case "map":
+			id := listMapKeyID(item, keys)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// count returns the number of items to generate for a list or map with the given bounds.
+func (g *generator) count(min, max *int64, depth int) int {
+	lower := 0
+	if min != nil {
+		lower = int(*min)
+	}
+	upper := lower + maxGeneratedItems
+	if depth >= maxOptionalDepth {
+		upper = lower
+	}
+	if max != nil && int(*max) < upper {
+		upper = int(*max)
+	}
+	return lower + g.rand.Intn(upper-lower+1)
+}
+
+func (g *generator) string(s *spec.Schema) any {
+	switch s.Format {
+	case "duration":
+		return (time.Duration(g.rand.Intn(100000)) * time.Second).String()
+	case "date-time":
+		return time.Unix(int64(g.rand.Intn(2000000000)), 0).UTC().Format(time.RFC3339)
+	case "date":
+		return time.Unix(int64(g.rand.Intn(2000000000)), 0).UTC().Format("2006-01-02")
+	case "byte":
+		return base64.StdEncoding.EncodeToString([]byte(g.letters(0, 8)))
+	}
+	minLength := 0
+	if s.MinLength != nil {
+		minLength = int(*s.MinLength)
+	}
+	maxLength := minLength + maxGeneratedLength
+	if s.MaxLength != nil && int(*s.MaxLength) < maxLength {
+		maxLength = int(*s.MaxLength)
+	}
+	return g.letters(minLength, maxLength)
+}
+
+func (g *generator) letters(min, max int) string {
+	n := min + g.rand.Intn(max-min+1)
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(byte('a' + g.rand.Intn(26)))
+	}
+	return b.String()
+}
+
+func (g *generator) integer(s *spec.Schema) any {
+	lower, upper := integerBounds(s)
+	return lower + g.rand.Int63n(upper-lower+1)
+}
+
+// integerBounds returns the inclusive bounds of the integers that are valid for the schema.
+func integerBounds(s *spec.Schema) (int64, int64) {
+	lower, upper := int64(-defaultIntegerBound), int64(defaultIntegerBound)
+	if s.Minimum != nil {
+		lower = int64(math.Ceil(*s.Minimum))
+		if s.ExclusiveMinimum && float64(lower) == *s.Minimum {
+			lower++
+		}
+		if s.Maximum == nil {
+			upper = lower + 2*defaultIntegerBound
+		}
+	}
+	if s.Maximum != nil {
+		upper = int64(math.Floor(*s.Maximum))
+		if s.ExclusiveMaximum && float64(upper) == *s.Maximum {
+			upper--
+		}
+		if s.Minimum == nil {
+			lower = upper - 2*defaultIntegerBound
+		}
+	}
+	return lower, upper
+}
+
+func (g *generator) number(s *spec.Schema) any {
+	lower, upper := -float64(defaultIntegerBound), float64(defaultIntegerBound)
+	if s.Minimum != nil {
+		lower = *s.Minimum
+	}
+	if s.Maximum != nil {
+		upper = *s.Maximum
+	}
+	// Numbers are generated with two decimal places so that they are represented exactly in both
+	// JSON and CEL.
+	v := math.Round((lower+g.rand.Float64()*(upper-lower))*100) / 100
+	return math.Max(lower, math.Min(upper, v))
+}
+
+// checkBounds returns an error if no values can be generated for the schema, or for any of its
+// fields or items, because a minimum length, number of items or number of properties is greater
+// than its maximum, or because no integer is between the minimum and maximum of an integer field.
+func checkBounds(s *spec.Schema, path *field.Path) error {
+	bounds := []struct {
+		min, max         *int64
+		minName, maxName string
+	}{
+		{s.MinLength, s.MaxLength, "minLength", "maxLength"},
+		{s.MinItems, s.MaxItems, "minItems", "maxItems"},
+		{s.MinProperties, s.MaxProperties, "minProperties", "maxProperties"},
+	}
+	for _, b := range bounds {
+		if b.min != nil && b.max != nil && *b.min > *b.max {
+			return fmt.Errorf("%s: %s %d is greater than %s %d", pathName(path), b.minName, *b.min, b.maxName, *b.max)
+		}
+	}
+	if schemaType(s) == "integer" && len(s.Enum) == 0 && !isIntOrString(s) {
+		if lower, upper := integerBounds(s); lower > upper {
+			return fmt.Errorf("%s: no integers are between the minimum and maximum", pathName(path))
+		}
+	}
+	for _, name := range sortedKeys(s.Properties) {
+		prop := s.Properties[name]
+		if err := checkBounds(&prop, path.Child(name)); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		if err := checkBounds(s.AdditionalProperties.Schema, path.Key("*")); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil && s.Items.Schema != nil {
+		if err := checkBounds(s.Items.Schema, path.Key("*")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathName returns the path as a string, or <root> for the root of an object.
+func pathName(path *field.Path) string {
+	if path == nil {
+		return "<root>"
+	}
+	return path.String()
+}
+
+func schemaType(s *spec.Schema) string {
+	if len(s.Type) == 0 {
+		return ""
+	}
+	return s.Type[0]
+}
+
+func isIntOrString(s *spec.Schema) bool {
+	v, _ := s.Extensions.GetBool("x-kubernetes-int-or-string")
+	return v
+}
+
+func isEmbeddedResource(s *spec.Schema) bool {
+	v, _ := s.Extensions.GetBool("x-kubernetes-embedded-resource")
+	return v
+}
+
+func listType(s *spec.Schema) string {
+	v, _ := s.Extensions.GetString("x-kubernetes-list-type")
+	return v
+}
+
+func listMapKeys(s *spec.Schema) []string {
+	if listType(s) != "map" {
+		return nil
+	}
+	keys, _ := s.Extensions.GetStringSlice("x-kubernetes-list-map-keys")
+	return keys
+}
+
+// listMapKeyID returns a string identifying the values of the keys of a listType=map item.
+func listMapKeyID(item any, keys []string) string {
+	m, _ := item.(map[string]any)
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = fmt.Sprintf("%#v", m[key])
+	}
+	return strings.Join(values, ",")
+}
+
+// isImplicitField returns true for the fields that are implicitly part of every resource.
+func isImplicitField(name string) bool {
+	return name == "apiVersion" || name == "kind" || name == "metadata"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package roundtrip verifies that a pair of conversions, from one version to another and back,
+// are lossless, by converting random objects that are valid for the schema of the from version.
+package roundtrip
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+)
+
+const (
+	// DefaultCount is the number of objects that are checked if Options.Count is not set.
+	DefaultCount = 100
+	// maxShrinkAttempts bounds the number of conversions made to minimize a counterexample.
+	maxShrinkAttempts = 1000
+)
+
+// ConvertFunc converts an object from one version to another.
+type ConvertFunc func(obj any) (any, error)
+
+// Options configure Verify.
+type Options struct {
+	// Count is the number of random objects that are checked. Defaults to DefaultCount.
+	Count int
+	// Seed seeds the generation of random objects, so that runs are reproducible.
+	Seed int64
+}
+
+// Result is the result of Verify.
+type Result struct {
+	// Checked is the number of objects that were checked.
+	Checked int
+	// Counterexample is the first object found that does not round trip, after it has been
+	// minimized, or nil if all the objects round tripped.
+	Counterexample *Counterexample
+}
+
+// Counterexample is an object that does not round trip.
+type Counterexample struct {
+	// Object is the object of the from version.
+	Object any
+	// Converted is the result of the forward conversion of Object, if it succeeded.
+	Converted any
+	// RoundTripped is the result of the backward conversion of Converted, if it succeeded.
+	RoundTripped any
+	// Err is the error of the conversion that failed, if any.
+	Err error
+	// Differences are the fields that differ between Object and RoundTripped.
+	Differences []string
+}
+
+// Verify checks that objects of the from version schema are unchanged by converting them with
+// forward and then converting the result with backward. Random objects are generated that are
+// valid for the schema, respecting the types, enums, minimums and maximums, formats, and list
+// types and keys of its fields. The first object that is changed by the round trip, or that fails
+// to convert, is minimized by removing and shrinking its fields for as long as it still fails, and
+// is returned as the counterexample of the result. An error is returned if the schema is not the
+// schema of an object, or if it has fields that no valid values can be generated for.
+func Verify(fromVersionSchema *spec.Schema, forward, backward ConvertFunc, opts Options) (*Result, error) {
+	if fromVersionSchema == nil || schemaType(fromVersionSchema) != "object" {
+		return nil, fmt.Errorf("expected the schema of an object")
+	}
+	if err := checkBounds(fromVersionSchema, nil); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = DefaultCount
+	}
+	g := &generator{rand: rand.New(rand.NewSource(opts.Seed))}
+	v := &verifier{schema: fromVersionSchema, forward: forward, backward: backward}
+	result := &Result{}
+	for result.Checked < count {
+		obj := g.object(fromVersionSchema)
+		result.Checked++
+		if c := v.check(obj); c != nil {
+			result.Counterexample = v.minimize(c)
+			break
+		}
+	}
+	return result, nil
+}
+
+type verifier struct {
+	schema            *spec.Schema
+	forward, backward ConvertFunc
+}
+
+// check returns a counterexample if obj does not round trip, or nil if it does.
+func (v *verifier) check(obj any) *Counterexample {
+	c := &Counterexample{Object: obj}
+	// The conversions are given copies, since they may modify the objects they convert.
+	c.Converted, c.Err = v.forward(runtime.DeepCopyJSONValue(obj))
+	if c.Err != nil {
+		c.Err = fmt.Errorf("forward conversion failed: %w", c.Err)
+		return c
+	}
+	c.RoundTripped, c.Err = v.backward(runtime.DeepCopyJSONValue(c.Converted))
+	if c.Err != nil {
+		c.Err = fmt.Errorf("backward conversion failed: %w", c.Err)
+		return c
+	}
+	if c.Differences = differences(obj, c.RoundTripped, nil); len(c.Differences) > 0 {
+		return c
+	}
+	return nil
+}
+
+// minimize greedily replaces the object of the counterexample with the first smaller object that
+// still fails to round trip, until no smaller object fails.
+func (v *verifier) minimize(c *Counterexample) *Counterexample {
+	attempts := 0
+	for shrunk := true; shrunk && attempts < maxShrinkAttempts; {
+		shrunk = false
+		for _, candidate := range shrinkValue(c.Object, v.schema, true) {
+			if attempts++; attempts > maxShrinkAttempts {
+				break
+			}
+			if failed := v.check(candidate); failed != nil {
+				c, shrunk = failed, true
+				break
+			}
+		}
+	}
+	return c
+}
+
+// shrinkValue returns smaller values than v that are valid for the schema s, in the order in
+// which they are tried.
+func shrinkValue(v any, s *spec.Schema, isResourceRoot bool) []any {
+	if len(s.Enum) > 0 || isIntOrString(s) {
+		return nil
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		return shrinkObject(v, s, isResourceRoot)
+	case []any:
+		return shrinkArray(v, s)
+	case string:
+		if len(s.Format) > 0 {
+			return nil
+		}
+		minLength := 0
+		if s.MinLength != nil {
+			minLength = int(*s.MinLength)
+		}
+		// Lengths are counted, and strings are cut, in runes, so that multi-byte characters are
+		// not split into invalid UTF-8.
+		if runes := []rune(v); len(runes) > minLength {
+			return []any{string(runes[:minLength]), string(runes[:minLength+(len(runes)-minLength)/2])}
+		}
+	case int64:
+		lower, upper := integerBounds(s)
+		var result []any
+		for _, c := range shrinkInteger(v, lower, upper) {
+			result = append(result, c)
+		}
+		return result
+	case float64:
+		if v != float64(int64(v)) {
+			return []any{float64(int64(v))}
+		}
+	case bool:
+		if v {
+			return []any{false}
+		}
+	}
+	return nil
+}
+
+// shrinkInteger returns the integers between v and the integer closest to zero within the bounds,
+// closest to that integer first.
+func shrinkInteger(v, lower, upper int64) []int64 {
+	target := int64(0)
+	if target < lower {
+		target = lower
+	}
+	if target > upper {
+		target = upper
+	}
+	var result []int64
+	for d := v - target; d != 0; d /= 2 {
+		result = append(result, v-d)
+	}
+	return result
+}
+
+func shrinkObject(v map[string]any, s *spec.Schema, isResourceRoot bool) []any {
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	canRemove := s.MinProperties == nil || int64(len(v)) > *s.MinProperties
+	var result []any
+	// Try removing each field, then shrinking each field.
+	for _, name := range sortedKeys(v) {
+		if _, ok := s.Properties[name]; (ok && required[name]) || !canRemove {
+			continue
+		}
+		if isImplicitField(name) && (isResourceRoot || isEmbeddedResource(s)) {
+			continue
+		}
+		shrunk := copyMap(v)
+		delete(shrunk, name)
+		result = append(result, shrunk)
+	}
+	for _, name := range sortedKeys(v) {
+		fieldSchema := fieldSchema(s, name)
+		if fieldSchema == nil || (isResourceRoot && isImplicitField(name)) {
+			continue
+		}
+		for _, c := range shrinkValue(v[name], fieldSchema, isEmbeddedResource(fieldSchema)) {
+			shrunk := copyMap(v)
+			shrunk[name] = c
+			result = append(result, shrunk)
+		}
+	}
+	return result
+}
+
+func shrinkArray(v []any, s *spec.Schema) []any {
+	if s.Items == nil || s.Items.Schema == nil {
+		return nil
+	}
+	minItems := 0
+	if s.MinItems != nil {
+		minItems = int(*s.MinItems)
+	}
+	var result []any
+	// Try removing each item, then shrinking each item.
+	if len(v) > minItems {
+		for i := range v {
+			shrunk := append(append([]any{}, v[:i]...), v[i+1:]...)
+			result = append(result, shrunk)
+		}
+	}
+	items := s.Items.Schema
+	keys := listMapKeys(s)
+	if len(keys) > 0 {
+		withKeys := *items
+		withKeys.Required = append(append([]string{}, items.Required...), keys...)
+		items = &withKeys
+	}
+	for i := range v {
+		for _, c := range shrinkValue(v[i], items, isEmbeddedResource(items)) {
+			shrunk := append([]any{}, v...)
+			shrunk[i] = c
+			if isUnique(shrunk, s, keys) {
+				result = append(result, shrunk)
+			}
+		}
+	}
+	return result
+}
+
+// isUnique returns false if the items of a listType=set or listType=map list are not unique.
+func isUnique(list []any, s *spec.Schema, keys []string) bool {
+	seen := map[string]bool{}
+	for _, item := range list {
+		var id string
+		switch listType(s) {
+		case "set":
+			id = fmt.Sprintf("%#v", item)
+		case "map":
+			id = listMapKeyID(item, keys)
+		default:
+			return true
+		}
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+	}
+	return true
+}
+
+func fieldSchema(s *spec.Schema, name string) *spec.Schema {
+	if prop, ok := s.Properties[name]; ok {
+		return &prop
+	}
+	if s.AdditionalProperties != nil {
+		return s.AdditionalProperties.Schema
+	}
+	return nil
+}
+
+func copyMap(m map[string]any) map[string]any {
+	result := make(map[string]any, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+// differences returns the paths at which expected and actual differ, with their values. Numbers
+// are compared by value, so an integral float64 does not differ from the same int64.
+func differences(expected, actual any, path *field.Path) []string {
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	if e, ok := toFloat64(expected); ok {
+		if a, ok := toFloat64(actual); ok && e == a {
+			return nil
+		}
+	}
+	switch e := expected.(type) {
+	case map[string]any:
+		a, ok := actual.(map[string]any)
+		if !ok {
+			break
+		}
+		var result []string
+		keys := map[string]any{}
+		for k := range e {
+			keys[k] = nil
+		}
+		for k := range a {
+			keys[k] = nil
+		}
+		for _, k := range sortedKeys(keys) {
+			ev, eok := e[k]
+			av, aok := a[k]
+			switch {
+			case !aok:
+				result = append(result, fmt.Sprintf("%s: %s was removed", path.Child(k), formatValue(ev)))
+			case !eok:
+				result = append(result, fmt.Sprintf("%s: %s was added", path.Child(k), formatValue(av)))
+			default:
+				result = append(result, differences(ev, av, path.Child(k))...)
+			}
+		}
+		return result
+	case []any:
+		a, ok := actual.([]any)
+		if !ok || len(a) != len(e) {
+			break
+		}
+		var result []string
+		for i := range e {
+			result = append(result, differences(e[i], a[i], path.Index(i))...)
+		}
+		return result
+	}
+	return []string{fmt.Sprintf("%s: %s became %s", pathName(path), formatValue(expected), formatValue(actual))}
+}
+
+// toFloat64 returns v as a float64 if it is a number.
+func toFloat64(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package roundtrip
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/crd"
+)
+
+const (
+	sizeToReplicas = "has(oldObject.spec) && has(oldObject.spec.size) ? Object{spec: Object.spec{replicas: oldObject.spec.size}} : Object{}"
+	replicasToSize = "has(oldObject.spec) && has(oldObject.spec.replicas) ? Object{spec: Object.spec{size: oldObject.spec.replicas}} : Object{}"
+	// lossyReplicasToSize loses replicas of 50 or more.
+	lossyReplicasToSize = "has(oldObject.spec) && has(oldObject.spec.replicas) ? Object{spec: Object.spec{size: oldObject.spec.replicas % 50}} : Object{}"
+)
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name                string
+		forward, backward   string
+		expectedObject      any
+		expectedDifferences []string
+	}{
+		{
+			name:     "lossless",
+			forward:  sizeToReplicas,
+			backward: replicasToSize,
+		},
+		{
+			name:                "lossy",
+			forward:             sizeToReplicas,
+			backward:            lossyReplicasToSize,
+			expectedObject:      map[string]any{"spec": map[string]any{"size": int64(50)}},
+			expectedDifferences: []string{"spec.size: 50 became 0"},
+		},
+	}
+	widgets, err := crd.LoadFile("../../testdata/policy/widget-crd.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := widgets.Version("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := widgets.Version("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			forward, err := apply.CompileConvertBasicMerge(v1.Schema, v2.Schema, map[string]any{"mutation": tc.forward})
+			if err != nil {
+				t.Fatal(err)
+			}
+			backward, err := apply.CompileConvertBasicMerge(v2.Schema, v1.Schema, map[string]any{"mutation": tc.backward})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := Verify(v1.Schema, forward.Apply, backward.Apply, Options{Seed: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := result.Counterexample
+			if tc.expectedObject == nil {
+				if c != nil {
+					t.Fatalf("expected all objects to round trip, but got counterexample %v: %v %v", c.Object, c.Differences, c.Err)
+				}
+				if result.Checked != DefaultCount {
+					t.Errorf("expected %d objects to be checked, but got %d", DefaultCount, result.Checked)
+				}
+				return
+			}
+			if c == nil {
+				t.Fatalf("expected a counterexample after checking %d objects", result.Checked)
+			}
+			if c.Err != nil {
+				t.Fatal(c.Err)
+			}
+			if !reflect.DeepEqual(tc.expectedObject, c.Object) {
+				t.Errorf("expected counterexample %v but got %v", tc.expectedObject, c.Object)
+			}
+			if !reflect.DeepEqual(tc.expectedDifferences, c.Differences) {
+				t.Errorf("expected differences %v but got %v", tc.expectedDifferences, c.Differences)
+			}
+		})
+	}
+}
+
+func TestVerifyIntegerEnum(t *testing.T) {
+	s := &spec.Schema{}
+	err := yaml.Unmarshal([]byte(`
+type: object
+required: [spec]
+properties:
+  spec:
+    type: object
+    required: [level]
+    properties:
+      level: {type: integer, enum: [1, 2]}
+`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := apply.CompileConvertBasicMerge(s, s, map[string]any{"mutation": "Object{}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Verify(s, identity.Apply, identity.Apply, Options{Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := result.Counterexample; c != nil {
+		t.Fatalf("expected all objects to round trip, but got counterexample %v: %v %v", c.Object, c.Differences, c.Err)
+	}
+}
+
+func TestVerifyInvalidBounds(t *testing.T) {
+	cases := []struct {
+		name          string
+		schema        string
+		expectedError string
+	}{
+		{
+			name:          "min length greater than max length",
+			schema:        `{type: object, properties: {spec: {type: object, properties: {name: {type: string, minLength: 5, maxLength: 2}}}}}`,
+			expectedError: "invalid schema: spec.name: minLength 5 is greater than maxLength 2",
+		},
+		{
+			name:          "min items greater than max items",
+			schema:        `{type: object, properties: {tags: {type: array, minItems: 3, maxItems: 1, items: {type: string}}}}`,
+			expectedError: "invalid schema: tags: minItems 3 is greater than maxItems 1",
+		},
+		{
+			name:          "min properties greater than max properties",
+			schema:        `{type: object, properties: {labels: {type: object, minProperties: 2, maxProperties: 1, additionalProperties: {type: string}}}}`,
+			expectedError: "invalid schema: labels: minProperties 2 is greater than maxProperties 1",
+		},
+		{
+			name:          "items",
+			schema:        `{type: object, properties: {names: {type: array, items: {type: string, minLength: 2, maxLength: 1}}}}`,
+			expectedError: "invalid schema: names[*]: minLength 2 is greater than maxLength 1",
+		},
+		{
+			name:          "no integers in range",
+			schema:        `{type: object, properties: {size: {type: integer, minimum: 1.2, maximum: 1.8}}}`,
+			expectedError: "invalid schema: size: no integers are between the minimum and maximum",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &spec.Schema{}
+			if err := yaml.Unmarshal([]byte(tc.schema), s); err != nil {
+				t.Fatal(err)
+			}
+			identity := func(obj any) (any, error) { return obj, nil }
+			_, err := Verify(s, identity, identity, Options{Seed: 1})
+			if err == nil || err.Error() != tc.expectedError {
+				t.Errorf("expected error %q but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestShrinkMultiByteString(t *testing.T) {
+	s := &spec.Schema{}
+	s.Type = spec.StringOrArray{"string"}
+	for _, c := range shrinkValue("héllo wörld", s, false) {
+		if str := c.(string); !utf8.ValidString(str) {
+			t.Errorf("expected a valid UTF-8 string but got %q", str)
+		}
+	}
+	if expected, actual := []any{"", "héllo"}, shrinkValue("héllo wörld", s, false); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	s := &spec.Schema{}
+	err := yaml.Unmarshal([]byte(`
+type: object
+required: [spec]
+properties:
+  apiVersion: {type: string}
+  spec:
+    type: object
+    required: [mode, level, replicas, ports]
+    properties:
+      mode: {type: string, enum: [fast, slow]}
+      level: {type: integer, enum: [1, 2]}
+      replicas: {type: integer, minimum: 3, maximum: 5}
+      name: {type: string, minLength: 2, maxLength: 4}
+      timeout: {type: string, format: duration}
+      tags:
+        type: array
+        x-kubernetes-list-type: set
+        minItems: 2
+        items: {type: string, enum: [a, b, c]}
+      ports:
+        type: array
+        x-kubernetes-list-type: map
+        x-kubernetes-list-map-keys: [port]
+        minItems: 1
+        items:
+          type: object
+          properties:
+            port: {type: integer, minimum: 1, maximum: 3}
+            protocol: {type: string}
+`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagsSchema := s.Properties["spec"].Properties["tags"]
+	g := &generator{rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < 100; i++ {
+		obj := g.object(s).(map[string]any)
+		if _, ok := obj["apiVersion"]; ok {
+			t.Fatalf("expected apiVersion not to be generated: %v", obj)
+		}
+		spec := obj["spec"].(map[string]any)
+		if mode := spec["mode"]; mode != "fast" && mode != "slow" {
+			t.Errorf("expected mode to be in the enum, but got %v", mode)
+		}
+		if level, ok := spec["level"].(int64); !ok || (level != 1 && level != 2) {
+			t.Errorf("expected level to be an int64 in the enum, but got %#v", spec["level"])
+		}
+		if replicas := spec["replicas"].(int64); replicas < 3 || replicas > 5 {
+			t.Errorf("expected replicas in [3, 5], but got %d", replicas)
+		}
+		if name, ok := spec["name"].(string); ok && (len(name) < 2 || len(name) > 4) {
+			t.Errorf("expected name of length [2, 4], but got %q", name)
+		}
+		if tags, ok := spec["tags"].([]any); ok {
+			if len(tags) < 2 || !isUnique(tags, &tagsSchema, nil) {
+				t.Errorf("expected at least 2 unique tags, but got %v", tags)
+			}
+		}
+		ports := spec["ports"].([]any)
+		seen := map[any]bool{}
+		for _, port := range ports {
+			p, ok := port.(map[string]any)["port"]
+			if !ok || seen[p] {
+				t.Errorf("expected ports with unique port keys, but got %v", ports)
+			}
+			seen[p] = true
+		}
+	}
+}
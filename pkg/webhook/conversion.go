@@ -0,0 +1,246 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/policy"
+)
+
+var conversionReviewGVK = apiextensionsv1.SchemeGroupVersion.WithKind("ConversionReview")
+
+// ConversionWebhook is an http.Handler that serves apiextensions.k8s.io/v1 ConversionReview
+// requests of a CustomResourceDefinition conversion webhook. Each object in a review is converted
+// by the conversion or policy registered for its kind, its version and the desired version. A
+// ConversionWebhook is safe for concurrent use.
+type ConversionWebhook struct {
+	lock       sync.RWMutex
+	converters map[versionPair]converter
+}
+
+// converter converts objects of one version to another version, and reports the values that
+// were not carried over.
+type converter func(obj any, toVersion string) (any, *apply.ConversionReport, error)
+
+// versionPair identifies the conversion of the objects of a kind from one version to another.
+type versionPair struct {
+	from      schema.GroupVersionKind
+	toVersion string
+}
+
+var _ http.Handler = (*ConversionWebhook)(nil)
+
+// NewConversionWebhook returns a ConversionWebhook with no conversions.
+func NewConversionWebhook() *ConversionWebhook {
+	return &ConversionWebhook{converters: map[versionPair]converter{}}
+}
+
+// Register sets the conversion of the objects of the kind from to the version toVersion of the
+// same group and kind. The conversion must have been compiled for the schemas of the two versions.
+func (w *ConversionWebhook) Register(from schema.GroupVersionKind, toVersion string, conversion *apply.CompiledConversion) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.converters[versionPair{from: from, toVersion: toVersion}] = func(obj any, _ string) (any, *apply.ConversionReport, error) {
+		return conversion.ApplyWithReport(obj)
+	}
+}
+
+// RegisterPolicy sets the conversions between all the versions of the policy, replacing any
+// conversions previously registered for the same versions.
+func (w *ConversionWebhook) RegisterPolicy(p *policy.CompiledConversionPolicy) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, from := range p.Policy.Spec.Versions {
+		for _, to := range p.Policy.Spec.Versions {
+			if from == to || p.Chain(from, to) == nil {
+				continue
+			}
+			gvk := p.GroupKind().WithVersion(from)
+			w.converters[versionPair{from: gvk, toVersion: to}] = p.ConvertWithReport
+		}
+	}
+}
+
+func (w *ConversionWebhook) converterFor(from schema.GroupVersionKind, toVersion string) converter {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.converters[versionPair{from: from, toVersion: toVersion}]
+}
+
+// ServeHTTP decodes the ConversionReview in the request body and writes the ConversionReview
+// containing the response of Convert.
+func (w *ConversionWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	review := &apiextensionsv1.ConversionReview{}
+	if !decodeReview(rw, req, review, conversionReviewGVK) {
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "ConversionReview has no request", http.StatusBadRequest)
+		return
+	}
+	writeReview(rw, &apiextensionsv1.ConversionReview{
+		TypeMeta: review.TypeMeta,
+		Response: w.Convert(review.Request),
+	})
+}
+
+// Convert converts all the objects of the request to the desired version. Objects that are
+// already of the desired version are returned unchanged. The values that the conversions did not
+// carry over are reported as the causes of the successful result, with the index of their object
+// in the field path. If any object cannot be converted, or its conversion changes fields of the
+// metadata other than the labels and annotations, the response has a failure result describing
+// why, and no converted objects, as the kube-apiserver requires.
+func (w *ConversionWebhook) Convert(req *apiextensionsv1.ConversionRequest) *apiextensionsv1.ConversionResponse {
+	resp := &apiextensionsv1.ConversionResponse{UID: req.UID}
+	desired, err := schema.ParseGroupVersion(req.DesiredAPIVersion)
+	if err != nil {
+		return conversionFailure(resp, fmt.Errorf("invalid desiredAPIVersion: %w", err))
+	}
+	converted := make([]runtime.RawExtension, len(req.Objects))
+	var causes []metav1.StatusCause
+	for i, raw := range req.Objects {
+		obj, report, err := w.convert(raw.Raw, desired)
+		if err != nil {
+			return conversionFailure(resp, fmt.Errorf("failed to convert object %d: %w", i, err))
+		}
+		converted[i] = runtime.RawExtension{Raw: obj}
+		causes = append(causes, droppedCauses(i, report)...)
+	}
+	resp.ConvertedObjects = converted
+	resp.Result = metav1.Status{Status: metav1.StatusSuccess}
+	if len(causes) > 0 {
+		resp.Result.Message = fmt.Sprintf("%d values were not carried over by the conversion", len(causes))
+		resp.Result.Details = &metav1.StatusDetails{Causes: causes}
+	}
+	return resp
+}
+
+func (w *ConversionWebhook) convert(data []byte, desired schema.GroupVersion) ([]byte, *apply.ConversionReport, error) {
+	var obj any
+	if err := utiljson.Unmarshal(data, &obj); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	u, ok := obj.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("expected an object, but got %T", obj)
+	}
+	apiVersion, _ := u["apiVersion"].(string)
+	kind, _ := u["kind"].(string)
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid apiVersion: %w", err)
+	}
+	if gv.Group != desired.Group {
+		return nil, nil, fmt.Errorf("cannot convert %s %s to a different group %s", apiVersion, kind, desired.Group)
+	}
+	if gv.Version == desired.Version {
+		return data, nil, nil
+	}
+	gvk := gv.WithKind(kind)
+	convert := w.converterFor(gvk, desired.Version)
+	if convert == nil {
+		return nil, nil, fmt.Errorf("no conversion of %s %s to %s", apiVersion, kind, desired.Version)
+	}
+	// The conversion may modify the object it converts.
+	metadata := runtime.DeepCopyJSONValue(u["metadata"])
+	var report *apply.ConversionReport
+	result, err := applySafely(func(obj any) (any, error) {
+		result, r, err := convert(obj, desired.Version)
+		report = r
+		return result, err
+	}, obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	convertedObj, ok := result.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("conversion of %s %s returned %T rather than an object", apiVersion, kind, result)
+	}
+	if err := checkMetadata(metadata, convertedObj["metadata"]); err != nil {
+		return nil, nil, fmt.Errorf("conversion of %s %s %w", apiVersion, kind, err)
+	}
+	convertedObj["apiVersion"] = desired.String()
+	data, err = json.Marshal(convertedObj)
+	return data, report, err
+}
+
+// checkMetadata returns an error if the converted metadata differs from the original metadata in
+// fields other than the labels and annotations, which the kube-apiserver does not allow
+// conversions to change.
+func checkMetadata(original, converted any) error {
+	from, _ := original.(map[string]any)
+	to, _ := converted.(map[string]any)
+	fields := map[string]bool{}
+	for k := range from {
+		fields[k] = true
+	}
+	for k := range to {
+		fields[k] = true
+	}
+	var changed []string
+	for k := range fields {
+		if k != "labels" && k != "annotations" && !reflect.DeepEqual(from[k], to[k]) {
+			changed = append(changed, "metadata."+k)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("changed %s, but only metadata.labels and metadata.annotations may be changed", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// droppedCauses returns a status cause for each value of the object at index i of a request that
+// the conversion did not carry over.
+func droppedCauses(i int, report *apply.ConversionReport) []metav1.StatusCause {
+	if report == nil {
+		return nil
+	}
+	warnings := report.Warnings()
+	causes := make([]metav1.StatusCause, len(report.Dropped))
+	for j, dropped := range report.Dropped {
+		causes[j] = metav1.StatusCause{
+			Type:    metav1.CauseType(dropped.Reason),
+			Message: warnings[j],
+			Field:   fmt.Sprintf("objects[%d].%s", i, dropped.Path),
+		}
+	}
+	return causes
+}
+
+func conversionFailure(resp *apiextensionsv1.ConversionResponse, err error) *apiextensionsv1.ConversionResponse {
+	resp.ConvertedObjects = nil
+	resp.Result = metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: err.Error(),
+	}
+	return resp
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/crd"
+	"jpbetz.github.com/celpatch/pkg/policy"
+)
+
+var exampleV1 = schema.GroupVersionKind{Group: "group.example.com", Version: "v1", Kind: "Example"}
+
+func TestConversionWebhook(t *testing.T) {
+	server := httptest.NewServer(newConversionWebhook(t))
+	defer server.Close()
+
+	review := readConversionReview(t, "convert-to-v2.json")
+	resp := postConversion(t, server.URL, review)
+	if resp.UID != review.Request.UID {
+		t.Errorf("expected response UID %s but got %s", review.Request.UID, resp.UID)
+	}
+	if resp.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected conversion to succeed, but got %v", resp.Result)
+	}
+	if len(resp.ConvertedObjects) != 2 {
+		t.Fatalf("expected 2 converted objects but got %d", len(resp.ConvertedObjects))
+	}
+	expected := unmarshalYAML(t, string(readTestdata(t, "templates/convert/basic/expected.yaml")))
+	expected.(map[string]any)["apiVersion"] = "group.example.com/v2"
+	if got := unmarshalRaw(t, resp.ConvertedObjects[0]); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+	if got, unchanged := unmarshalRaw(t, resp.ConvertedObjects[1]), unmarshalRaw(t, review.Request.Objects[1]); !reflect.DeepEqual(unchanged, got) {
+		t.Errorf("expected object of the desired version to be unchanged, but got %v", got)
+	}
+}
+
+func TestConversionWebhookPolicy(t *testing.T) {
+	policies, err := policy.LoadFile(filepath.Join(testdata, "policy/widget-conversion.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	widgets, err := crd.LoadFile(filepath.Join(testdata, "policy/widget-crd.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := policy.CompileConversionPolicy(policies.ConversionPolicies[0], widgets.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewConversionWebhook()
+	w.RegisterPolicy(compiled)
+
+	req := &apiextensionsv1.ConversionRequest{UID: "1", DesiredAPIVersion: "policy.example.com/v3", Objects: []runtime.RawExtension{
+		{Raw: []byte(`{"apiVersion": "policy.example.com/v1", "kind": "Widget", "spec": {"size": 2}}`)},
+		{Raw: []byte(`{"apiVersion": "policy.example.com/v2", "kind": "Widget", "spec": {"replicas": 4}}`)},
+	}}
+	resp := w.Convert(req)
+	if resp.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected conversion to succeed, but got %v", resp.Result)
+	}
+	// The fields of each version are dropped by the projection, and converted by the rules.
+	if resp.Result.Details == nil {
+		t.Fatalf("expected the dropped values to be reported, but got %v", resp.Result)
+	}
+	var dropped []string
+	for _, cause := range resp.Result.Details.Causes {
+		dropped = append(dropped, cause.Field)
+		if cause.Type != metav1.CauseType(apply.DropReasonUnknownField) {
+			t.Errorf("expected %s to be dropped as an unknown field, but got %s", cause.Field, cause.Type)
+		}
+	}
+	if expected := []string{"objects[0].spec.size", "objects[0].spec.replicas", "objects[1].spec.replicas"}; !reflect.DeepEqual(expected, dropped) {
+		t.Errorf("expected dropped values %v but got %v", expected, dropped)
+	}
+	for i, expected := range []string{
+		`{"apiVersion": "policy.example.com/v3", "kind": "Widget", "spec": {"count": 2}}`,
+		`{"apiVersion": "policy.example.com/v3", "kind": "Widget", "spec": {"count": 4}}`,
+	} {
+		if got := unmarshalRaw(t, resp.ConvertedObjects[i]); !reflect.DeepEqual(unmarshalRaw(t, runtime.RawExtension{Raw: []byte(expected)}), got) {
+			t.Errorf("expected object %d to be %s, but got %v", i, expected, got)
+		}
+	}
+}
+
+func TestConversionWebhookFailures(t *testing.T) {
+	w := newConversionWebhook(t)
+	v1Object := `{"apiVersion": "group.example.com/v1", "kind": "Example", "metadata": {"name": "alpha"}, "spec": {"replicas": 1, "list": ["a", "b"], "listMap": [], "something": 1}}`
+	cases := []struct {
+		name          string
+		desired       string
+		objects       []string
+		expectedError string
+	}{
+		{
+			name:          "no conversion",
+			desired:       "group.example.com/v3",
+			objects:       []string{v1Object},
+			expectedError: "failed to convert object 0: no conversion of group.example.com/v1 Example to v3",
+		},
+		{
+			name:          "different group",
+			desired:       "other.example.com/v2",
+			objects:       []string{v1Object},
+			expectedError: "cannot convert group.example.com/v1 Example to a different group other.example.com",
+		},
+		{
+			name:          "invalid object",
+			desired:       "group.example.com/v2",
+			objects:       []string{v1Object, `["not", "an", "object"]`},
+			expectedError: "failed to convert object 1: expected an object",
+		},
+		{
+			name:          "evaluation error",
+			desired:       "group.example.com/v2",
+			objects:       []string{`{"apiVersion": "group.example.com/v1", "kind": "Example", "metadata": {"name": "alpha"}, "spec": {"replicas": 1, "list": ["a"], "listMap": [], "something": 1}}`},
+			expectedError: "evaluation error at spec.value",
+		},
+		{
+			name:          "invalid desired version",
+			desired:       "group.example.com/v2/v3",
+			expectedError: "invalid desiredAPIVersion",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &apiextensionsv1.ConversionRequest{UID: "1", DesiredAPIVersion: tc.desired}
+			for _, obj := range tc.objects {
+				req.Objects = append(req.Objects, runtime.RawExtension{Raw: []byte(obj)})
+			}
+			resp := w.Convert(req)
+			if resp.Result.Status != metav1.StatusFailure {
+				t.Fatalf("expected conversion to fail, but got %v", resp.Result)
+			}
+			if !strings.Contains(resp.Result.Message, tc.expectedError) {
+				t.Errorf("expected failure containing %q but got %q", tc.expectedError, resp.Result.Message)
+			}
+			if len(resp.ConvertedObjects) > 0 {
+				t.Errorf("expected no converted objects, but got %d", len(resp.ConvertedObjects))
+			}
+		})
+	}
+}
+
+func TestConversionWebhookMetadata(t *testing.T) {
+	c, err := crd.LoadFile(filepath.Join(testdata, "crd.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := c.Version("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := c.Version("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Object := `{"apiVersion": "group.example.com/v1", "kind": "Example", "metadata": {"name": "alpha", "labels": {"a": "1"}}, "spec": {}}`
+	cases := []struct {
+		name          string
+		expression    string
+		expectedError string
+	}{
+		{
+			name:       "labels and annotations may change",
+			expression: "Object{metadata: Object.metadata{labels: {'b': '2'}, annotations: {'c': '3'}}}",
+		},
+		{
+			name:          "other fields may not change",
+			expression:    "Object{metadata: Object.metadata{name: 'beta', generateName: 'b-'}}",
+			expectedError: "failed to convert object 0: conversion of group.example.com/v1 Example changed metadata.generateName, metadata.name, but only metadata.labels and metadata.annotations may be changed",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conversion, err := apply.CompileConvertBasicMerge(v1.Schema, v2.Schema, map[string]any{"mutation": tc.expression})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewConversionWebhook()
+			w.Register(exampleV1, "v2", conversion)
+			resp := w.Convert(&apiextensionsv1.ConversionRequest{
+				UID:               "1",
+				DesiredAPIVersion: "group.example.com/v2",
+				Objects:           []runtime.RawExtension{{Raw: []byte(v1Object)}},
+			})
+			if len(tc.expectedError) > 0 {
+				if resp.Result.Status != metav1.StatusFailure || resp.Result.Message != tc.expectedError {
+					t.Errorf("expected failure %q but got %v", tc.expectedError, resp.Result)
+				}
+				if len(resp.ConvertedObjects) > 0 {
+					t.Errorf("expected no converted objects, but got %d", len(resp.ConvertedObjects))
+				}
+				return
+			}
+			if resp.Result.Status != metav1.StatusSuccess {
+				t.Fatalf("expected conversion to succeed, but got %v", resp.Result)
+			}
+			metadata := unmarshalRaw(t, resp.ConvertedObjects[0]).(map[string]any)["metadata"]
+			expected := map[string]any{"name": "alpha", "labels": map[string]any{"a": "1", "b": "2"}, "annotations": map[string]any{"c": "3"}}
+			if !reflect.DeepEqual(expected, metadata) {
+				t.Errorf("expected metadata %v but got %v", expected, metadata)
+			}
+		})
+	}
+}
+
+func TestConversionWebhookBadRequests(t *testing.T) {
+	server := httptest.NewServer(NewConversionWebhook())
+	defer server.Close()
+
+	for name, body := range map[string]string{
+		"admission review": `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "1"}}`,
+		"no request":       `{"apiVersion": "apiextensions.k8s.io/v1", "kind": "ConversionReview"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d but got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func newConversionWebhook(t *testing.T) *ConversionWebhook {
+	t.Helper()
+	c, err := crd.LoadFile(filepath.Join(testdata, "crd.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := c.Version("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := c.Version("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewConversionWebhook()
+	for _, pair := range []struct {
+		from, to *crd.Version
+		template string
+	}{
+		{from: v1, to: v2, template: "templates/convert/basic/v1tov2.yaml"},
+		{from: v2, to: v1, template: "templates/convert/basic/v2tov1.yaml"},
+	} {
+		conversion, err := apply.CompileConvertWithTemplate(pair.from.Schema, pair.to.Schema, unmarshalYAML(t, string(readTestdata(t, pair.template))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Register(exampleV1.GroupKind().WithVersion(pair.from.Name), pair.to.Name, conversion)
+	}
+	return w
+}
+
+func readConversionReview(t *testing.T, file string) *apiextensionsv1.ConversionReview {
+	t.Helper()
+	review := &apiextensionsv1.ConversionReview{}
+	if err := json.Unmarshal(readTestdata(t, filepath.Join("webhook", file)), review); err != nil {
+		t.Fatal(err)
+	}
+	return review
+}
+
+func postConversion(t *testing.T, url string, review *apiextensionsv1.ConversionReview) *apiextensionsv1.ConversionResponse {
+	t.Helper()
+	data, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	result := &apiextensionsv1.ConversionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Response == nil {
+		t.Fatal("expected a response")
+	}
+	return result.Response
+}
+
+func readTestdata(t *testing.T, file string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(testdata, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func unmarshalRaw(t *testing.T, raw runtime.RawExtension) any {
+	t.Helper()
+	var result any
+	if err := utiljson.Unmarshal(raw.Raw, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
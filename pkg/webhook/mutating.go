@@ -0,0 +1,248 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook serves Kubernetes mutating admission webhooks and CustomResourceDefinition
+// conversion webhooks that mutate and convert resources using the apply package.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/jsonpatch"
+	"jpbetz.github.com/celpatch/pkg/policy"
+)
+
+var admissionReviewGVK = admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+
+// MutatingWebhook is an http.Handler that serves admission.k8s.io/v1 AdmissionReview requests of
+// a mutating admission webhook. The mutations and policies registered for the kind of the object
+// under review, and that match it, are applied to it in the order they were registered, and the
+// changes they make are returned as a JSONPatch. A MutatingWebhook is safe for concurrent use.
+type MutatingWebhook struct {
+	lock     sync.RWMutex
+	mutators map[schema.GroupVersionKind][]mutator
+}
+
+// mutator is a mutation registered with a MutatingWebhook.
+type mutator interface {
+	// matches returns true if the object of the kind gvk, in the namespace and with the labels,
+	// should be mutated.
+	matches(gvk schema.GroupVersionKind, namespace string, labels map[string]string) bool
+	// apply mutates obj, with request as the request variable of match conditions.
+	apply(gvk schema.GroupVersionKind, obj, request any) (any, error)
+	// objectSchema returns the schema of the objects of the kind gvk.
+	objectSchema(gvk schema.GroupVersionKind) *spec.Schema
+}
+
+// kindMutation is a mutation of all the objects of a kind.
+type kindMutation struct {
+	mutation *apply.CompiledMutation
+}
+
+func (m kindMutation) matches(schema.GroupVersionKind, string, map[string]string) bool {
+	return true
+}
+
+func (m kindMutation) apply(_ schema.GroupVersionKind, obj, request any) (any, error) {
+	return m.mutation.ApplyWithRequest(obj, request)
+}
+
+func (m kindMutation) objectSchema(schema.GroupVersionKind) *spec.Schema {
+	return m.mutation.Schema()
+}
+
+// policyMutation is a mutation of the objects matched by a MutationPolicy.
+type policyMutation struct {
+	policy *policy.CompiledMutationPolicy
+}
+
+func (m policyMutation) matches(gvk schema.GroupVersionKind, namespace string, labels map[string]string) bool {
+	return m.policy.Matches(gvk, namespace, labels)
+}
+
+func (m policyMutation) apply(gvk schema.GroupVersionKind, obj, request any) (any, error) {
+	return m.policy.ApplyWithRequest(gvk, obj, request)
+}
+
+func (m policyMutation) objectSchema(gvk schema.GroupVersionKind) *spec.Schema {
+	return m.policy.Schema(gvk)
+}
+
+var _ http.Handler = (*MutatingWebhook)(nil)
+
+// NewMutatingWebhook returns a MutatingWebhook with no mutations.
+func NewMutatingWebhook() *MutatingWebhook {
+	return &MutatingWebhook{mutators: map[schema.GroupVersionKind][]mutator{}}
+}
+
+// Register adds a mutation of the objects of the kind gvk. The mutation must have been compiled
+// for the schema of gvk.
+func (w *MutatingWebhook) Register(gvk schema.GroupVersionKind, mutation *apply.CompiledMutation) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.mutators[gvk] = append(w.mutators[gvk], kindMutation{mutation: mutation})
+}
+
+// RegisterPolicy adds a policy, which mutates the objects it matches. Failures of the policy are
+// handled according to its failure policy.
+func (w *MutatingWebhook) RegisterPolicy(p *policy.CompiledMutationPolicy) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, gvk := range p.Kinds() {
+		w.mutators[gvk] = append(w.mutators[gvk], policyMutation{policy: p})
+	}
+}
+
+func (w *MutatingWebhook) mutatorsFor(gvk schema.GroupVersionKind) []mutator {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.mutators[gvk]
+}
+
+// ServeHTTP decodes the AdmissionReview in the request body and writes the AdmissionReview
+// containing the response of Admit.
+func (w *MutatingWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	serveAdmissionReview(rw, req, w.Admit)
+}
+
+// Admit applies the mutations and policies that match the object under review, and returns a
+// response that patches the object with the changes made by them. Objects of kinds with no
+// mutations, and requests that are not creates or updates, are allowed unchanged. Requests are
+// denied if a mutation fails, or if a policy with a Fail failure policy fails. The match
+// conditions of the mutations and policies are given the attributes of the request, other than
+// its objects and options, as the request variable.
+func (w *MutatingWebhook) Admit(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return resp
+	}
+	gvk := schema.GroupVersionKind{Group: req.Kind.Group, Version: req.Kind.Version, Kind: req.Kind.Kind}
+	mutators := w.mutatorsFor(gvk)
+	if len(mutators) == 0 {
+		return resp
+	}
+
+	var original any
+	if err := utiljson.Unmarshal(req.Object.Raw, &original); err != nil {
+		return deny(resp, http.StatusBadRequest, fmt.Errorf("failed to decode object: %w", err))
+	}
+	attributes, err := requestAttributes(req)
+	if err != nil {
+		return deny(resp, http.StatusInternalServerError, fmt.Errorf("failed to encode request attributes: %w", err))
+	}
+	labels := objectLabels(original)
+	obj := original
+	for _, m := range mutators {
+		if !m.matches(gvk, req.Namespace, labels) {
+			continue
+		}
+		mutated, err := applySafely(func(obj any) (any, error) { return m.apply(gvk, obj, attributes) }, obj)
+		if err != nil {
+			return deny(resp, http.StatusInternalServerError, fmt.Errorf("failed to mutate %s: %w", gvk.Kind, err))
+		}
+		obj = mutated
+	}
+
+	// All the mutators of a kind were compiled for the schema of the kind.
+	patch := jsonpatch.Create(mutators[0].objectSchema(gvk), original, obj)
+	if len(patch) == 0 {
+		return resp
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(resp, http.StatusInternalServerError, fmt.Errorf("failed to encode patch: %w", err))
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	resp.Patch = data
+	resp.PatchType = &patchType
+	return resp
+}
+
+// requestAttributes returns the attributes of the request, other than its objects and options, as
+// an unstructured value for the request variable of match conditions.
+func requestAttributes(req *admissionv1.AdmissionRequest) (any, error) {
+	// The objects are cleared so that they are not encoded.
+	attributes := *req
+	attributes.Object = runtime.RawExtension{}
+	attributes.OldObject = runtime.RawExtension{}
+	attributes.Options = runtime.RawExtension{}
+	data, err := json.Marshal(&attributes)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]any
+	if err := utiljson.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"object", "oldObject", "options"} {
+		delete(result, k)
+	}
+	return result, nil
+}
+
+// objectLabels returns the labels of the unstructured object obj.
+func objectLabels(obj any) map[string]string {
+	u, _ := obj.(map[string]any)
+	metadata, _ := u["metadata"].(map[string]any)
+	labels, _ := metadata["labels"].(map[string]any)
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if s, ok := v.(string); ok {
+			result[k] = s
+		}
+	}
+	return result
+}
+
+func deny(resp *admissionv1.AdmissionResponse, code int32, err error) *admissionv1.AdmissionResponse {
+	resp.Allowed = false
+	resp.Patch = nil
+	resp.PatchType = nil
+	resp.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Message: err.Error(),
+	}
+	return resp
+}
+
+// serveAdmissionReview decodes the AdmissionReview in the body of req, and writes an
+// AdmissionReview containing the response of admit.
+func serveAdmissionReview(rw http.ResponseWriter, req *http.Request, admit func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+	review := &admissionv1.AdmissionReview{}
+	if !decodeReview(rw, req, review, admissionReviewGVK) {
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "AdmissionReview has no request", http.StatusBadRequest)
+		return
+	}
+	writeReview(rw, &admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: admit(review.Request),
+	})
+}
@@ -0,0 +1,544 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/yaml"
+
+	"jpbetz.github.com/celpatch/pkg/apply"
+	"jpbetz.github.com/celpatch/pkg/builtin"
+	"jpbetz.github.com/celpatch/pkg/policy"
+)
+
+const testdata = "../../testdata"
+
+var (
+	podGVK        = schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	deploymentGVK = schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+)
+
+func TestMutatingWebhook(t *testing.T) {
+	w := NewMutatingWebhook()
+	w.Register(podGVK, compileMutation(t, podGVK, map[string]any{"mutation": `
+Object{
+  spec: Object.spec{
+    containers: [
+      Object.spec.containers.item{
+        name: "proxy",
+        image: "proxy:1.0",
+        args: ["--app=" + oldObject.metadata.labels.app]
+      }
+    ]
+  }
+}`}))
+	w.Register(podGVK, compileMutation(t, podGVK, map[string]any{"mutation": `
+Object{
+  metadata: Object.metadata{
+    annotations: {"example.com/injected": "proxy"}
+  }
+}`}))
+	w.Register(deploymentGVK, compileMutation(t, deploymentGVK, map[string]any{"mutation": `
+Object{
+  spec: Object.spec{
+    template: Object.spec.template{
+      metadata: Object.spec.template.metadata{
+        annotations: {"example.com/image": oldObject.spec.template.spec.containers[0].image}
+      }
+    }
+  }
+}`}))
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	cases := []struct {
+		name     string
+		review   string
+		expected string
+	}{
+		{
+			name:   "create",
+			review: "pod-create.json",
+			expected: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  namespace: default
+  labels:
+    app: web
+  annotations:
+    example.com/injected: proxy
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+    ports:
+    - containerPort: 8080
+  - name: proxy
+    image: proxy:1.0
+    args:
+    - --app=web
+`,
+		},
+		{
+			name:   "update",
+			review: "deployment-update.json",
+			expected: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: default
+spec:
+  replicas: 3
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+      annotations:
+        example.com/image: app:2.0
+    spec:
+      containers:
+      - name: app
+        image: app:2.0
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			review := readReview(t, tc.review)
+			resp := post(t, server.URL, review)
+			if resp.UID != review.Request.UID {
+				t.Errorf("expected response UID %s but got %s", review.Request.UID, resp.UID)
+			}
+			if !resp.Allowed {
+				t.Fatalf("expected request to be allowed, but got %v", resp.Result)
+			}
+			if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Fatalf("expected a JSONPatch, but got patch type %v", resp.PatchType)
+			}
+			var obj any
+			if err := utiljson.Unmarshal(review.Request.Object.Raw, &obj); err != nil {
+				t.Fatal(err)
+			}
+			var patch []map[string]any
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+			result, err := applyJSONPatch(obj, patch)
+			if err != nil {
+				t.Fatalf("failed to apply patch %s: %v", resp.Patch, err)
+			}
+			expected := unmarshalYAML(t, tc.expected)
+			if !reflect.DeepEqual(expected, result) {
+				t.Errorf("expected %v but got %v", expected, result)
+			}
+		})
+	}
+}
+
+func TestMutatingWebhookUnchanged(t *testing.T) {
+	w := NewMutatingWebhook()
+	w.Register(podGVK, compileMutation(t, podGVK, map[string]any{"mutation": `
+Object{
+  metadata: Object.metadata{
+    labels: {"app": oldObject.metadata.labels.app}
+  }
+}`}))
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	cases := []struct {
+		name   string
+		review string
+	}{
+		{name: "no changes", review: "pod-create.json"},
+		{name: "not a create or update", review: "pod-delete.json"},
+		{name: "no mutations of kind", review: "deployment-update.json"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := post(t, server.URL, readReview(t, tc.review))
+			if !resp.Allowed {
+				t.Fatalf("expected request to be allowed, but got %v", resp.Result)
+			}
+			if resp.PatchType != nil || len(resp.Patch) > 0 {
+				t.Errorf("expected no patch, but got %s", resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutatingWebhookMutationError(t *testing.T) {
+	w := NewMutatingWebhook()
+	w.Register(podGVK, compileMutation(t, podGVK, map[string]any{"mutation": `
+Object{
+  metadata: Object.metadata{
+    labels: {"tier": oldObject.metadata.labels.tier}
+  }
+}`}))
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	resp := post(t, server.URL, readReview(t, "pod-create.json"))
+	if resp.Allowed {
+		t.Fatal("expected request to be denied")
+	}
+	if resp.Result == nil || resp.Result.Code != http.StatusInternalServerError || !strings.Contains(resp.Result.Message, "no such key: tier") {
+		t.Errorf("expected an internal error for the missing label, but got %v", resp.Result)
+	}
+}
+
+func TestMutatingWebhookPolicies(t *testing.T) {
+	policies, err := policy.LoadFile(filepath.Join(testdata, "policy/policies.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMutatingWebhook()
+	for _, p := range policies.MutationPolicies {
+		compiled, err := policy.CompileMutationPolicy(p, builtin.NewResolver())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.RegisterPolicy(compiled)
+	}
+	server := httptest.NewServer(w)
+	defer server.Close()
+
+	cases := []struct {
+		name          string
+		review        string
+		namespace     string
+		expectedPatch string
+	}{
+		{
+			name:          "pod matched by both policies",
+			review:        "pod-create.json",
+			expectedPatch: `[{"op":"add","path":"/metadata/labels/team","value":"payments"},{"op":"add","path":"/spec/containers/1","value":{"args":["--port=15001"],"image":"proxy:1.0","name":"proxy"}}]`,
+		},
+		{
+			name:          "pod in another namespace",
+			review:        "pod-create.json",
+			namespace:     "kube-system",
+			expectedPatch: `[{"op":"add","path":"/metadata/labels/team","value":"payments"}]`,
+		},
+		{
+			name:          "deployment",
+			review:        "deployment-update.json",
+			expectedPatch: `[{"op":"add","path":"/metadata/labels","value":{"team":"payments"}}]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			review := readReview(t, tc.review)
+			if len(tc.namespace) > 0 {
+				review.Request.Namespace = tc.namespace
+			}
+			resp := post(t, server.URL, review)
+			if !resp.Allowed {
+				t.Fatalf("expected request to be allowed, but got %v", resp.Result)
+			}
+			if string(resp.Patch) != tc.expectedPatch {
+				t.Errorf("expected patch %s but got %s", tc.expectedPatch, resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutatingWebhookMatchConditions(t *testing.T) {
+	mutation := map[string]any{"mutation": `Object{metadata: Object.metadata{labels: {"admitted": "true"}}}`}
+	cases := []struct {
+		name          string
+		condition     string
+		expectedPatch string
+	}{
+		{
+			name:          "request attributes match",
+			condition:     "request.operation == 'CREATE' && request.namespace == 'default' && request.userInfo.username == 'admin'",
+			expectedPatch: `[{"op":"add","path":"/metadata/labels/admitted","value":"true"}]`,
+		},
+		{
+			name:      "request attributes do not match",
+			condition: "request.operation == 'UPDATE'",
+		},
+		{
+			name:          "objects are not request attributes",
+			condition:     "!has(dyn(request).object) && !has(dyn(request).oldObject)",
+			expectedPatch: `[{"op":"add","path":"/metadata/labels/admitted","value":"true"}]`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := NewMutatingWebhook()
+			condition := apply.MatchCondition{Name: "condition", Expression: tc.condition}
+			w.Register(podGVK, compileMutation(t, podGVK, mutation, apply.WithMatchConditions(apply.MatchFailurePolicyFail, condition)))
+			resp := w.Admit(readReview(t, "pod-create.json").Request)
+			if !resp.Allowed {
+				t.Fatalf("expected request to be allowed, but got %v", resp.Result)
+			}
+			if string(resp.Patch) != tc.expectedPatch {
+				t.Errorf("expected patch %s but got %s", tc.expectedPatch, resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutatingWebhookBadRequests(t *testing.T) {
+	server := httptest.NewServer(NewMutatingWebhook())
+	defer server.Close()
+
+	cases := []struct {
+		name           string
+		method         string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			contentType:    "application/json",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "wrong content type",
+			method:         http.MethodPost,
+			contentType:    "application/yaml",
+			body:           "{}",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "malformed content type",
+			method:         http.MethodPost,
+			contentType:    "application/json; charset",
+			body:           "{}",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			// The content type is accepted, and the review is rejected only for having no request.
+			name:           "content type with charset",
+			method:         http.MethodPost,
+			contentType:    "application/json; charset=utf-8",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "malformed review",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           "{",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unsupported review version",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview", "request": {"uid": "1"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "no request",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, server.URL, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("expected status %d but got %d", tc.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func compileMutation(t *testing.T, gvk schema.GroupVersionKind, patch any, opts ...apply.CompileOption) *apply.CompiledMutation {
+	t.Helper()
+	s, err := builtin.NewResolver().ResolveSchema(gvk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutation, err := apply.CompileMutateBasicMerge(s, patch, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mutation
+}
+
+func readReview(t *testing.T, file string) *admissionv1.AdmissionReview {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(testdata, "webhook", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(data, review); err != nil {
+		t.Fatal(err)
+	}
+	return review
+}
+
+func post(t *testing.T, url string, review *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	t.Helper()
+	data, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	result := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.APIVersion != "admission.k8s.io/v1" || result.Kind != "AdmissionReview" {
+		t.Errorf("expected an admission.k8s.io/v1 AdmissionReview but got %s %s", result.APIVersion, result.Kind)
+	}
+	if result.Response == nil {
+		t.Fatal("expected a response")
+	}
+	return result.Response
+}
+
+func unmarshalYAML(t *testing.T, s string) any {
+	t.Helper()
+	data, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result any
+	if err := utiljson.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// applyJSONPatch applies the add, remove and replace operations of a JSON Patch, which are the
+// operations generated by jsonpatch.Create, to an unstructured object.
+func applyJSONPatch(obj any, patch []map[string]any) (any, error) {
+	for _, op := range patch {
+		path, _ := op["path"].(string)
+		var tokens []string
+		if len(path) > 0 {
+			tokens = strings.Split(strings.TrimPrefix(path, "/"), "/")
+		}
+		for i, token := range tokens {
+			tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		}
+		// Values decoded by encoding/json use float64 for numbers, so re-decode them in the form
+		// used for objects.
+		value, err := json.Marshal(op["value"])
+		if err != nil {
+			return nil, err
+		}
+		var v any
+		if err := utiljson.Unmarshal(value, &v); err != nil {
+			return nil, err
+		}
+		obj, err = applyOperation(obj, op["op"].(string), tokens, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op["op"], path, err)
+		}
+	}
+	return obj, nil
+}
+
+func applyOperation(obj any, op string, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		if op == "remove" {
+			return nil, nil
+		}
+		return value, nil
+	}
+	switch o := obj.(type) {
+	case map[string]any:
+		child, ok := o[tokens[0]]
+		if len(tokens) == 1 {
+			switch {
+			case op == "remove" && ok:
+				delete(o, tokens[0])
+			case op == "add" || (op == "replace" && ok):
+				o[tokens[0]] = value
+			default:
+				return nil, fmt.Errorf("no such field %q", tokens[0])
+			}
+			return o, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("no such field %q", tokens[0])
+		}
+		updated, err := applyOperation(child, op, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		o[tokens[0]] = updated
+		return o, nil
+	case []any:
+		i, err := strconv.Atoi(tokens[0])
+		if len(tokens) == 1 && op == "add" && err == nil && i >= 0 && i <= len(o) {
+			return append(o[:i], append([]any{value}, o[i:]...)...), nil
+		}
+		if err != nil || i < 0 || i >= len(o) {
+			return nil, fmt.Errorf("invalid index %q", tokens[0])
+		}
+		if len(tokens) == 1 && op == "remove" {
+			return append(o[:i], o[i+1:]...), nil
+		}
+		updated, err := applyOperation(o[i], op, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		o[i] = updated
+		return o, nil
+	default:
+		return nil, fmt.Errorf("cannot apply %s to %T", op, obj)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// maxRequestBytes is the largest review accepted, which is the limit on the size of the request
+// bodies that the kube-apiserver accepts, plus some room for the rest of the review.
+const maxRequestBytes = 4 * 1024 * 1024
+
+// review is an AdmissionReview or ConversionReview.
+type review interface {
+	GroupVersionKind() schema.GroupVersionKind
+}
+
+// decodeReview decodes the review in the body of req into r, and checks that it is of the
+// expected kind. Malformed requests are rejected with an HTTP error status, since there is no
+// request UID to respond to, and false is returned.
+func decodeReview(rw http.ResponseWriter, req *http.Request, r review, expected schema.GroupVersionKind) bool {
+	if req.Method != http.MethodPost {
+		http.Error(rw, fmt.Sprintf("unsupported method %s, only POST is supported", req.Method), http.StatusMethodNotAllowed)
+		return false
+	}
+	// Parameters of the content type, such as the charset, are ignored, since JSON is UTF-8.
+	contentType := req.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		http.Error(rw, fmt.Sprintf("unsupported content type %q, only application/json is supported", contentType), http.StatusUnsupportedMediaType)
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestBytes+1))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	if len(body) > maxRequestBytes {
+		http.Error(rw, "request is too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if err := json.Unmarshal(body, r); err != nil {
+		http.Error(rw, fmt.Sprintf("failed to decode %s: %v", expected.Kind, err), http.StatusBadRequest)
+		return false
+	}
+	if gvk := r.GroupVersionKind(); gvk != expected {
+		http.Error(rw, fmt.Sprintf("unsupported review %s, only %s is supported", gvk, expected), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeReview writes the review r as the response.
+func writeReview(rw http.ResponseWriter, r review) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("failed to encode %s: %v", r.GroupVersionKind().Kind, err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// applySafely calls apply on obj, returning any panic as an error so that a single object that
+// cannot be mutated or converted fails only the request it is part of.
+func applySafely(apply func(any) (any, error), obj any) (result any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return apply(obj)
+}